@@ -0,0 +1,114 @@
+package cryptd
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownAnnotation is returned in strict mode when an encrypted layer
+// carries an annotation that is not written by the layer encryption
+var ErrUnknownAnnotation = errors.New("unknown annotation on encrypted layer")
+
+// encAnnotations are the annotations the layer encryption writes to encrypted layers
+var encAnnotations = map[string]struct{}{
+	"org.opencontainers.image.enc.keys.jwe":   {},
+	"org.opencontainers.image.enc.keys.pkcs7": {},
+	"org.opencontainers.image.enc.keys.pgp":   {},
+	"org.opencontainers.image.enc.pubopts":    {},
+}
+
+// uncompressedAnnotation holds the DiffID of a layer, as written by containerd
+const uncompressedAnnotation = "containerd.io/uncompressed"
+
+// passthroughAnnotations are annotations written by image builders and containerd that
+// encrypted layers keep; they describe the layer and are accepted in strict mode
+var passthroughAnnotations = map[string]struct{}{
+	"buildkit/rewritten-timestamp": {},
+	uncompressedAnnotation:         {},
+}
+
+// checkAnnotations returns a manifestFunc that errors on encrypted layers carrying
+// annotations other than encAnnotations, or removes them if strip is set
+func checkAnnotations(strip bool) manifestFunc {
+	return func(ctx context.Context, cs content.Store, m *ocispec.Manifest) (bool, error) {
+		var modified bool
+		for i, layer := range m.Layers {
+			if !IsEncryptedMediaType(layer.MediaType) {
+				continue
+			}
+			for key := range layer.Annotations {
+				if _, ok := encAnnotations[key]; ok {
+					continue
+				}
+				if _, ok := passthroughAnnotations[key]; ok {
+					continue
+				}
+				if !strip {
+					return false, errors.Wrapf(ErrUnknownAnnotation, "layer %s has annotation %s", layer.Digest, key)
+				}
+				delete(m.Layers[i].Annotations, key)
+				modified = true
+			}
+		}
+		return modified, nil
+	}
+}
+
+// base64Encodings are the encodings the values of the encryption annotations are
+// found in; the layer encryption itself reads and writes standard base64 only
+var base64Encodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+// DecodeBase64 decodes a value of an encryption annotation that may be encoded with
+// standard or URL safe base64, with or without padding
+func DecodeBase64(s string) ([]byte, error) {
+	var err error
+	for _, enc := range base64Encodings {
+		var p []byte
+		if p, err = enc.DecodeString(s); err == nil {
+			return p, nil
+		}
+	}
+	return nil, err
+}
+
+// normalizeAnnotations returns a manifestFunc that re-encodes the values of the
+// encryption annotations of encrypted layers with standard base64, as expected by
+// the layer encryption
+func normalizeAnnotations() manifestFunc {
+	return func(ctx context.Context, cs content.Store, m *ocispec.Manifest) (bool, error) {
+		var modified bool
+		for i, layer := range m.Layers {
+			if !IsEncryptedMediaType(layer.MediaType) {
+				continue
+			}
+			for key, value := range layer.Annotations {
+				if _, ok := encAnnotations[key]; !ok || value == "" {
+					continue
+				}
+				parts := strings.Split(value, ",")
+				for j, part := range parts {
+					p, err := DecodeBase64(part)
+					if err != nil {
+						return false, errors.Wrapf(err, "layer %s has an invalid annotation %s", layer.Digest, key)
+					}
+					parts[j] = base64.StdEncoding.EncodeToString(p)
+				}
+				if normalized := strings.Join(parts, ","); normalized != value {
+					m.Layers[i].Annotations[key] = normalized
+					modified = true
+				}
+			}
+		}
+		return modified, nil
+	}
+}
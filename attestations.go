@@ -0,0 +1,62 @@
+package cryptd
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// dockerReferenceType is the index annotation buildkit marks attestation manifests with
+const dockerReferenceType = "vnd.docker.reference.type"
+
+// isAttestationManifest checks whether the index entry is a manifest that cannot be run
+// but is attached to one, such as the SBOM and provenance attestations of buildkit;
+// these carry the unknown/unknown platform
+func isAttestationManifest(desc ocispec.Descriptor) bool {
+	if desc.Annotations[dockerReferenceType] == "attestation-manifest" {
+		return true
+	}
+	return desc.Platform != nil && desc.Platform.OS == "unknown" && desc.Platform.Architecture == "unknown"
+}
+
+// attestationLayers returns the digests of the layers of the attestation manifests of
+// the index desc, including nested indexes
+func attestationLayers(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (map[digest.Digest]bool, error) {
+	layers := make(map[digest.Digest]bool)
+	if !isIndexMediaType(desc.MediaType) {
+		return layers, nil
+	}
+	var idx index
+	if err := readJSON(ctx, cs, desc, &idx); err != nil {
+		return nil, err
+	}
+	for _, child := range idx.Manifests {
+		switch {
+		case isIndexMediaType(child.MediaType):
+			nested, err := attestationLayers(ctx, cs, child)
+			if err != nil {
+				return nil, err
+			}
+			for dgst := range nested {
+				layers[dgst] = true
+			}
+		case isManifestMediaType(child.MediaType) && isAttestationManifest(child):
+			if _, err := cs.Info(ctx, child.Digest); errdefs.IsNotFound(err) {
+				continue
+			}
+			manifests, err := readManifests(ctx, cs, child)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range manifests {
+				for _, layer := range m.Layers {
+					layers[layer.Digest] = true
+				}
+			}
+		}
+	}
+	return layers, nil
+}
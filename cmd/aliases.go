@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// aliasPrefix marks recipients naming an alias of the --recipient-aliases file
+const aliasPrefix = "@"
+
+// readRecipientAliases reads the alias file, a JSON object mapping alias names to
+// the recipients they stand for; these may name other aliases themselves
+func readRecipientAliases(path string) (map[string][]string, error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read recipient aliases %s", path)
+	}
+	var aliases map[string][]string
+	if err := json.Unmarshal(p, &aliases); err != nil {
+		return nil, errors.Wrapf(err, "could not parse recipient aliases %s", path)
+	}
+	return aliases, nil
+}
+
+// expandRecipients replaces the @<name> recipients by the recipients of the alias and
+// then the jwe and pkcs7 recipients with a file name glob by one per matching file
+func expandRecipients(context *cli.Context, recipients []string) ([]string, error) {
+	recipients, err := expandRecipientAliases(context, recipients)
+	if err != nil {
+		return nil, err
+	}
+	return expandRecipientGlobs(recipients, context.Bool("allow-empty-glob"))
+}
+
+// expandRecipientAliases replaces the @<name> recipients by the recipients of the alias
+func expandRecipientAliases(context *cli.Context, recipients []string) ([]string, error) {
+	var aliases map[string][]string
+	for _, recipient := range recipients {
+		if !strings.HasPrefix(recipient, aliasPrefix) {
+			continue
+		}
+		path := context.String("recipient-aliases")
+		if path == "" {
+			return nil, errors.Errorf("recipient %s is an alias but no --recipient-aliases file was given", recipient)
+		}
+		var err error
+		if aliases, err = readRecipientAliases(path); err != nil {
+			return nil, err
+		}
+		break
+	}
+	if aliases == nil {
+		return recipients, nil
+	}
+	return expandAliases(aliases, recipients, nil)
+}
+
+// expandAliases expands recipients recursively; path holds the aliases being
+// expanded so that cycles are detected
+func expandAliases(aliases map[string][]string, recipients, path []string) ([]string, error) {
+	var expanded []string
+	for _, recipient := range recipients {
+		if !strings.HasPrefix(recipient, aliasPrefix) {
+			expanded = append(expanded, recipient)
+			continue
+		}
+		name := strings.TrimPrefix(recipient, aliasPrefix)
+		for i, p := range path {
+			if p == name {
+				return nil, errors.Errorf("recipient alias cycle %s", strings.Join(append(path[i:], name), " -> "))
+			}
+		}
+		members, ok := aliases[name]
+		if !ok {
+			return nil, errors.Errorf("unknown recipient alias %s", recipient)
+		}
+		e, err := expandAliases(aliases, members, append(path, name))
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, e...)
+	}
+	return expanded, nil
+}
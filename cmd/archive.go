@@ -0,0 +1,93 @@
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/images/archive"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// importArchive imports the images of the OCI or Docker tar archive at path into the
+// image store under temporary names. It returns the temporary name of the image named
+// name in the archive, or of its only image if name is empty, and a function removing
+// the temporary images again.
+func importArchive(ctx gocontext.Context, client *containerd.Client, path, name string) (string, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "could not open archive %s", path)
+	}
+	defer f.Close()
+
+	prefix := fmt.Sprintf("import-cryptd-%d/", time.Now().UnixNano())
+	imgs, err := client.Import(ctx, f,
+		containerd.WithImageRefTranslator(func(ref string) string {
+			return prefix + ref
+		}),
+		containerd.WithDigestRef(func(dgst digest.Digest) string {
+			return prefix + dgst.String()
+		}),
+		containerd.WithAllPlatforms(true),
+	)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "could not import archive %s", path)
+	}
+
+	remove := func() {
+		is := client.ImageService()
+		for _, img := range imgs {
+			if err := is.Delete(ctx, img.Name); err != nil {
+				logrus.WithError(err).Warnf("could not remove imported image %s", img.Name)
+			}
+		}
+	}
+
+	switch {
+	case name != "":
+		for _, img := range imgs {
+			if img.Name == prefix+name {
+				return img.Name, remove, nil
+			}
+		}
+		remove()
+		return "", nil, errors.Errorf("image %s not found in archive %s", name, path)
+	case len(imgs) == 1:
+		return imgs[0].Name, remove, nil
+	default:
+		remove()
+		return "", nil, errors.Errorf("archive %s holds %d images; please provide the name of the image to encrypt", path, len(imgs))
+	}
+}
+
+// exportArchive writes the image with all its platforms to a tar archive at path. The
+// oci format is an OCI image layout; the docker format adds the manifest.json of
+// 'docker load' to it.
+func exportArchive(ctx gocontext.Context, client *containerd.Client, image containerd.Image, path, format string) error {
+	opts := []archive.ExportOpt{
+		archive.WithImage(client.ImageService(), image.Name()),
+		archive.WithAllPlatforms(),
+	}
+	switch format {
+	case "docker":
+	case "oci":
+		opts = append(opts, archive.WithSkipDockerManifest())
+	default:
+		return errors.Errorf("unsupported archive format %s; expected oci or docker", format)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "could not create archive %s", path)
+	}
+	if err := client.Export(ctx, f, opts...); err != nil {
+		f.Close()
+		os.Remove(path)
+		return errors.Wrapf(err, "could not write archive %s", path)
+	}
+	return f.Close()
+}
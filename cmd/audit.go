@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/crosbymichael/cryptd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// keyReuse is a wrapped layer key found on layers with different blobs
+type keyReuse struct {
+	Scheme string
+	Layers []digest.Digest
+}
+
+// auditKeyReuse finds distinct encrypted layers that share a wrapped layer key. Key
+// wrapping is randomized, so the same wrapped key on two layers means that the wrapped
+// key was copied and both layers are encrypted with the same layer key (DEK). Wrapped
+// keys are compared per recipient: the encrypted key of every JWE recipient, of every
+// PKCS7 recipient and every PGP key packet.
+func auditKeyReuse(descs []ocispec.Descriptor) ([]keyReuse, error) {
+	var (
+		layers  = make(map[string]map[digest.Digest]bool)
+		schemes = make(map[string]string)
+	)
+	for _, desc := range descs {
+		if !cryptd.IsEncryptedMediaType(desc.MediaType) {
+			continue
+		}
+		for annotation, scheme := range keyAnnotations {
+			value := desc.Annotations[annotation]
+			if value == "" {
+				continue
+			}
+			for _, b64 := range strings.Split(value, ",") {
+				data, err := cryptd.DecodeBase64(b64)
+				if err != nil {
+					return nil, errors.Wrapf(err, "could not decode %s annotation of layer %s", scheme, desc.Digest)
+				}
+				wrapped, err := wrappedKeys(scheme, data)
+				if err != nil {
+					return nil, errors.Wrapf(err, "layer %s", desc.Digest)
+				}
+				for _, w := range wrapped {
+					id := scheme + ":" + digest.FromBytes(w).String()
+					if layers[id] == nil {
+						layers[id] = make(map[digest.Digest]bool)
+					}
+					layers[id][desc.Digest] = true
+					schemes[id] = scheme
+				}
+			}
+		}
+	}
+
+	var reused []keyReuse
+	for id, dgsts := range layers {
+		if len(dgsts) < 2 {
+			continue
+		}
+		r := keyReuse{Scheme: schemes[id]}
+		for dgst := range dgsts {
+			r.Layers = append(r.Layers, dgst)
+		}
+		sort.Slice(r.Layers, func(i, j int) bool { return r.Layers[i] < r.Layers[j] })
+		reused = append(reused, r)
+	}
+	sort.Slice(reused, func(i, j int) bool {
+		return reused[i].Layers[0] < reused[j].Layers[0]
+	})
+	return reused, nil
+}
+
+// wrappedKeys splits the wrapped key data of an encryption annotation entry into the
+// wrapped keys of its recipients
+func wrappedKeys(scheme string, data []byte) ([][]byte, error) {
+	switch scheme {
+	case "jwe":
+		var jwe struct {
+			EncryptedKey string `json:"encrypted_key"`
+			Recipients   []struct {
+				EncryptedKey string `json:"encrypted_key"`
+			} `json:"recipients"`
+		}
+		if err := json.Unmarshal(data, &jwe); err != nil {
+			return nil, errors.Wrap(err, "could not parse JWE")
+		}
+		var keys [][]byte
+		if jwe.EncryptedKey != "" {
+			keys = append(keys, []byte(jwe.EncryptedKey))
+		}
+		for _, r := range jwe.Recipients {
+			if r.EncryptedKey != "" {
+				keys = append(keys, []byte(r.EncryptedKey))
+			}
+		}
+		return keys, nil
+	case "pkcs7":
+		var ci pkcs7ContentInfo
+		if _, err := asn1.Unmarshal(data, &ci); err != nil {
+			return nil, errors.Wrap(err, "could not parse PKCS7 envelope")
+		}
+		var env pkcs7EnvelopedData
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &env); err != nil {
+			return nil, errors.Wrap(err, "could not parse PKCS7 enveloped data")
+		}
+		var keys [][]byte
+		for _, ri := range env.RecipientInfos {
+			keys = append(keys, ri.EncryptedKey)
+		}
+		return keys, nil
+	}
+	// a PGP entry is the encrypted message of the layer key
+	return [][]byte{data}, nil
+}
+
+func joinDigests(dgsts []digest.Digest) string {
+	s := make([]string, len(dgsts))
+	for i, d := range dgsts {
+		s[i] = d.String()
+	}
+	return strings.Join(s, ", ")
+}
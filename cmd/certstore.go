@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// defaultCertDir is the directory searched for pkcs7:subject:<cn> recipients
+const defaultCertDir = "/etc/ssl/certs"
+
+// findCertificateBySubject searches the certificates in dir for the one with the
+// given subject common name and returns it PEM encoded. Certificates may be stored
+// PEM encoded, several per file, or DER encoded; a certificate found in several
+// files counts as a single match.
+func findCertificateBySubject(dir, cn string) ([]byte, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read certificate directory %s", dir)
+	}
+
+	var matches []*x509.Certificate
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		for _, cert := range parseCertificates(data) {
+			if cert.Subject.CommonName != cn || containsCertificate(matches, cert) {
+				continue
+			}
+			matches = append(matches, cert)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, errors.Errorf("no certificate with subject %s found in %s", cn, dir)
+	case 1:
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: matches[0].Raw}), nil
+	default:
+		return nil, errors.Errorf("%d certificates with subject %s found in %s", len(matches), cn, dir)
+	}
+}
+
+// parseCertificates returns the certificates in data; data that is neither
+// PEM nor DER encoded certificates yields none
+func parseCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 {
+		if cert, err := x509.ParseCertificate(data); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+func containsCertificate(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if bytes.Equal(c.Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	gocontext "context"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/defaults"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	dialBackoffInitial = 100 * time.Millisecond
+	dialBackoffMax     = 2 * time.Second
+)
+
+// dialContainerd connects to the containerd daemon; it is replaced to fake the daemon
+var dialContainerd = func() (*containerd.Client, error) {
+	return containerd.New(defaults.DefaultAddress)
+}
+
+// newContainerdClient connects to the containerd daemon. With --wait-for-containerd the
+// dial is retried with an increasing delay until the daemon is reachable or the
+// duration elapsed, for commands started before the daemon during boot.
+func newContainerdClient(ctx gocontext.Context, context *cli.Context) (*containerd.Client, error) {
+	wait := context.GlobalDuration("wait-for-containerd")
+	client, err := dialContainerd()
+	if err == nil || wait <= 0 {
+		return client, err
+	}
+
+	deadline := time.Now().Add(wait)
+	backoff := dialBackoffInitial
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, errors.Wrapf(err, "containerd was not reachable within %s", wait)
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		logrus.WithError(err).Debugf("containerd not reachable, retrying in %s", backoff)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if client, err = dialContainerd(); err == nil {
+			return client, nil
+		}
+		if backoff *= 2; backoff > dialBackoffMax {
+			backoff = dialBackoffMax
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// colorOutput is set when the human-readable output goes to a terminal and colors
+// were not disabled with --no-color or NO_COLOR
+var colorOutput bool
+
+// the colors all have escape sequences of the same length, so that the columns of a
+// tabwriter stay aligned as long as every cell of a column is colorized
+const (
+	colorRed     = "31"
+	colorGreen   = "32"
+	colorYellow  = "33"
+	colorDefault = "39"
+)
+
+// setupColor enables colors for terminals; logs are written without colors as well
+// when colors are disabled
+func setupColor(clix *cli.Context) {
+	disabled := clix.GlobalBool("no-color") || os.Getenv("NO_COLOR") != ""
+	colorOutput = !disabled && terminal.IsTerminal(int(os.Stdout.Fd()))
+	if disabled {
+		logrus.SetFormatter(&logrus.TextFormatter{DisableColors: true})
+	}
+}
+
+// colorize returns s in the color if colors are enabled
+func colorize(color, s string) string {
+	if !colorOutput || s == "" {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// resultColor returns the color of the outcome of an operation on an image or layer
+func resultColor(result string) string {
+	switch result {
+	case "encrypted", "decrypted", "recrypted", "rewrapped", "reencrypted":
+		return colorGreen
+	case "failed":
+		return colorRed
+	case "skipped", "unchanged":
+		return colorYellow
+	}
+	return colorDefault
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	gocontext "context"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/platforms"
+	"github.com/crosbymichael/cryptd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// keyAnnotations maps the annotations holding the wrapped layer keys to their scheme
+var keyAnnotations = map[string]string{
+	"org.opencontainers.image.enc.keys.jwe":   "jwe",
+	"org.opencontainers.image.enc.keys.pkcs7": "pkcs7",
+	"org.opencontainers.image.enc.keys.pgp":   "pgp",
+}
+
+// layerEncryption describes how a layer is encrypted
+type layerEncryption struct {
+	MediaType  string   `json:"mediaType"`
+	Schemes    []string `json:"schemes,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+}
+
+// layerComparison holds the differences of the layers with the same number and platform
+// of two images; A or B is missing if only one of the images has the layer
+type layerComparison struct {
+	Platform    string           `json:"platform,omitempty"`
+	Index       int32            `json:"index"`
+	A           *layerEncryption `json:"a,omitempty"`
+	B           *layerEncryption `json:"b,omitempty"`
+	Differences []string         `json:"differences"`
+}
+
+var compareCommand = cli.Command{
+	Name:      "compare",
+	Usage:     "Compare the encryption schemes, recipients and media types of the layers of two images",
+	ArgsUsage: "<refA> <refB>",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "platform",
+			Usage: "For which platform to compare the layers; by default all platforms are compared",
+		}, cli.StringFlag{
+			Name:  "platform-default-os",
+			Usage: "The OS used to complete platforms that only name an architecture (i.e. amd64)",
+			Value: "linux",
+		}, cli.BoolFlag{
+			Name:  "all",
+			Usage: "List all layers, not only the ones that differ",
+		}, cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the comparison as JSON",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		refA, refB := context.Args().Get(0), context.Args().Get(1)
+		if refA == "" || refB == "" {
+			return errors.New("please provide the names of the two images to compare")
+		}
+
+		ctx := appContext()
+		ctdClient, err := newContainerdClient(ctx, context)
+		if err != nil {
+			return err
+		}
+
+		layersA, err := describeLayers(ctx, ctdClient, context, refA)
+		if err != nil {
+			return err
+		}
+		layersB, err := describeLayers(ctx, ctdClient, context, refB)
+		if err != nil {
+			return err
+		}
+		comparisons := compareLayers(layersA, layersB, context.Bool("all"))
+
+		if context.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(comparisons)
+		}
+		if len(comparisons) == 0 {
+			fmt.Println("the encryption metadata of the layers is the same")
+			return nil
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+		fmt.Fprintln(tw, "PLATFORM\tINDEX\tDIFFERENCES")
+		for _, c := range comparisons {
+			diff := strings.Join(c.Differences, "; ")
+			if diff == "" {
+				diff = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", c.Platform, c.Index, colorize(colorYellow, diff))
+		}
+		return tw.Flush()
+	},
+}
+
+// layerKey identifies a layer by platform and number for comparing images
+type layerKey struct {
+	platform string
+	index    int32
+}
+
+// describeLayers describes the encryption of the layers of the image ref
+func describeLayers(ctx gocontext.Context, client *containerd.Client, context *cli.Context, ref string) (map[layerKey]*layerEncryption, error) {
+	lis, _, err := getImageLayerInfos(client, ctx, ref, nil, nil, context.StringSlice("platform"), context.String("platform-default-os"))
+	if err != nil {
+		return nil, err
+	}
+	layers := make(map[layerKey]*layerEncryption, len(lis))
+	for _, li := range lis {
+		key := layerKey{index: int32(li.Index)}
+		if li.Descriptor.Platform != nil {
+			key.platform = platforms.Format(*li.Descriptor.Platform)
+		}
+		enc, err := describeLayerEncryption(li.Descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not describe layer %s of %s", li.Descriptor.Digest, ref)
+		}
+		layers[key] = enc
+	}
+	return layers, nil
+}
+
+// describeLayerEncryption reads the schemes and recipients from the encryption
+// annotations of the layer. PGP recipients are given by key id and PKCS7 recipients
+// by certificate issuer and serial number; the JWE key wrapping does not record the
+// recipient keys, so JWE recipients are listed by their number and algorithm.
+func describeLayerEncryption(desc ocispec.Descriptor) (*layerEncryption, error) {
+	enc := &layerEncryption{MediaType: desc.MediaType}
+	if !cryptd.IsEncryptedMediaType(desc.MediaType) {
+		return enc, nil
+	}
+	for annotation, scheme := range keyAnnotations {
+		value := desc.Annotations[annotation]
+		if value == "" {
+			continue
+		}
+		enc.Schemes = append(enc.Schemes, scheme)
+		for _, b64 := range strings.Split(value, ",") {
+			data, err := cryptd.DecodeBase64(b64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not decode %s annotation", scheme)
+			}
+			var recipients []string
+			switch scheme {
+			case "pgp":
+				ids, err := gpgKeyIdsFromPacket(data)
+				if err != nil {
+					return nil, err
+				}
+				for _, id := range ids {
+					recipients = append(recipients, fmt.Sprintf("pgp:%016X", id))
+				}
+			case "jwe":
+				recipients, err = jweRecipients(data)
+			case "pkcs7":
+				recipients, err = pkcs7Recipients(data)
+			}
+			if err != nil {
+				return nil, err
+			}
+			enc.Recipients = append(enc.Recipients, recipients...)
+		}
+	}
+	sort.Strings(enc.Schemes)
+	sort.Strings(enc.Recipients)
+	return enc, nil
+}
+
+// jweRecipients lists the recipients of a JWE in JSON serialization by algorithm
+func jweRecipients(data []byte) ([]string, error) {
+	type header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var jwe struct {
+		Header     *header `json:"header"`
+		Recipients []struct {
+			Header header `json:"header"`
+		} `json:"recipients"`
+	}
+	if err := json.Unmarshal(data, &jwe); err != nil {
+		return nil, errors.Wrap(err, "could not parse JWE")
+	}
+	headers := make([]header, 0, len(jwe.Recipients))
+	for _, r := range jwe.Recipients {
+		headers = append(headers, r.Header)
+	}
+	if jwe.Header != nil {
+		headers = append(headers, *jwe.Header)
+	}
+	var recipients []string
+	for i, h := range headers {
+		if h.Kid != "" {
+			recipients = append(recipients, fmt.Sprintf("jwe:%s", h.Kid))
+			continue
+		}
+		recipients = append(recipients, fmt.Sprintf("jwe:#%d(%s)", i+1, h.Alg))
+	}
+	return recipients, nil
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7EnvelopedData struct {
+	Version        int
+	RecipientInfos []pkcs7RecipientInfo `asn1:"set"`
+	Rest           asn1.RawValue
+}
+
+type pkcs7RecipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  pkcs7IssuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// pkcs7Recipients lists the recipients of a PKCS7 envelope by the issuer and serial
+// number of their certificates
+func pkcs7Recipients(data []byte) ([]string, error) {
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(data, &ci); err != nil {
+		return nil, errors.Wrap(err, "could not parse PKCS7 envelope")
+	}
+	var env pkcs7EnvelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &env); err != nil {
+		return nil, errors.Wrap(err, "could not parse PKCS7 enveloped data")
+	}
+	var recipients []string
+	for _, ri := range env.RecipientInfos {
+		var issuer pkix.RDNSequence
+		if _, err := asn1.Unmarshal(ri.IssuerAndSerialNumber.Issuer.FullBytes, &issuer); err != nil {
+			return nil, errors.Wrap(err, "could not parse PKCS7 recipient issuer")
+		}
+		var name pkix.Name
+		name.FillFromRDNSequence(&issuer)
+		recipients = append(recipients, fmt.Sprintf("pkcs7:%s/%s", name.String(), ri.IssuerAndSerialNumber.SerialNumber))
+	}
+	return recipients, nil
+}
+
+// compareLayers compares the layers of two images; unless all is set only layers that
+// differ are returned
+func compareLayers(a, b map[layerKey]*layerEncryption, all bool) []layerComparison {
+	keys := make(map[layerKey]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	sorted := make([]layerKey, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].platform != sorted[j].platform {
+			return sorted[i].platform < sorted[j].platform
+		}
+		return sorted[i].index < sorted[j].index
+	})
+
+	var comparisons []layerComparison
+	for _, k := range sorted {
+		c := layerComparison{
+			Platform:    k.platform,
+			Index:       k.index,
+			A:           a[k],
+			B:           b[k],
+			Differences: []string{},
+		}
+		switch {
+		case c.A == nil:
+			c.Differences = append(c.Differences, "layer only in B")
+		case c.B == nil:
+			c.Differences = append(c.Differences, "layer only in A")
+		default:
+			if c.A.MediaType != c.B.MediaType {
+				c.Differences = append(c.Differences, fmt.Sprintf("media type %s != %s", c.A.MediaType, c.B.MediaType))
+			}
+			c.Differences = append(c.Differences, setDifferences("scheme", c.A.Schemes, c.B.Schemes)...)
+			c.Differences = append(c.Differences, setDifferences("recipient", c.A.Recipients, c.B.Recipients)...)
+		}
+		if all || len(c.Differences) > 0 {
+			comparisons = append(comparisons, c)
+		}
+	}
+	return comparisons
+}
+
+// setDifferences describes the values that are in only one of a and b
+func setDifferences(what string, a, b []string) []string {
+	inA := make(map[string]bool, len(a))
+	for _, v := range a {
+		inA[v] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, v := range b {
+		inB[v] = true
+	}
+	var diffs []string
+	for _, v := range a {
+		if !inB[v] {
+			diffs = append(diffs, fmt.Sprintf("%s %s only in A", what, v))
+		}
+	}
+	for _, v := range b {
+		if !inA[v] {
+			diffs = append(diffs, fmt.Sprintf("%s %s only in B", what, v))
+		}
+	}
+	return diffs
+}
@@ -17,125 +17,199 @@
 package main
 
 import (
+	"bytes"
 	gocontext "context"
-
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/containerd/containerd"
-	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/pkg/encryption"
 	encconfig "github.com/containerd/containerd/pkg/encryption/config"
 	encutils "github.com/containerd/containerd/pkg/encryption/utils"
-	"github.com/containerd/containerd/platforms"
-
+	"github.com/crosbymichael/cryptd"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
-// LayerInfo holds information about an image layer
-type LayerInfo struct {
-	// The Number of this layer in the sequence; starting at 0
-	Index      uint32
-	Descriptor ocispec.Descriptor
-}
-
-// isUserSelectedLayer checks whether a layer is user-selected given its number
-// A layer can be described with its (positive) index number or its negative number.
-// The latter is counted relative to the topmost one (-1), the former relative to
-// the bottommost one (0).
-func isUserSelectedLayer(layerIndex, layersTotal int32, layers []int32) bool {
-	if len(layers) == 0 {
-		// convenience for the user; none given means 'all'
-		return true
-	}
-	negNumber := layerIndex - layersTotal
-
-	for _, l := range layers {
-		if l == negNumber || l == layerIndex {
-			return true
+// expandRecipientGlobs replaces jwe and pkcs7 recipients whose file name is a shell
+// glob with one recipient per matching file. A glob matching no file is an error unless
+// allowEmpty is set.
+func expandRecipientGlobs(recipients []string, allowEmpty bool) ([]string, error) {
+	var expanded []string
+	for _, recipient := range recipients {
+		idx := strings.Index(recipient, ":")
+		if idx < 0 {
+			expanded = append(expanded, recipient)
+			continue
+		}
+		protocol, value := recipient[:idx], recipient[idx+1:]
+		if (protocol != "jwe" && protocol != "pkcs7") || !isRecipientGlob(value) {
+			expanded = append(expanded, recipient)
+			continue
+		}
+		matches, err := filepath.Glob(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid glob in recipient %q", recipient)
+		}
+		if len(matches) == 0 && !allowEmpty {
+			return nil, errors.Errorf("recipient %q matches no files", recipient)
+		}
+		for _, m := range matches {
+			expanded = append(expanded, protocol+":"+m)
 		}
 	}
-	return false
+	return expanded, nil
 }
 
-// isUserSelectedPlatform determines whether the platform matches one in
-// the array of user-provided platforms
-func isUserSelectedPlatform(platform *ocispec.Platform, platformList []ocispec.Platform) bool {
-	if len(platformList) == 0 {
-		// convenience for the user; none given means 'all'
-		return true
-	}
-	matcher := platforms.NewMatcher(*platform)
-
-	for _, platform := range platformList {
-		if matcher.Match(platform) {
-			return true
-		}
+// isRecipientGlob returns whether the value of a recipient is a file name glob and not
+// a certificate subject or a remote key source
+func isRecipientGlob(value string) bool {
+	if strings.HasPrefix(value, "subject:") || strings.Contains(value, "://") {
+		return false
 	}
-	return false
+	return strings.ContainsAny(value, "*?[")
 }
 
 // processRecipientKeys sorts the array of recipients by type. Recipients may be either
-// x509 certificates, public keys, or PGP public keys identified by email address or name
-func processRecipientKeys(recipients []string) ([][]byte, [][]byte, [][]byte, error) {
+// x509 certificates, public keys, or PGP public keys identified by email address or name.
+// PGP public keys given as pgp:keyserver:<keyid> are fetched from the keyserver; these are
+// returned in the format of a GPG public keyring so they can be added to the local one.
+// x509 certificates given as pkcs7:subject:<cn> are looked up by subject in the cert dir,
+// those given as piv:[<card>/]<slot> are read from a PIV token and used for PKCS7.
+// The file name globs of jwe and pkcs7 recipients must have been expanded already, see
+// expandRecipients.
+func processRecipientKeys(context *cli.Context, recipients []string) ([][]byte, [][]byte, [][]byte, [][]byte, error) {
 	var (
 		gpgRecipients [][]byte
+		gpgPubKeys    [][]byte
 		pubkeys       [][]byte
 		x509s         [][]byte
 	)
 	for _, recipient := range recipients {
+		if strings.TrimSpace(recipient) == "" {
+			return nil, nil, nil, nil, errors.New("empty recipient given")
+		}
 
 		idx := strings.Index(recipient, ":")
 		if idx < 0 {
-			return nil, nil, nil, errors.New("Invalid recipient format")
+			return nil, nil, nil, nil, errors.Errorf("invalid recipient format %q; expected <protocol>:<value>", recipient)
 		}
 
 		protocol := recipient[:idx]
 		value := recipient[idx+1:]
+		if protocol == "" {
+			return nil, nil, nil, nil, errors.Errorf("recipient %q has no protocol", recipient)
+		}
+		if strings.TrimSpace(value) == "" {
+			return nil, nil, nil, nil, errors.Errorf("recipient %q has no value", recipient)
+		}
+		for _, prefix := range []string{"keyserver:", "subject:"} {
+			if strings.HasPrefix(value, prefix) && strings.TrimSpace(strings.TrimPrefix(value, prefix)) == "" {
+				return nil, nil, nil, nil, errors.Errorf("recipient %q has no value", recipient)
+			}
+		}
 
 		switch protocol {
 		case "pgp":
+			if strings.HasPrefix(value, "keyserver:") {
+				keyserver := context.String("keyserver")
+				if keyserver == "" {
+					keyserver = defaultKeyserver
+				}
+				gpgRecipient, gpgPubKey, err := fetchGPGPublicKey(keyserver, strings.TrimPrefix(value, "keyserver:"))
+				if err != nil {
+					return nil, nil, nil, nil, err
+				}
+				gpgRecipients = append(gpgRecipients, gpgRecipient)
+				gpgPubKeys = append(gpgPubKeys, gpgPubKey)
+				continue
+			}
 			gpgRecipients = append(gpgRecipients, []byte(value))
 		case "jwe":
-			tmp, err := ioutil.ReadFile(value)
+			tmp, err := readKeySource(context, value)
 			if err != nil {
-				return nil, nil, nil, errors.Wrap(err, "Unable to read file")
+				return nil, nil, nil, nil, errors.Wrap(err, "Unable to read file")
 			}
 			if !encutils.IsPublicKey(tmp) {
-				return nil, nil, nil, errors.New("File provided is not a public key")
+				return nil, nil, nil, nil, errors.New("File provided is not a public key")
+			}
+			if err := checkJWEKeyType(recipient, tmp); err != nil {
+				return nil, nil, nil, nil, err
 			}
 			pubkeys = append(pubkeys, tmp)
 
 		case "pkcs7":
-			tmp, err := ioutil.ReadFile(value)
+			if strings.HasPrefix(value, "subject:") {
+				certDir := context.String("cert-dir")
+				if certDir == "" {
+					certDir = defaultCertDir
+				}
+				cert, err := findCertificateBySubject(certDir, strings.TrimPrefix(value, "subject:"))
+				if err != nil {
+					return nil, nil, nil, nil, err
+				}
+				if err := checkPKCS7KeyType(recipient, cert); err != nil {
+					return nil, nil, nil, nil, err
+				}
+				x509s = append(x509s, cert)
+				continue
+			}
+			tmp, err := readKeySource(context, value)
 			if err != nil {
-				return nil, nil, nil, errors.Wrap(err, "Unable to read file")
+				return nil, nil, nil, nil, errors.Wrap(err, "Unable to read file")
 			}
 			if !encutils.IsCertificate(tmp) {
-				return nil, nil, nil, errors.New("File provided is not an x509 cert")
+				return nil, nil, nil, nil, errors.New("File provided is not an x509 cert")
+			}
+			if err := checkPKCS7KeyType(recipient, tmp); err != nil {
+				return nil, nil, nil, nil, err
 			}
 			x509s = append(x509s, tmp)
 
+		case pivScheme:
+			cert, err := readPIVCertificate(value)
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
+			if err := checkPKCS7KeyType(recipient, cert); err != nil {
+				return nil, nil, nil, nil, err
+			}
+			x509s = append(x509s, cert)
+
 		default:
-			return nil, nil, nil, errors.New("Provided protocol not recognized")
+			return nil, nil, nil, nil, errors.Errorf("protocol %s of recipient %q not recognized", protocol, recipient)
 		}
 	}
-	return gpgRecipients, pubkeys, x509s, nil
+	return gpgRecipients, gpgPubKeys, pubkeys, x509s, nil
 }
 
 // Process a password that may be in any of the following formats:
 // - file=<passwordfile>
 // - pass=<password>
 // - fd=<filedescriptor>
+// - k8s://<namespace>/<secret>/<key>
+// - vault://<path>#<field>
 // - <password>
-func processPwdString(pwdString string) ([]byte, error) {
+func processPwdString(context *cli.Context, pwdString string) ([]byte, error) {
 	if strings.HasPrefix(pwdString, "file=") {
 		return ioutil.ReadFile(pwdString[5:])
+	} else if strings.HasPrefix(pwdString, k8sScheme) || strings.HasPrefix(pwdString, vaultScheme) {
+		return readKeySource(context, pwdString)
 	} else if strings.HasPrefix(pwdString, "pass=") {
 		return []byte(pwdString[5:]), nil
 	} else if strings.HasPrefix(pwdString, "fd=") {
@@ -167,7 +241,11 @@ func processPwdString(pwdString string) ([]byte, error) {
 // - <filename>:pass=<password>
 // - <filename>:fd=<filedescriptor>
 // - <filename>:<password>
-func processPrivateKeyFiles(keyFilesAndPwds []string) ([][]byte, [][]byte, [][]byte, [][]byte, error) {
+// - <gpg keyring>:<key id or fingerprint>=<password in any of the forms above>
+// Instead of a filename the key may be read from a kubernetes secret with k8s://<namespace>/<secret>/<key>.
+// The last form selects a single key of a GPG secret keyring, so that the keys of a ring
+// protected by different passphrases are given as several --key options.
+func processPrivateKeyFiles(context *cli.Context, keyFilesAndPwds []string) ([][]byte, [][]byte, [][]byte, [][]byte, error) {
 	var (
 		gpgSecretKeyRingFiles [][]byte
 		gpgSecretKeyPasswords [][]byte
@@ -179,19 +257,45 @@ func processPrivateKeyFiles(keyFilesAndPwds []string) ([][]byte, [][]byte, [][]b
 	for _, keyfileAndPwd := range keyFilesAndPwds {
 		var password []byte
 
-		parts := strings.Split(keyfileAndPwd, ":")
-		if len(parts) == 2 {
-			password, err = processPwdString(parts[1])
+		if strings.HasPrefix(keyfileAndPwd, pivScheme+":") {
+			// the PKCS7 decryption needs the private key itself, which never leaves the token
+			return nil, nil, nil, nil, errors.New("decrypting with a key on a PIV token is not supported")
+		}
+		keyfile, pwdString, hasPwd := splitKeyAndPassword(keyfileAndPwd)
+		var gpgKeyID string
+		if m := gpgKeyPasswordRegexp.FindStringSubmatch(pwdString); hasPwd && m != nil {
+			gpgKeyID, pwdString = m[1], m[2]
+		}
+		if hasPwd {
+			password, err = processPwdString(context, pwdString)
 			if err != nil {
 				return nil, nil, nil, nil, err
 			}
 		}
 
-		keyfile := parts[0]
-		tmp, err := ioutil.ReadFile(keyfile)
+		tmp, err := readKeySource(context, keyfile)
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
+		if gpgKeyID != "" {
+			if !encutils.IsGPGPrivateKeyRing(tmp) {
+				return nil, nil, nil, nil, errors.Errorf("key %s is not a GPG secret keyring; a key id can only be given for keyrings", keyfile)
+			}
+			// the extracted key is no longer protected by the password
+			if tmp, err = extractGPGKey(tmp, gpgKeyID, password); err != nil {
+				return nil, nil, nil, nil, errors.Wrapf(err, "key %s", keyfile)
+			}
+			gpgSecretKeyRingFiles = append(gpgSecretKeyRingFiles, tmp)
+			gpgSecretKeyPasswords = append(gpgSecretKeyPasswords, nil)
+			continue
+		}
+		if isOpenSSHPrivateKey(tmp) {
+			// the converted key is no longer protected by the password
+			if tmp, err = convertOpenSSHPrivateKey(tmp, password); err != nil {
+				return nil, nil, nil, nil, errors.Wrapf(err, "key %s", keyfile)
+			}
+			password = nil
+		}
 		isPrivKey, err := encutils.IsPrivateKey(tmp, password)
 		if encutils.IsPasswordError(err) {
 			return nil, nil, nil, nil, err
@@ -203,7 +307,7 @@ func processPrivateKeyFiles(keyFilesAndPwds []string) ([][]byte, [][]byte, [][]b
 			gpgSecretKeyRingFiles = append(gpgSecretKeyRingFiles, tmp)
 			gpgSecretKeyPasswords = append(gpgSecretKeyPasswords, password)
 		} else {
-			return nil, nil, nil, nil, fmt.Errorf("unidentified private key in file %s (password=%s)", keyfile, string(password))
+			return nil, nil, nil, nil, errors.Errorf("unidentified private key in file %s", keyfile)
 		}
 	}
 	return gpgSecretKeyRingFiles, gpgSecretKeyPasswords, privkeys, privkeysPasswords, nil
@@ -213,6 +317,128 @@ func createGPGClient(context *cli.Context) (encryption.GPGClient, error) {
 	return encryption.NewGPGClient(context.String("gpg-version"), context.String("gpg-homedir"))
 }
 
+// gpgBinary returns the GPG binary to invoke for the configured GPG version
+func gpgBinary(context *cli.Context) (string, error) {
+	if binary := context.String("gpg-binary"); binary != "" {
+		return binary, nil
+	}
+	switch context.String("gpg-version") {
+	case "v1":
+		return exec.LookPath("gpg")
+	case "v2":
+		return exec.LookPath("gpg2")
+	}
+	if path, err := exec.LookPath("gpg2"); err == nil {
+		return path, nil
+	}
+	return exec.LookPath("gpg")
+}
+
+// setupGPGBinary makes the GPG binary given with --gpg-binary the one invoked by the
+// GPG client, which looks up gpg and gpg2 in PATH. Both names are linked to the binary
+// in a temporary directory put first in PATH; the returned function removes it again.
+func setupGPGBinary(context *cli.Context) (func(), error) {
+	binary := context.String("gpg-binary")
+	if binary == "" {
+		return func() {}, nil
+	}
+	binary, err := filepath.Abs(binary)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(binary); err != nil {
+		return nil, errors.Wrap(err, "unable to find the GPG binary")
+	}
+
+	dir, err := ioutil.TempDir("", "cryptd-gpg-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+	for _, name := range []string{"gpg", "gpg2"} {
+		if err := os.Symlink(binary, filepath.Join(dir, name)); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	if err := os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH")); err != nil {
+		cleanup()
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+// createGPGHomedir creates a temporary GPG homedir when --homedir-create is given,
+// imports the GPG secret keyrings passed with --key into it and makes it the
+// gpg-homedir of the command. The returned function removes the homedir again.
+// The GPG binary given with --gpg-binary is set up first.
+func createGPGHomedir(context *cli.Context) (func(), error) {
+	cleanupBinary, err := setupGPGBinary(context)
+	if err != nil {
+		return nil, err
+	}
+	if !context.Bool("homedir-create") {
+		return cleanupBinary, nil
+	}
+	cleanup, err := createTempGPGHomedir(context)
+	if err != nil {
+		cleanupBinary()
+		return nil, err
+	}
+	return func() {
+		cleanup()
+		cleanupBinary()
+	}, nil
+}
+
+// createTempGPGHomedir creates the temporary GPG homedir of --homedir-create
+func createTempGPGHomedir(context *cli.Context) (func(), error) {
+	if context.String("gpg-homedir") != "" {
+		return nil, errors.New("--homedir-create cannot be used together with --gpg-homedir")
+	}
+
+	binary, err := gpgBinary(context)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to find the GPG binary")
+	}
+	gpgSecretKeyRingFiles, _, _, _, err := processPrivateKeyFiles(context, context.StringSlice("key"))
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "cryptd-gnupg-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+	// gpg refuses to use a homedir accessible by others
+	if err := os.Chmod(dir, 0700); err != nil {
+		cleanup()
+		return nil, err
+	}
+	for _, keyRing := range gpgSecretKeyRingFiles {
+		cmd := exec.Command(binary, "--homedir", dir, "--batch", "--import")
+		cmd.Stdin = bytes.NewReader(keyRing)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			cleanup()
+			return nil, errors.Wrapf(err, "could not import keyring into GPG homedir: %s", out)
+		}
+	}
+	if err := context.Set("gpg-homedir", dir); err != nil {
+		cleanup()
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+// getGPGPrivateKeys exports the secret keys able to unwrap the layer keys of descs from
+// the GPG homedir, or from the given keyrings. The exported keys are matched against the
+// key ids of the layers by filterGPGKeyRings, like the keyrings given with --key, so that
+// keys whose secret material is that of a subkey are selected the same way.
 func getGPGPrivateKeys(context *cli.Context, gpgSecretKeyRingFiles [][]byte, descs []ocispec.Descriptor, mustFindKey bool) (gpgPrivKeys [][]byte, gpgPrivKeysPwds [][]byte, err error) {
 	gpgClient, err := createGPGClient(context)
 	if err != nil {
@@ -227,10 +453,238 @@ func getGPGPrivateKeys(context *cli.Context, gpgSecretKeyRingFiles [][]byte, des
 			return nil, nil, err
 		}
 	}
-	return encryption.GPGGetPrivateKey(descs, gpgClient, gpgVault, mustFindKey)
+	gpgPrivKeys, gpgPrivKeysPwds, err = encryption.GPGGetPrivateKey(descs, gpgClient, gpgVault, mustFindKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return filterGPGKeyRings(gpgPrivKeys, gpgPrivKeysPwds, descs)
+}
+
+// gpgKeyIdsFromDescriptors returns the ids of the keys the PGP wrapped keys of the given
+// layers are encrypted to; these may be ids of primary keys or of subkeys
+func gpgKeyIdsFromDescriptors(descs []ocispec.Descriptor) ([]uint64, error) {
+	var keyids []uint64
+
+	for _, desc := range descs {
+		b64pgpPackets := desc.Annotations["org.opencontainers.image.enc.keys.pgp"]
+		if b64pgpPackets == "" {
+			continue
+		}
+		for _, b64pgpPacket := range strings.Split(b64pgpPackets, ",") {
+			pgpPacket, err := cryptd.DecodeBase64(b64pgpPacket)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not decode base64 encoded PGP packet of layer %s", desc.Digest)
+			}
+			ids, err := gpgKeyIdsFromPacket(pgpPacket)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not read PGP packet of layer %s", desc.Digest)
+			}
+			keyids = append(keyids, ids...)
+		}
+	}
+	return keyids, nil
+}
+
+// gpgKeyIdsFromPacket returns the key ids of the encrypted session keys in a PGP message
+func gpgKeyIdsFromPacket(pgpPacket []byte) ([]uint64, error) {
+	var keyids []uint64
+
+	packets := packet.NewReader(bytes.NewBuffer(pgpPacket))
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			keyids = append(keyids, p.KeyId)
+		case *packet.SymmetricallyEncrypted:
+			return keyids, nil
+		}
+	}
+	return keyids, nil
+}
+
+// gpgKeyPasswordRegexp matches the password of a single key of a GPG secret keyring,
+// given as <key id or fingerprint>=<password>
+var gpgKeyPasswordRegexp = regexp.MustCompile(`^([0-9A-Fa-f]{16}|[0-9A-Fa-f]{40})=(.*)$`)
+
+// extractGPGKey returns a keyring holding only the key of the secret keyring with the
+// key id or fingerprint, or whose subkey has it, with its secret keys decrypted with
+// the password
+func extractGPGKey(keyRing []byte, id string, password []byte) ([]byte, error) {
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(keyRing))
+	if err != nil {
+		if el, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(keyRing)); err != nil {
+			return nil, err
+		}
+	}
+	for _, entity := range el {
+		if !gpgEntityHasID(entity, id) {
+			continue
+		}
+		keys := []*packet.PrivateKey{entity.PrivateKey}
+		for _, subkey := range entity.Subkeys {
+			keys = append(keys, subkey.PrivateKey)
+		}
+		for _, key := range keys {
+			if key == nil || !key.Encrypted {
+				continue
+			}
+			if err := key.Decrypt(password); err != nil {
+				return nil, errors.Wrapf(err, "could not decrypt GPG key %s", id)
+			}
+		}
+		var buf bytes.Buffer
+		if err := entity.SerializePrivate(&buf, nil); err != nil {
+			return nil, errors.Wrapf(err, "could not serialize GPG key %s", id)
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errors.Errorf("no GPG key %s in keyring", id)
+}
+
+// gpgEntityHasID checks whether the key id or fingerprint is the one of the primary key
+// or of a subkey of the entity
+func gpgEntityHasID(entity *openpgp.Entity, id string) bool {
+	keys := []*packet.PublicKey{entity.PrimaryKey}
+	for _, subkey := range entity.Subkeys {
+		keys = append(keys, subkey.PublicKey)
+	}
+	for _, key := range keys {
+		if strings.EqualFold(id, fmt.Sprintf("%X", key.Fingerprint[:])) || strings.EqualFold(id, fmt.Sprintf("%016X", key.KeyId)) || strings.EqualFold(id, fmt.Sprintf("%08X", uint32(key.KeyId))) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeGPGKeyID returns a short (8 hex digits) or long (16) key id or a fingerprint
+// (40) in upper case without 0x prefix and spaces; ok is false if id is none of these
+func normalizeGPGKeyID(id string) (string, bool) {
+	id = strings.ToUpper(strings.Replace(strings.TrimSpace(id), " ", "", -1))
+	id = strings.TrimPrefix(id, "0X")
+	switch len(id) {
+	case 8, 16, 40:
+	default:
+		return "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// resolveGPGRecipients replaces the PGP recipients given by key id or fingerprint by the
+// email address of their key in the public keyring, which is what the PGP key wrapping
+// looks recipients up by; recipients given by email address or name are kept as is
+func resolveGPGRecipients(recipients [][]byte, pubRing []byte) ([][]byte, error) {
+	var (
+		el       openpgp.EntityList
+		resolved = make([][]byte, 0, len(recipients))
+	)
+	for _, recipient := range recipients {
+		id, ok := normalizeGPGKeyID(string(recipient))
+		if !ok {
+			resolved = append(resolved, recipient)
+			continue
+		}
+		if el == nil {
+			var err error
+			if el, err = openpgp.ReadKeyRing(bytes.NewReader(pubRing)); err != nil {
+				if el, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(pubRing)); err != nil {
+					return nil, errors.Wrap(err, "could not read the GPG public keyring")
+				}
+			}
+		}
+		var emails []string
+		for _, entity := range el {
+			if !gpgEntityHasID(entity, id) {
+				continue
+			}
+			email := gpgEntityEmail(entity)
+			if email == "" {
+				return nil, errors.Errorf("PGP key %s has no identity with an email address", recipient)
+			}
+			if len(emails) == 0 || emails[0] != email {
+				emails = append(emails, email)
+			}
+		}
+		switch len(emails) {
+		case 0:
+			return nil, errors.Errorf("no PGP key %s in the GPG public keyring", recipient)
+		case 1:
+			resolved = append(resolved, []byte(emails[0]))
+		default:
+			return nil, errors.Errorf("PGP key id %s is ambiguous, it matches the keys of %s; please give the fingerprint", recipient, strings.Join(emails, ", "))
+		}
+	}
+	return resolved, nil
+}
+
+// gpgEntityEmail returns the first email address of the identities of the entity
+func gpgEntityEmail(entity *openpgp.Entity) string {
+	for _, identity := range entity.Identities {
+		if identity.UserId.Email != "" {
+			return identity.UserId.Email
+		}
+	}
+	return ""
+}
+
+// gpgKeyRingHasKey checks whether the keyring holds a secret key with one of the given
+// key ids. Subkeys are considered as well since users often export only the encryption
+// subkey, in which case the primary key is a stub without secret material.
+func gpgKeyRingHasKey(keyRing []byte, keyids []uint64) bool {
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(keyRing))
+	if err != nil {
+		el, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(keyRing))
+		if err != nil {
+			return false
+		}
+	}
+	for _, keyid := range keyids {
+		for _, key := range el.KeysById(keyid) {
+			if key.PrivateKey != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterGPGKeyRings returns the secret keyrings and their passwords that hold a key,
+// primary or subkey, able to unwrap one of the layers; if none of them match, all of
+// them are returned so that decryption fails with the regular error
+func filterGPGKeyRings(keyRings, passwords [][]byte, descs []ocispec.Descriptor) ([][]byte, [][]byte, error) {
+	keyids, err := gpgKeyIdsFromDescriptors(descs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keyids) == 0 {
+		return keyRings, passwords, nil
+	}
+
+	var (
+		matchedRings     [][]byte
+		matchedPasswords [][]byte
+	)
+	for i, keyRing := range keyRings {
+		if gpgKeyRingHasKey(keyRing, keyids) {
+			matchedRings = append(matchedRings, keyRing)
+			matchedPasswords = append(matchedPasswords, passwords[i])
+		}
+	}
+	if len(matchedRings) == 0 {
+		return keyRings, passwords, nil
+	}
+	return matchedRings, matchedPasswords, nil
 }
 
-func getImageLayerInfos(client *containerd.Client, ctx gocontext.Context, name string, layers []int32, platformList []string) ([]LayerInfo, []ocispec.Descriptor, error) {
+func getImageLayerInfos(client *containerd.Client, ctx gocontext.Context, name string, layers, excludeLayers []int32, platformList []string, defaultOS string) ([]cryptd.LayerInfo, []ocispec.Descriptor, error) {
 	s := client.ImageService()
 
 	image, err := s.Get(ctx, name)
@@ -238,60 +692,240 @@ func getImageLayerInfos(client *containerd.Client, ctx gocontext.Context, name s
 		return nil, nil, err
 	}
 
-	pl, err := parsePlatformArray(platformList)
+	pl, err := cryptd.ParsePlatformArray(platformList, defaultOS)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	alldescs, err := images.GetImageLayerDescriptors(ctx, client.ContentStore(), image.Target)
+	lis, descs, _, err := cryptd.SelectLayerDescriptors(ctx, client.ContentStore(), image.Target, layers, excludeLayers, pl, false)
+	return lis, descs, err
+}
+
+// unmatchedLayers returns the layer numbers that do not match a layer of any of the
+// selected platforms, such as 99 or -99 for images of three layers
+func unmatchedLayers(alldescs []ocispec.Descriptor, layers []int32, pl []ocispec.Platform) []int32 {
+	var totals []int32
+	for i, desc := range alldescs {
+		if (i == 0 || alldescs[i-1].Platform != desc.Platform) && cryptd.IsUserSelectedPlatform(desc.Platform, pl) {
+			totals = append(totals, cryptd.CountLayers(alldescs, desc.Platform))
+		}
+	}
+	var unmatched []int32
+	for _, l := range layers {
+		matched := false
+		for _, total := range totals {
+			if (l >= 0 && l < total) || (l < 0 && l >= -total) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			unmatched = append(unmatched, l)
+		}
+	}
+	return unmatched
+}
+
+// checkLayerRange fails if a number given with --layer or --exclude-layer matches no
+// layer of the selected platforms of the image, or warns with --ignore-missing-layers
+func checkLayerRange(ctx gocontext.Context, context *cli.Context, image containerd.Image) error {
+	layers := append(commands.IntToInt32Array(context.IntSlice("layer")), commands.IntToInt32Array(context.IntSlice("exclude-layer"))...)
+	if len(layers) == 0 {
+		return nil
+	}
+	pl, err := cryptd.ParsePlatformArray(context.StringSlice("platform"), context.String("platform-default-os"))
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+	alldescs, _, err := cryptd.LayerDescriptors(ctx, image.ContentStore(), image.Target(), false)
+	if err != nil {
+		return err
+	}
+	unmatched := unmatchedLayers(alldescs, layers, pl)
+	if len(unmatched) == 0 {
+		return nil
+	}
+	if context.Bool("ignore-missing-layers") {
+		logrus.Warnf("layers %v match no layer of image %s", unmatched, image.Name())
+		return nil
+	}
+	return errors.Errorf("layers %v match no layer of image %s; use --ignore-missing-layers to continue anyway", unmatched, image.Name())
+}
+
+// cryptOpts creates the options common to encrypting and decrypting an image
+// from the command line options
+func cryptOpts(context *cli.Context, layers []int32) []cryptd.CryptOpt {
+	opts := []cryptd.CryptOpt{
+		cryptd.WithPlatforms(context.StringSlice("platform")),
+		cryptd.WithPlatformDefaultOS(context.String("platform-default-os")),
+		cryptd.WithLayers(layers),
+		cryptd.WithExcludeLayers(commands.IntToInt32Array(context.IntSlice("exclude-layer"))),
+		cryptd.WithConcurrency(context.Int("concurrency")),
+		cryptd.WithContentConcurrency(context.Int("content-concurrency")),
+	}
+	if context.Bool("strict-annotations") {
+		opts = append(opts, cryptd.WithStrictAnnotations(context.Bool("strip-unknown")))
+	}
+	if context.Bool("no-lease") {
+		opts = append(opts, cryptd.WithNoLease())
+	}
+	if expr := context.String("layer-filter-expr"); expr != "" {
+		opts = append(opts, cryptd.WithLayerFilterExpr(expr))
 	}
+	if keys := context.StringSlice("redact-labels"); len(keys) > 0 {
+		opts = append(opts, cryptd.WithRedactLabels(keys))
+	}
+	if !context.BoolT("sbom-passthrough") {
+		opts = append(opts, cryptd.WithEncryptAttestations())
+	}
+	if context.Bool("require-all-platforms") {
+		opts = append(opts, cryptd.WithRequireAllPlatforms())
+	}
+	if !context.BoolT("preserve-history") {
+		opts = append(opts, cryptd.WithStripHistory())
+	}
+	return opts
+}
 
-	lis, descs := filterLayerDescriptors(alldescs, layers, pl)
-	return lis, descs, nil
+// recipientResolver returns the registered resolver of the recipient and the value
+// to resolve. Recipients of the builtin schemes, pgp, jwe, pkcs7 and piv, are never
+// dispatched to a resolver; processRecipientKeys handles them.
+func recipientResolver(recipient string) (cryptd.RecipientResolver, string, bool) {
+	idx := strings.Index(recipient, ":")
+	if idx <= 0 {
+		return nil, "", false
+	}
+	scheme, value := recipient[:idx], recipient[idx+1:]
+	if cryptd.IsBuiltinRecipientScheme(scheme) || scheme == pivScheme || strings.TrimSpace(value) == "" {
+		return nil, "", false
+	}
+	r, ok := cryptd.GetRecipientResolver(scheme)
+	return r, value, ok
+}
+
+// createEncryptCryptoConfig creates the CryptoConfig object that contains the necessary
+// information to perform encryption for the given recipients; aliases and file name
+// globs are expanded first
+func createEncryptCryptoConfig(context *cli.Context, recipients []string) (encconfig.CryptoConfig, error) {
+	recipients, err := expandRecipients(context, recipients)
+	if err != nil {
+		return encconfig.CryptoConfig{}, err
+	}
+	return encryptCryptoConfig(context, recipients)
 }
 
-func countLayers(descs []ocispec.Descriptor, platform *ocispec.Platform) int32 {
-	c := int32(0)
+// encryptCryptoConfig creates the CryptoConfig encrypting for the recipients, whose
+// aliases and globs are expanded already; recipients of registered schemes are
+// resolved by their resolver, the others by processRecipientKeys
+func encryptCryptoConfig(context *cli.Context, recipients []string) (encconfig.CryptoConfig, error) {
+	encryptCcs := []encconfig.CryptoConfig{}
+	var builtin []string
+	for _, recipient := range recipients {
+		r, value, ok := recipientResolver(recipient)
+		if !ok {
+			builtin = append(builtin, recipient)
+			continue
+		}
+		cc, err := r.Resolve(value)
+		if err != nil {
+			return encconfig.CryptoConfig{}, errors.Wrapf(err, "recipient %s", recipient)
+		}
+		if err := checkRecipientKeyTypes(recipient, cc.EncryptConfig); err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		encryptCcs = append(encryptCcs, cc)
+	}
 
-	for _, desc := range descs {
-		if desc.Platform == platform {
-			c = c + 1
+	gpgRecipients, gpgPubKeys, pubKeys, x509s, err := processRecipientKeys(context, builtin)
+	if err != nil {
+		return encconfig.CryptoConfig{}, err
+	}
+
+	_, err = createGPGClient(context)
+	gpgInstalled := err == nil
+
+	if len(gpgRecipients) > 0 && (gpgInstalled || len(gpgPubKeys) > 0) {
+		var gpgPubRingFile []byte
+		if gpgInstalled {
+			gpgClient, err := createGPGClient(context)
+			if err != nil {
+				return encconfig.CryptoConfig{}, err
+			}
+
+			gpgPubRingFile, err = gpgClient.ReadGPGPubRingFile()
+			if err != nil {
+				// the local keyring is only needed for recipients not fetched from the keyserver
+				if len(gpgPubKeys) < len(gpgRecipients) {
+					return encconfig.CryptoConfig{}, errors.Wrap(err, "could not read the GPG public keyring needed for the PGP recipients")
+				}
+				logrus.WithError(err).Warn("could not read the GPG public keyring; using the keys fetched from the keyserver only")
+				gpgPubRingFile = nil
+			}
+		}
+		// keys fetched from the keyserver are used in addition to the local keyring
+		for _, gpgPubKey := range gpgPubKeys {
+			gpgPubRingFile = append(gpgPubRingFile, gpgPubKey...)
+		}
+
+		if gpgRecipients, err = resolveGPGRecipients(gpgRecipients, gpgPubRingFile); err != nil {
+			return encconfig.CryptoConfig{}, err
 		}
+		gpgCc, err := encconfig.EncryptWithGpg(gpgRecipients, gpgPubRingFile)
+		if err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		encryptCcs = append(encryptCcs, gpgCc)
+
+	} else if len(gpgRecipients) > 0 {
+		return encconfig.CryptoConfig{}, errors.New("PGP recipients require GPG to be installed, unless they are fetched with pgp:keyserver:<keyid>")
+	}
+
+	// Create Encryption Crypto Config
+	pkcs7Cc, err := encconfig.EncryptWithPkcs7(x509s)
+	if err != nil {
+		return encconfig.CryptoConfig{}, err
+	}
+	encryptCcs = append(encryptCcs, pkcs7Cc)
+
+	jweCc, err := encconfig.EncryptWithJwe(pubKeys)
+	if err != nil {
+		return encconfig.CryptoConfig{}, err
 	}
+	encryptCcs = append(encryptCcs, jweCc)
 
-	return c
+	return encconfig.CombineCryptoConfigs(encryptCcs), nil
 }
 
-func filterLayerDescriptors(alldescs []ocispec.Descriptor, layers []int32, pl []ocispec.Platform) ([]LayerInfo, []ocispec.Descriptor) {
-	var (
-		layerInfos  []LayerInfo
-		descs       []ocispec.Descriptor
-		curplat     *ocispec.Platform
-		layerIndex  int32
-		layersTotal int32
-	)
+// hasDecryptionKeys checks whether the decrypt config holds any private key
+func hasDecryptionKeys(dc *encconfig.DecryptConfig) bool {
+	return len(dc.Parameters["privkeys"]) > 0 || len(dc.Parameters["gpg-privatekeys"]) > 0
+}
 
-	for _, desc := range alldescs {
-		if curplat != desc.Platform {
-			curplat = desc.Platform
-			layerIndex = 0
-			layersTotal = countLayers(alldescs, desc.Platform)
-		} else {
-			layerIndex = layerIndex + 1
+// checkAddRecipients ensures that a decryption key is available when recipients are to be
+// added to already encrypted layers. None of the supported schemes (jwe, pkcs7, pgp) allows
+// wrapping the layer key for another recipient without unwrapping it first.
+func checkAddRecipients(descs []ocispec.Descriptor, dc *encconfig.DecryptConfig) error {
+	if hasDecryptionKeys(dc) {
+		return nil
+	}
+	for _, desc := range descs {
+		if cryptd.IsEncryptedMediaType(desc.MediaType) {
+			return errors.Errorf("layer %s is already encrypted; adding recipients requires a private key (--key) of one of its existing recipients", desc.Digest)
 		}
+	}
+	return nil
+}
 
-		if isUserSelectedLayer(layerIndex, layersTotal, layers) && isUserSelectedPlatform(curplat, pl) {
-			li := LayerInfo{
-				Index:      uint32(layerIndex),
-				Descriptor: desc,
-			}
-			descs = append(descs, desc)
-			layerInfos = append(layerInfos, li)
+// encryptedDescriptors returns the descriptors of the encrypted layers; keys are only
+// looked up for these since plaintext layers pass through decryption untouched
+func encryptedDescriptors(descs []ocispec.Descriptor) []ocispec.Descriptor {
+	var encrypted []ocispec.Descriptor
+	for _, desc := range descs {
+		if cryptd.IsEncryptedMediaType(desc.MediaType) {
+			encrypted = append(encrypted, desc)
 		}
 	}
-	return layerInfos, descs
+	return encrypted
 }
 
 // CreateDecryptCryptoConfig creates the CryptoConfig object that contains the necessary
@@ -301,12 +935,16 @@ func CreateDecryptCryptoConfig(context *cli.Context, descs []ocispec.Descriptor)
 	ccs := []encconfig.CryptoConfig{}
 
 	// x509 cert is needed for PKCS7 decryption
-	_, _, x509s, err := processRecipientKeys(context.StringSlice("dec-recipient"))
+	x509s, err := decRecipientCertificates(context)
 	if err != nil {
 		return encconfig.CryptoConfig{}, err
 	}
 
-	gpgSecretKeyRingFiles, gpgSecretKeyPasswords, privKeys, privKeysPasswords, err := processPrivateKeyFiles(context.StringSlice("key"))
+	keys, err := orderKeys(context.String("key-order"), context.StringSlice("key"))
+	if err != nil {
+		return encconfig.CryptoConfig{}, err
+	}
+	gpgSecretKeyRingFiles, gpgSecretKeyPasswords, privKeys, privKeysPasswords, err := processPrivateKeyFiles(context, keys)
 	if err != nil {
 		return encconfig.CryptoConfig{}, err
 	}
@@ -328,7 +966,12 @@ func CreateDecryptCryptoConfig(context *cli.Context, descs []ocispec.Descriptor)
 			ccs = append(ccs, gpgCc)
 
 		} else if len(gpgSecretKeyRingFiles) > 0 {
-			gpgCc, err := encconfig.DecryptWithGpgPrivKeys(gpgSecretKeyRingFiles, gpgSecretKeyPasswords)
+			keyRings, keyRingPasswords, err := filterGPGKeyRings(gpgSecretKeyRingFiles, gpgSecretKeyPasswords, descs)
+			if err != nil {
+				return encconfig.CryptoConfig{}, err
+			}
+
+			gpgCc, err := encconfig.DecryptWithGpgPrivKeys(keyRings, keyRingPasswords)
 			if err != nil {
 				return encconfig.CryptoConfig{}, err
 			}
@@ -352,16 +995,170 @@ func CreateDecryptCryptoConfig(context *cli.Context, descs []ocispec.Descriptor)
 	return encconfig.CombineCryptoConfigs(ccs), nil
 }
 
-// parsePlatformArray parses an array of specifiers and converts them into an array of specs.Platform
-func parsePlatformArray(specifiers []string) ([]ocispec.Platform, error) {
-	var speclist []ocispec.Platform
+// decRecipientCertificates returns the x509 certificates of the --dec-recipient options,
+// whose file names may be globs
+func decRecipientCertificates(context *cli.Context) ([][]byte, error) {
+	recipients, err := expandRecipientGlobs(context.StringSlice("dec-recipient"), context.Bool("allow-empty-glob"))
+	if err != nil {
+		return nil, err
+	}
+	_, _, _, x509s, err := processRecipientKeys(context, recipients)
+	return x509s, err
+}
+
+// createKeyDecryptConfig creates the DecryptConfig of a single private key passed
+// with --key; x509 certificates passed with --dec-recipient are included for PKCS7
+func createKeyDecryptConfig(context *cli.Context, key string) (*encconfig.DecryptConfig, error) {
+	x509s, err := decRecipientCertificates(context)
+	if err != nil {
+		return nil, err
+	}
+	gpgSecretKeyRingFiles, gpgSecretKeyPasswords, privKeys, privKeysPasswords, err := processPrivateKeyFiles(context, []string{key})
+	if err != nil {
+		return nil, err
+	}
 
-	for _, specifier := range specifiers {
-		spec, err := platforms.Parse(specifier)
+	var ccs []encconfig.CryptoConfig
+	if len(gpgSecretKeyRingFiles) > 0 {
+		gpgCc, err := encconfig.DecryptWithGpgPrivKeys(gpgSecretKeyRingFiles, gpgSecretKeyPasswords)
 		if err != nil {
-			return []ocispec.Platform{}, err
+			return nil, err
+		}
+		ccs = append(ccs, gpgCc)
+	}
+	x509sCc, err := encconfig.DecryptWithX509s(x509s)
+	if err != nil {
+		return nil, err
+	}
+	ccs = append(ccs, x509sCc)
+	privKeysCc, err := encconfig.DecryptWithPrivKeys(privKeys, privKeysPasswords)
+	if err != nil {
+		return nil, err
+	}
+	ccs = append(ccs, privKeysCc)
+
+	return encconfig.CombineCryptoConfigs(ccs).DecryptConfig, nil
+}
+
+// unsetEnv returns a config transform removing the named environment variables
+func unsetEnv(names []string) func(*ocispec.Image) error {
+	return func(config *ocispec.Image) error {
+		var env []string
+		for _, e := range config.Config.Env {
+			name := strings.SplitN(e, "=", 2)[0]
+			var unset bool
+			for _, n := range names {
+				if n == name {
+					unset = true
+					break
+				}
+			}
+			if !unset {
+				env = append(env, e)
+			}
+		}
+		config.Config.Env = env
+		return nil
+	}
+}
+
+// checkPinnedDigest fails if --pin-digest is set and the resolved image's manifest
+// digest differs from it, so that a tag repointed after it was chosen is not used
+func checkPinnedDigest(context *cli.Context, image containerd.Image) error {
+	pin := context.String("pin-digest")
+	if pin == "" {
+		return nil
+	}
+	dgst, err := digest.Parse(pin)
+	if err != nil {
+		return errors.Wrapf(err, "invalid pinned digest %s", pin)
+	}
+	if target := image.Target().Digest; target != dgst {
+		return errors.Errorf("image %s resolved to %s, not the pinned digest %s", image.Name(), target, dgst)
+	}
+	return nil
+}
+
+// resolveImageName returns the name of the stored image ref refers to. A reference
+// pinned by digest, <name>@sha256:..., that is not the name of an image itself resolves
+// to the image of the same repository whose manifest has the digest.
+func resolveImageName(ctx gocontext.Context, client *containerd.Client, ref string) (string, error) {
+	s := client.ImageService()
+	_, err := s.Get(ctx, ref)
+	if err == nil {
+		return ref, nil
+	}
+	idx := strings.LastIndex(ref, "@")
+	if !errdefs.IsNotFound(err) || idx < 0 {
+		return "", err
+	}
+	repo := ref[:idx]
+	dgst, err := digest.Parse(ref[idx+1:])
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid digest in image reference %s", ref)
+	}
+	imgs, err := s.List(ctx, "target.digest=="+dgst.String())
+	if err != nil {
+		return "", err
+	}
+	for _, image := range imgs {
+		if repo == "" || imageRepository(image.Name) == repo {
+			return image.Name, nil
+		}
+	}
+	return "", errors.Wrapf(errdefs.ErrNotFound, "no image %s with digest %s", repo, dgst)
+}
+
+// imageRepository strips the tag and digest from the image name
+func imageRepository(name string) string {
+	if idx := strings.LastIndex(name, "@"); idx >= 0 {
+		name = name[:idx]
+	}
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		name = name[:idx]
+	}
+	return name
+}
+
+// validateNewName checks that name can be the name of the image to create; unlike the
+// source image it cannot be referenced by digest, as the new image has a new digest
+func validateNewName(name string) error {
+	if name == "" {
+		return errors.New("please provide the name of the new image")
+	}
+	if strings.ContainsAny(name, " \t\r\n") {
+		return errors.Errorf("invalid image name %q", name)
+	}
+	if _, err := digest.Parse(strings.TrimPrefix(name, "@")); err == nil {
+		return errors.Errorf("the new image name %s is a digest; please provide a name such as <name>:<tag>", name)
+	}
+	if idx := strings.LastIndex(name, "@"); idx >= 0 {
+		if _, err := digest.Parse(name[idx+1:]); err == nil {
+			return errors.Errorf("the new image name %s cannot be pinned to a digest, the new image has a different digest", name)
+		}
+	}
+	return nil
+}
+
+// orderKeys orders the --key options by the --key-order strategy, as the candidate keys
+// are tried in the order they are given:
+// - as-given: the order of the command line
+// - local-first: keys read from files before keys from remote sources, such as k8s://
+func orderKeys(strategy string, keys []string) ([]string, error) {
+	switch strategy {
+	case "", "as-given":
+		return keys, nil
+	case "local-first":
+		var local, remote []string
+		for _, key := range keys {
+			source, _, _ := splitKeyAndPassword(key)
+			if remoteKeyScheme(source) != "" {
+				remote = append(remote, key)
+			} else {
+				local = append(local, key)
+			}
 		}
-		speclist = append(speclist, spec)
+		return append(local, remote...), nil
 	}
-	return speclist, nil
+	return nil, errors.Errorf("unknown key order %s; expected local-first or as-given", strategy)
 }
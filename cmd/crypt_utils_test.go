@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	gocontext "context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	imgenc "github.com/containerd/containerd/images/encryption"
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	"github.com/crosbymichael/cryptd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/openpgp"
+)
+
+// testContext returns the context of a command with the flags, parsed from args
+func testContext(t *testing.T, flags []cli.Flag, args ...string) *cli.Context {
+	t.Helper()
+
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range flags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+// writeRSAPublicKey writes the PEM encoded public key of a new RSA key to dir/name
+func writeRSAPublicKey(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePublicKey(t, dir, name, &key.PublicKey)
+}
+
+// writePublicKey writes the PEM encoded public key to dir/name
+func writePublicKey(t *testing.T, dir, name string, pub interface{}) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testResolver resolves all values to the JWE recipient of its public key
+type testResolver struct {
+	pubKey []byte
+}
+
+func (testResolver) Scheme() string {
+	return "resolver-test"
+}
+
+func (r testResolver) Resolve(value string) (encconfig.CryptoConfig, error) {
+	return encconfig.EncryptWithJwe([][]byte{r.pubKey})
+}
+
+var resolverKey = func() []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}()
+
+func init() {
+	cryptd.RegisterRecipientResolver(testResolver{pubKey: resolverKey})
+}
+
+func TestRecipientResolver(t *testing.T) {
+	for _, tc := range []struct {
+		recipient string
+		value     string
+		ok        bool
+	}{
+		{recipient: "resolver-test:value", value: "value", ok: true},
+		{recipient: "resolver-test:", ok: false},
+		{recipient: "jwe:/keys/key.pem", ok: false},
+		{recipient: "jwe:/keys/*.pem", ok: false},
+		{recipient: "pkcs7:/certs/cert.pem", ok: false},
+		{recipient: "pkcs7:subject:alice", ok: false},
+		{recipient: "pgp:alice@example.com", ok: false},
+		{recipient: "piv:9d", ok: false},
+		{recipient: "unknown:value", ok: false},
+		{recipient: "no-scheme", ok: false},
+	} {
+		t.Run(tc.recipient, func(t *testing.T) {
+			r, value, ok := recipientResolver(tc.recipient)
+			if ok != tc.ok {
+				t.Fatalf("got ok %v, expected %v", ok, tc.ok)
+			}
+			if !ok {
+				return
+			}
+			if r.Scheme() != "resolver-test" || value != tc.value {
+				t.Fatalf("got resolver %s with value %q, expected resolver-test with %q", r.Scheme(), value, tc.value)
+			}
+		})
+	}
+}
+
+func TestCreateEncryptCryptoConfigResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jweKey := writeRSAPublicKey(t, dir, "jwe.pem")
+
+	context := testContext(t, encryptCommand.Flags)
+	cc, err := createEncryptCryptoConfig(context, []string{"resolver-test:alice", "jwe:" + jweKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeys := cc.EncryptConfig.Parameters["pubkeys"]
+	if len(pubKeys) != 2 {
+		t.Fatalf("got %d public keys, expected the ones of the resolver and of the jwe recipient", len(pubKeys))
+	}
+	if string(pubKeys[0]) != string(resolverKey) && string(pubKeys[1]) != string(resolverKey) {
+		t.Fatal("the public key of the resolver is missing")
+	}
+}
+
+// writeTestImage writes a single platform image of the layers to cs, the layer blobs
+// are taken as uncompressed layers
+func writeTestImage(ctx gocontext.Context, t *testing.T, cs content.Store, layers ...[]byte) ocispec.Descriptor {
+	t.Helper()
+
+	var (
+		layerDescs []ocispec.Descriptor
+		diffIDs    []digest.Digest
+	)
+	for _, layer := range layers {
+		desc := writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageLayer, layer)
+		layerDescs = append(layerDescs, desc)
+		diffIDs = append(diffIDs, desc.Digest)
+	}
+	config, err := json.Marshal(ocispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageConfig, config),
+		Layers:    layerDescs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageManifest, manifest)
+}
+
+// writeTestBlob writes the blob to cs and returns its descriptor
+func writeTestBlob(ctx gocontext.Context, t *testing.T, cs content.Store, mediaType string, p []byte) ocispec.Descriptor {
+	t.Helper()
+
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(p),
+		Size:      int64(len(p)),
+	}
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(p), desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// newTestStore returns a content store in a new temporary directory; the returned
+// function removes it again
+func newTestStore(t *testing.T) (content.Store, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "cryptd-content-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := local.NewStore(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return cs, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExpandRecipientGlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.pem", "b.pem", "c.crt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name       string
+		recipients []string
+		allowEmpty bool
+		expected   []string
+		err        bool
+	}{
+		{
+			name:       "jwe glob",
+			recipients: []string{"jwe:" + dir + "/*.pem"},
+			expected:   []string{"jwe:" + dir + "/a.pem", "jwe:" + dir + "/b.pem"},
+		},
+		{
+			name:       "pkcs7 glob",
+			recipients: []string{"pkcs7:" + dir + "/*.crt"},
+			expected:   []string{"pkcs7:" + dir + "/c.crt"},
+		},
+		{
+			name:       "no glob",
+			recipients: []string{"jwe:" + dir + "/a.pem", "pgp:alice@example.com"},
+			expected:   []string{"jwe:" + dir + "/a.pem", "pgp:alice@example.com"},
+		},
+		{
+			name:       "not a file scheme",
+			recipients: []string{"pgp:*"},
+			expected:   []string{"pgp:*"},
+		},
+		{
+			name:       "subject",
+			recipients: []string{"pkcs7:subject:*"},
+			expected:   []string{"pkcs7:subject:*"},
+		},
+		{
+			name:       "remote source",
+			recipients: []string{"jwe:vault://secret/keys#*"},
+			expected:   []string{"jwe:vault://secret/keys#*"},
+		},
+		{
+			name:       "no match",
+			recipients: []string{"jwe:" + dir + "/*.key"},
+			err:        true,
+		},
+		{
+			name:       "no match allowed",
+			recipients: []string{"jwe:" + dir + "/*.key", "jwe:" + dir + "/a.pem"},
+			allowEmpty: true,
+			expected:   []string{"jwe:" + dir + "/a.pem"},
+		},
+		{
+			name:       "invalid glob",
+			recipients: []string{"jwe:" + dir + "/[.pem"},
+			err:        true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expanded, err := expandRecipientGlobs(tc.recipients, tc.allowEmpty)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", expanded)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expanded, tc.expected) {
+				t.Fatalf("got %v, expected %v", expanded, tc.expected)
+			}
+		})
+	}
+}
+
+func TestEncryptWithRecipientGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyDir := filepath.Join(dir, "keys")
+	if err := os.Mkdir(keyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.pem", "b.pem", "c.pem"} {
+		writeRSAPublicKey(t, keyDir, name)
+	}
+
+	context := testContext(t, encryptCommand.Flags)
+	cc, err := createEncryptCryptoConfig(context, []string{"jwe:" + keyDir + "/*.pem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cc.EncryptConfig.Parameters["pubkeys"]); n != 3 {
+		t.Fatalf("got %d public keys, expected one per matching file", n)
+	}
+
+	ctx := gocontext.Background()
+	cs, cleanup := newTestStore(t)
+	defer cleanup()
+	target := writeTestImage(ctx, t, cs, []byte("layer"))
+
+	encTarget, modified, err := imgenc.EncryptImage(ctx, cs, target, &cc, func(ocispec.Descriptor) bool {
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modified {
+		t.Fatal("the image was not encrypted")
+	}
+	p, err := content.ReadBlob(ctx, cs, encTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(p, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := describeLayerEncryption(manifest.Layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwe int
+	for _, r := range enc.Recipients {
+		if strings.HasPrefix(r, "jwe:") {
+			jwe++
+		}
+	}
+	if jwe != 3 {
+		t.Fatalf("got %d JWE recipients, expected 3: %v", jwe, enc.Recipients)
+	}
+}
+
+func TestUnidentifiedPrivateKeyHidesPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	context := testContext(t, decryptCommand.Flags)
+	for _, key := range []string{path + ":pass=hunter2", path + ":hunter2"} {
+		_, _, _, _, err := processPrivateKeyFiles(context, []string{key})
+		if err == nil {
+			t.Fatalf("expected %s not to be identified", key)
+		}
+		if strings.Contains(err.Error(), "hunter2") {
+			t.Fatalf("error %q contains the password", err)
+		}
+	}
+}
+
+// newGPGEntity returns a new entity, with an encryption subkey, and its serialized
+// secret keyring
+func newGPGEntity(t *testing.T, name string) (*openpgp.Entity, []byte) {
+	t.Helper()
+
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := entity.SerializePrivate(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	return entity, buf.Bytes()
+}
+
+// pgpLayer returns an encrypted layer whose layer key is wrapped for the entities,
+// which encrypts it to their encryption subkeys
+func pgpLayer(t *testing.T, to ...*openpgp.Entity) ocispec.Descriptor {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, to, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("layer key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return ocispec.Descriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar+gzip+encrypted",
+		Annotations: map[string]string{
+			"org.opencontainers.image.enc.keys.pgp": base64.StdEncoding.EncodeToString(buf.Bytes()),
+		},
+	}
+}
+
+func TestFilterGPGKeyRings(t *testing.T) {
+	alice, aliceRing := newGPGEntity(t, "alice")
+	bob, bobRing := newGPGEntity(t, "bob")
+	carol, _ := newGPGEntity(t, "carol")
+	for _, e := range []*openpgp.Entity{alice, bob} {
+		if len(e.Subkeys) == 0 {
+			t.Fatalf("%v has no encryption subkey", e.Identities)
+		}
+	}
+
+	keyRings := [][]byte{aliceRing, bobRing}
+	passwords := [][]byte{[]byte("alice"), []byte("bob")}
+	for _, tc := range []struct {
+		name      string
+		descs     []ocispec.Descriptor
+		passwords []string
+	}{
+		{
+			name:      "subkey of one keyring",
+			descs:     []ocispec.Descriptor{pgpLayer(t, bob)},
+			passwords: []string{"bob"},
+		},
+		{
+			name:      "subkeys of both keyrings",
+			descs:     []ocispec.Descriptor{pgpLayer(t, alice), pgpLayer(t, bob)},
+			passwords: []string{"alice", "bob"},
+		},
+		{
+			name:      "no matching keyring",
+			descs:     []ocispec.Descriptor{pgpLayer(t, carol)},
+			passwords: []string{"alice", "bob"},
+		},
+		{
+			name:      "no pgp layers",
+			descs:     []ocispec.Descriptor{{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip"}},
+			passwords: []string{"alice", "bob"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rings, pwds, err := filterGPGKeyRings(keyRings, passwords, tc.descs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rings) != len(tc.passwords) || len(pwds) != len(tc.passwords) {
+				t.Fatalf("got %d keyrings and %d passwords, expected %d", len(rings), len(pwds), len(tc.passwords))
+			}
+			for i, pwd := range tc.passwords {
+				if string(pwds[i]) != pwd {
+					t.Errorf("keyring %d has password %q, expected %q", i, pwds[i], pwd)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderKeys(t *testing.T) {
+	keys := []string{"k8s://ns/secret/key", "a.pem:pw", "vault://secret/keys#private", "b.pem"}
+	for _, tc := range []struct {
+		strategy string
+		expected []string
+		err      bool
+	}{
+		{strategy: "", expected: keys},
+		{strategy: "as-given", expected: keys},
+		{strategy: "local-first", expected: []string{"a.pem:pw", "b.pem", "k8s://ns/secret/key", "vault://secret/keys#private"}},
+		{strategy: "remote-first", err: true},
+	} {
+		t.Run(tc.strategy, func(t *testing.T) {
+			ordered, err := orderKeys(tc.strategy, keys)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", ordered)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ordered, tc.expected) {
+				t.Fatalf("got %v, expected %v", ordered, tc.expected)
+			}
+		})
+	}
+}
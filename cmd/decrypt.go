@@ -1,7 +1,189 @@
 package main
 
-import "github.com/urfave/cli"
+import (
+	gocontext "context"
+	"fmt"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/pkg/encryption"
+	"github.com/containerd/containerd/platforms"
+	"github.com/crosbymichael/cryptd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
 
 var decryptCommand = cli.Command{
 	Name: "decrypt",
+	Flags: append(append([]cli.Flag{
+		cli.BoolTFlag{
+			Name:  "verify-diffids",
+			Usage: "Verify that the DiffIDs of the decrypted layers match the image config",
+		},
+		cli.BoolFlag{
+			Name:  "platform-from-node",
+			Usage: "Decrypt only the platform of this host; cannot be used together with --platform",
+		},
+		cli.BoolFlag{
+			Name:  "remote",
+			Usage: "Fetch the image from its registry, downloading only the selected layers, instead of using the image store",
+		},
+		cli.IntFlag{
+			Name:  "keys-required",
+			Usage: "Fail before decrypting unless at least this many of the keys given with --key unwrap the layer key of a selected layer",
+		},
+		cli.StringSliceFlag{
+			Name:  "unset-env",
+			Usage: "Remove the environment variable from the config of the decrypted image",
+		},
+	}, append(ImageLayerFlags, ImageCryptFlags...)...),
+		ImageDecryptionFlags...),
+	Action: func(context *cli.Context) error {
+		local := context.Args().First()
+		if local == "" {
+			return errors.New("please provide the name of an image to decrypt")
+		}
+
+		newName := context.Args().Get(1)
+		if err := validateNewName(newName); err != nil {
+			return err
+		}
+		fmt.Printf("Decrypting %s to %s\n", local, newName)
+		cleanup, err := createGPGHomedir(context)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		sum := newSummary()
+		ctx := appContext()
+		ctdClient, err := newContainerdClient(ctx, context)
+		if err != nil {
+			return err
+		}
+
+		if context.Bool("platform-from-node") {
+			if len(context.StringSlice("platform")) > 0 {
+				return errors.New("--platform-from-node cannot be used together with --platform")
+			}
+			if err := context.Set("platform", platforms.Format(platforms.DefaultSpec())); err != nil {
+				return err
+			}
+		}
+
+		layers32 := commands.IntToInt32Array(context.IntSlice("layer"))
+
+		remote := context.Bool("remote")
+		if remote {
+			// keep the fetched content until the decrypted image references it
+			var done func(gocontext.Context) error
+			ctx, done, err = ctdClient.WithLease(ctx)
+			if err != nil {
+				return err
+			}
+			defer done(ctx)
+
+			if err := fetchSelectedLayers(ctx, ctdClient, local, layers32, commands.IntToInt32Array(context.IntSlice("exclude-layer")), context.StringSlice("platform"), context.String("platform-default-os")); err != nil {
+				return err
+			}
+		}
+
+		_, span := tracer.Start(ctx, "resolve image")
+		local, err = resolveImageName(ctx, ctdClient, local)
+		if err != nil {
+			span.End()
+			return err
+		}
+		image, err := ctdClient.GetImage(ctx, local)
+		span.End()
+		if err != nil {
+			return err
+		}
+		if err := checkPinnedDigest(context, image); err != nil {
+			return err
+		}
+		if err := checkLayerRange(ctx, context, image); err != nil {
+			return err
+		}
+
+		_, descs, err := getImageLayerInfos(ctdClient, ctx, local, layers32, commands.IntToInt32Array(context.IntSlice("exclude-layer")), context.StringSlice("platform"), context.String("platform-default-os"))
+		if err != nil {
+			return err
+		}
+
+		_, span = tracer.Start(ctx, "build config")
+		descs = encryptedDescriptors(descs)
+		if len(descs) == 0 {
+			logrus.Warnf("image %s has no encrypted layers to decrypt", local)
+		}
+		if n := context.Int("keys-required"); n > 0 {
+			if err := checkKeysRequired(context, descs, n); err != nil {
+				span.End()
+				return err
+			}
+		}
+		cc, err := CreateDecryptCryptoConfig(context, descs)
+		span.End()
+		if err != nil {
+			return err
+		}
+		if path := context.String("dump-config"); path != "" {
+			if err := dumpCryptoConfig(path, cc); err != nil {
+				return err
+			}
+		}
+
+		opts := cryptOpts(context, layers32)
+		// the layers that were not fetched cannot be verified
+		if context.Bool("verify-diffids") {
+			if !remote {
+				opts = append(opts, cryptd.WithVerifyDiffIDs())
+			} else if context.IsSet("verify-diffids") {
+				logrus.Warn("--verify-diffids is not supported with --remote; the DiffIDs of the decrypted layers are not verified")
+			}
+		}
+		if unset := context.StringSlice("unset-env"); len(unset) > 0 {
+			opts = append(opts, cryptd.WithConfigTransform(unsetEnv(unset)))
+		}
+
+		client := cryptd.New(ctdClient)
+		decImage, err := client.DecryptImage(ctx, image, newName, &cc, opts...)
+		if err != nil {
+			return err
+		}
+
+		if context.Bool("summary") || context.String("report-file") != "" {
+			if err := sum.addKeyUsage(context, descs); err != nil {
+				return err
+			}
+		}
+		if err := finishSummary(ctx, context, sum, image, decImage); err != nil {
+			return err
+		}
+		return unchangedStatus(image, decImage)
+	},
+}
+
+// checkKeysRequired ensures that at least n of the keys given with --key unwrap the
+// layer key of one of the encrypted layers, so that decrypting fails before anything
+// is written if too few usable keys were given
+func checkKeysRequired(context *cli.Context, descs []ocispec.Descriptor, n int) error {
+	usable := 0
+	for _, key := range context.StringSlice("key") {
+		dc, err := createKeyDecryptConfig(context, key)
+		if err != nil {
+			return err
+		}
+		for _, desc := range descs {
+			if _, _, _, err := encryption.DecryptLayer(dc, nil, desc, true); err == nil {
+				usable++
+				break
+			}
+		}
+	}
+	if usable < n {
+		return errors.Errorf("%d of the %d keys given with --key unwrap a layer key of the image, %d are required", usable, len(context.StringSlice("key")), n)
+	}
+	return nil
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// parameterSchemes maps the crypto config parameters to the scheme using them
+var parameterSchemes = map[string]string{
+	"pubkeys":                   "jwe",
+	"privkeys":                  "jwe",
+	"privkeys-passwords":        "jwe",
+	"x509s":                     "pkcs7",
+	"gpg-recipients":            "pgp",
+	"gpg-pubkeyringfile":        "pgp",
+	"gpg-privatekeys":           "pgp",
+	"gpg-privatekeys-passwords": "pgp",
+}
+
+// publicParameters are the parameters that do not hold secret material
+var publicParameters = map[string]bool{
+	"pubkeys":            true,
+	"x509s":              true,
+	"gpg-recipients":     true,
+	"gpg-pubkeyringfile": true,
+}
+
+// cryptoConfigDump is a redacted view of a CryptoConfig; secret material is
+// only ever counted while public keys are listed by their fingerprint
+type cryptoConfigDump struct {
+	Encrypt *parametersDump `json:"encrypt,omitempty"`
+	// AttachedDecrypt holds the decryption parameters attached to the encryption
+	// config for adding recipients to already encrypted layers
+	AttachedDecrypt *parametersDump `json:"attached_decrypt,omitempty"`
+	Decrypt         *parametersDump `json:"decrypt,omitempty"`
+}
+
+type parametersDump struct {
+	Schemes    []string                 `json:"schemes"`
+	Parameters map[string]parameterDump `json:"parameters"`
+}
+
+type parameterDump struct {
+	Count        int      `json:"count"`
+	Fingerprints []string `json:"fingerprints,omitempty"`
+}
+
+func dumpParameters(parameters map[string][][]byte) *parametersDump {
+	if len(parameters) == 0 {
+		return nil
+	}
+	var (
+		d = &parametersDump{
+			Parameters: make(map[string]parameterDump),
+		}
+		schemes = make(map[string]struct{})
+	)
+	for name, values := range parameters {
+		if len(values) == 0 {
+			continue
+		}
+		if scheme, ok := parameterSchemes[name]; ok {
+			schemes[scheme] = struct{}{}
+		}
+		pd := parameterDump{
+			Count: len(values),
+		}
+		if publicParameters[name] {
+			for _, v := range values {
+				pd.Fingerprints = append(pd.Fingerprints, digest.FromBytes(v).String())
+			}
+		}
+		d.Parameters[name] = pd
+	}
+	for scheme := range schemes {
+		d.Schemes = append(d.Schemes, scheme)
+	}
+	sort.Strings(d.Schemes)
+	return d
+}
+
+// dumpCryptoConfig writes a redacted view of the crypto config to path
+func dumpCryptoConfig(path string, cc encconfig.CryptoConfig) error {
+	var d cryptoConfigDump
+	if cc.EncryptConfig != nil {
+		d.Encrypt = dumpParameters(cc.EncryptConfig.Parameters)
+		d.AttachedDecrypt = dumpParameters(cc.EncryptConfig.DecryptConfig.Parameters)
+	}
+	if cc.DecryptConfig != nil {
+		d.Decrypt = dumpParameters(cc.DecryptConfig.Parameters)
+	}
+	p, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, p, 0644)
+}
@@ -1,119 +1,357 @@
 package main
 
 import (
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cmd/ctr/commands"
-	"github.com/containerd/containerd/defaults"
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
 	"github.com/crosbymichael/cryptd"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
 var encryptCommand = cli.Command{
 	Name: "encrypt",
-	Flags: append([]cli.Flag{
-		cli.StringFlag{
+	Flags: append(append([]cli.Flag{
+		cli.StringSliceFlag{
 			Name:  "recipient",
-			Usage: "Recipient of the image is the person who can decrypt it in the form specified above (i.e. jwe:/path/to/key)",
-		},
-		cli.IntSliceFlag{
-			Name:  "layer",
-			Usage: "The layer to encrypt; this must be either the layer number or a negative number starting with -1 for topmost layer",
+			Usage: "Recipient of the image is the person who can decrypt it in the form specified above (i.e. jwe:/path/to/key); jwe and pkcs7 file names may be globs such as jwe:/keys/*.pem",
 		},
 		cli.StringSliceFlag{
-			Name:  "platform",
-			Usage: "For which platform to encrypt; by default encrytion is done for all platforms",
+			Name:  "layer-recipient",
+			Usage: "Recipient of a single layer in the form <layer>=<recipient> (i.e. 0=jwe:/path/to/key); the layer is numbered as for --layer and encrypted only for its own recipients",
 		},
-	},
+		cli.StringFlag{
+			Name:  "recipient-aliases",
+			Usage: "JSON file mapping alias names to recipients; aliases are given as @<name> recipients",
+		},
+		cli.StringFlag{
+			Name:  "keyserver",
+			Usage: "The HKP keyserver to fetch pgp:keyserver:<keyid> recipients from",
+			Value: defaultKeyserver,
+		},
+		cli.BoolFlag{
+			Name:  "print-recipients",
+			Usage: "Print the recipients after expanding aliases and reading their keys, with the identity of their keys, and exit without encrypting",
+		},
+		cli.StringFlag{
+			Name:  "input",
+			Usage: "Read the image from an OCI or Docker tar archive instead of the image store",
+		},
+		cli.StringFlag{
+			Name:  "compression",
+			Usage: "Compress the selected plaintext layers before encrypting them; only gzip is supported, zstd is rejected; by default layers keep their compression",
+		},
+		cli.IntFlag{
+			Name:  "compression-level",
+			Usage: "The gzip compression level (0-9) used with --compression; -1 selects the default level",
+			Value: gzip.DefaultCompression,
+		},
+		cli.BoolFlag{
+			Name:  "materialize-foreign",
+			Usage: "Fetch selected foreign layers from their urls so that they can be encrypted",
+		},
+		cli.BoolFlag{
+			Name:  "compat-docker",
+			Usage: "Give encrypted layers the Docker encrypted layer media types for registries rejecting the OCI ones",
+		},
+		cli.StringFlag{
+			Name:  "output-tar",
+			Usage: "Write the encrypted image to a tar archive; the image is kept in the image store as well; no archive is written if no layer was encrypted",
+		},
+		cli.StringFlag{
+			Name:  "output-format",
+			Usage: "The format of the --output-tar archive: oci for an OCI image layout, or docker to add the manifest of 'docker load'",
+			Value: "oci",
+		},
+		cli.StringFlag{
+			Name:  "push",
+			Usage: "Push the encrypted image to the reference after encrypting it; nothing is pushed if no layer was encrypted",
+		},
+		cli.IntFlag{
+			Name:  "push-retries",
+			Usage: "How often a failed push is retried",
+			Value: 3,
+		},
+	}, append(append(ImageLayerFlags, ImageCryptFlags...), commands.RegistryFlags...)...),
 		ImageDecryptionFlags...),
-	Action: func(clix *cli.Context) error {
+	Action: func(context *cli.Context) error {
+		if context.Bool("print-recipients") {
+			return printRecipients(context)
+		}
 		local := context.Args().First()
-		if local == "" {
+		newName := context.Args().Get(1)
+		if context.String("input") != "" && context.NArg() == 1 {
+			// the only image of the archive is encrypted to the given name
+			local, newName = "", local
+		} else if local == "" {
 			return errors.New("please provide the name of an image to encrypt")
 		}
-
-		newName := context.Args().Get(1)
-		if newName != "" {
-			fmt.Printf("Encrypting %s to %s\n", local, newName)
+		if err := validateNewName(newName); err != nil {
+			return err
+		}
+		if format := context.String("output-format"); context.String("output-tar") != "" && format != "oci" && format != "docker" {
+			return errors.Errorf("unsupported archive format %s; expected oci or docker", format)
+		}
+		if context.String("compression") == "zstd" {
+			// the decompression of containerd, used to verify and decrypt layers, and the
+			// encryption of layers only know gzip compressed and uncompressed layers
+			return errors.New("zstd compression is not supported yet; use --compression gzip or keep the compression of the layers")
 		}
-		ctx := context.Background()
-		ctdClient, err := containerd.New(defaults.DefaultAddress)
+		source := local
+		if input := context.String("input"); input != "" {
+			source = fmt.Sprintf("%s:%s", input, local)
+		}
+		fmt.Printf("Encrypting %s to %s\n", source, newName)
+		cleanup, err := createGPGHomedir(context)
 		if err != nil {
 			return err
 		}
+		defer cleanup()
+
+		sum := newSummary()
+		ctx := appContext()
+		ctdClient, err := newContainerdClient(ctx, context)
+		if err != nil {
+			return err
+		}
+
+		if input := context.String("input"); input != "" {
+			imported, remove, err := importArchive(ctx, ctdClient, input, local)
+			if err != nil {
+				return err
+			}
+			defer remove()
+			local = imported
+		}
 
+		_, span := tracer.Start(ctx, "resolve image")
+		local, err = resolveImageName(ctx, ctdClient, local)
+		if err != nil {
+			span.End()
+			return err
+		}
 		image, err := ctdClient.GetImage(ctx, local)
+		span.End()
 		if err != nil {
 			return err
 		}
+		if err := checkPinnedDigest(context, image); err != nil {
+			return err
+		}
+		if err := checkLayerRange(ctx, context, image); err != nil {
+			return err
+		}
 
 		recipients := context.StringSlice("recipient")
-		if len(recipients) == 0 {
+		layerRecipients, err := parseLayerRecipients(context.StringSlice("layer-recipient"))
+		if err != nil {
+			return err
+		}
+		if len(recipients) == 0 && len(layerRecipients) == 0 {
 			return errors.New("no recipients given -- nothing to do")
 		}
 		layers32 := commands.IntToInt32Array(context.IntSlice("layer"))
 
-		gpgRecipients, pubKeys, x509s, err := processRecipientKeys(recipients)
+		// without --recipient only the layers given with --layer-recipient are encrypted
+		var cc *encconfig.CryptoConfig
+		if len(recipients) > 0 {
+			_, span = tracer.Start(ctx, "build config")
+			config, err := createEncryptCryptoConfig(context, recipients)
+			span.End()
+			if err != nil {
+				return err
+			}
+			cc = &config
+		}
+
+		_, descs, err := getImageLayerInfos(ctdClient, ctx, local, layers32, commands.IntToInt32Array(context.IntSlice("exclude-layer")), context.StringSlice("platform"), context.String("platform-default-os"))
 		if err != nil {
 			return err
 		}
 
-		encryptCcs := []encconfig.CryptoConfig{}
-		_, err = createGPGClient(context)
-		gpgInstalled := err == nil
-
-		if len(gpgRecipients) > 0 && gpgInstalled {
-			gpgClient, err := createGPGClient(context)
-			if err != nil {
-				return err
+		// Create Decryption CryptoConfig for use in adding recipients to
+		// existing image if decryptable.
+		decryptCc, err := CreateDecryptCryptoConfig(context, descs)
+		if err != nil {
+			return err
+		}
+		if err := checkAddRecipients(descs, decryptCc.DecryptConfig); err != nil {
+			return err
+		}
+		if cc != nil {
+			cc.EncryptConfig.AttachDecryptConfig(decryptCc.DecryptConfig)
+			if path := context.String("dump-config"); path != "" {
+				if err := dumpCryptoConfig(path, *cc); err != nil {
+					return err
+				}
 			}
+			sum.addRecipients(cc.EncryptConfig)
+		}
 
-			gpgPubRingFile, err := gpgClient.ReadGPGPubRingFile()
-			if err != nil {
-				return err
+		opts := cryptOpts(context, layers32)
+		if context.Bool("materialize-foreign") {
+			opts = append(opts, cryptd.WithMaterializeForeign())
+		}
+		if context.Bool("compat-docker") {
+			opts = append(opts, cryptd.WithEncryptedMediaType(cryptd.DockerEncryptedMediaType))
+		}
+		switch compression := context.String("compression"); compression {
+		case "":
+		case "gzip":
+			level := context.Int("compression-level")
+			if level < gzip.DefaultCompression || level > gzip.BestCompression {
+				return errors.Errorf("invalid gzip compression level %d", level)
 			}
+			opts = append(opts, cryptd.WithGzipCompression(level))
+		default:
+			return errors.Errorf("unsupported compression %s; only gzip is supported", compression)
+		}
 
-			gpgCc, err := encconfig.EncryptWithGpg(gpgRecipients, gpgPubRingFile)
+		for layer, rs := range layerRecipients {
+			lcc, err := createEncryptCryptoConfig(context, rs)
 			if err != nil {
-				return err
+				return errors.Wrapf(err, "recipients of layer %d", layer)
 			}
-			encryptCcs = append(encryptCcs, gpgCc)
-
+			lcc.EncryptConfig.AttachDecryptConfig(decryptCc.DecryptConfig)
+			opts = append(opts, cryptd.WithLayerCryptoConfig(layer, &lcc))
+			sum.addRecipients(lcc.EncryptConfig)
 		}
 
-		// Create Encryption Crypto Config
-		pkcs7Cc, err := encconfig.EncryptWithPkcs7(x509s)
+		client := cryptd.New(ctdClient)
+		encImage, err := client.EncryptImage(ctx, image, newName, cc, opts...)
 		if err != nil {
 			return err
 		}
-		encryptCcs = append(encryptCcs, pkcs7Cc)
 
-		jweCc, err := encconfig.EncryptWithJwe(pubKeys)
-		if err != nil {
+		if err := publishEncrypted(context, image, encImage, func(path string) error {
+			return exportArchive(ctx, ctdClient, encImage, path, context.String("output-format"))
+		}, func(ref string) error {
+			return pushImage(ctx, context, ctdClient, ref, encImage)
+		}); err != nil {
 			return err
 		}
-		encryptCcs = append(encryptCcs, jweCc)
 
-		cc := encconfig.CombineCryptoConfigs(encryptCcs)
+		if err := finishSummary(ctx, context, sum, image, encImage); err != nil {
+			return err
+		}
+		return unchangedStatus(image, encImage)
+	},
+}
 
-		_, descs, err := getImageLayerInfos(ctdClient, ctx, local, layers32, context.StringSlice("platform"))
-		if err != nil {
+// publishEncrypted writes the encrypted image to the --output-tar archive and pushes
+// it to the --push reference. When no layer was encrypted the result is the plaintext
+// source image; it is then neither written nor pushed.
+func publishEncrypted(context *cli.Context, source, result containerd.Image, export func(path string) error, push func(ref string) error) error {
+	path, ref := context.String("output-tar"), context.String("push")
+	if result.Target().Digest == source.Target().Digest {
+		if path != "" || ref != "" {
+			logrus.Warnf("no layer of %s was encrypted; the unencrypted image is neither written to an archive nor pushed", source.Name())
+		}
+		return nil
+	}
+	if path != "" {
+		if err := export(path); err != nil {
 			return err
 		}
+	}
+	if ref != "" {
+		if err := push(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// Create Decryption CryptoConfig for use in adding recipients to
-		// existing image if decryptable.
-		decryptCc, err := CreateDecryptCryptoConfig(context, descs)
+// parseLayerRecipients groups the --layer-recipient options, <layer>=<recipient>, by layer
+func parseLayerRecipients(values []string) (map[int32][]string, error) {
+	recipients := make(map[int32][]string)
+	for _, v := range values {
+		idx := strings.Index(v, "=")
+		if idx <= 0 {
+			return nil, errors.Errorf("invalid layer recipient %q; expected <layer>=<recipient>", v)
+		}
+		layer, err := strconv.ParseInt(v[:idx], 10, 32)
 		if err != nil {
-			return err
+			return nil, errors.Errorf("invalid layer number in layer recipient %q", v)
 		}
-		cc.EncryptConfig.AttachDecryptConfig(decryptCc.DecryptConfig)
+		recipients[int32(layer)] = append(recipients[int32(layer)], v[idx+1:])
+	}
+	return recipients, nil
+}
 
-		client := cryptd.New(ctdClient)
-		_, err = client.EncryptImage(ctx, image, newName, cc, cryptd.WithPlatforms(clix.StringSlice("platform")), cryptd.WithLayers(layers32))
+// printRecipients prints the recipients of --recipient and --layer-recipient, one line
+// per key: the scheme and the identity of the key, a digest of the public key for jwe
+// and the subject and a digest of the public key of the certificate for pkcs7. Keys
+// given more than once are printed once.
+func printRecipients(context *cli.Context) error {
+	recipients := context.StringSlice("recipient")
+	layerRecipients, err := parseLayerRecipients(context.StringSlice("layer-recipient"))
+	if err != nil {
+		return err
+	}
+	for _, r := range layerRecipients {
+		recipients = append(recipients, r...)
+	}
+	if len(recipients) == 0 {
+		return errors.New("no recipients given -- nothing to do")
+	}
+	recipients, err = expandRecipients(context, recipients)
+	if err != nil {
 		return err
+	}
 
-	},
+	var (
+		seen = make(map[string]bool)
+		tw   = tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+	)
+	fmt.Fprintln(tw, "RECIPIENT\tSCHEME\tIDENTITY")
+	for _, recipient := range recipients {
+		cc, err := encryptCryptoConfig(context, []string{recipient})
+		if err != nil {
+			return err
+		}
+		params := cc.EncryptConfig.Parameters
+		var ids [][2]string
+		for _, r := range params["gpg-recipients"] {
+			ids = append(ids, [2]string{"pgp", strings.ToLower(string(r))})
+		}
+		for _, k := range params["pubkeys"] {
+			ids = append(ids, [2]string{"jwe", publicKeyFingerprint(k)})
+		}
+		for _, c := range params["x509s"] {
+			ids = append(ids, [2]string{"pkcs7", certificateIdentity(c)})
+		}
+		for _, id := range ids {
+			if seen[id[0]+":"+id[1]] {
+				continue
+			}
+			seen[id[0]+":"+id[1]] = true
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", recipient, id[0], id[1])
+		}
+	}
+	return tw.Flush()
+}
+
+// certificateIdentity describes a certificate by its subject and the digest of its
+// public key
+func certificateIdentity(cert []byte) string {
+	der := cert
+	if block, _ := pem.Decode(cert); block != nil {
+		der = block.Bytes
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		return certificateFingerprint(cert)
+	}
+	return fmt.Sprintf("%s %s", c.Subject.String(), certificateFingerprint(cert))
 }
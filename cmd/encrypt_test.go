@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testImage is an image of the given name and target; its other methods are not
+// implemented
+type testImage struct {
+	containerd.Image
+	name   string
+	target ocispec.Descriptor
+}
+
+func (i testImage) Name() string {
+	return i.name
+}
+
+func (i testImage) Target() ocispec.Descriptor {
+	return i.target
+}
+
+func newTestImage(name, manifest string) containerd.Image {
+	return testImage{
+		name: name,
+		target: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromString(manifest),
+		},
+	}
+}
+
+func TestPublishEncrypted(t *testing.T) {
+	source := newTestImage("docker.io/library/alpine:latest", "plaintext")
+
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		result   containerd.Image
+		exported string
+		pushed   string
+	}{
+		{
+			name:   "no-op push",
+			args:   []string{"--push", "registry.example.com/alpine:enc"},
+			result: source,
+		},
+		{
+			name:   "no-op archive",
+			args:   []string{"--output-tar", "alpine.tar"},
+			result: source,
+		},
+		{
+			name:   "no-op archive and push",
+			args:   []string{"--output-tar", "alpine.tar", "--push", "registry.example.com/alpine:enc"},
+			result: newTestImage("docker.io/library/alpine:enc", "plaintext"),
+		},
+		{
+			name:   "encrypted push",
+			args:   []string{"--push", "registry.example.com/alpine:enc"},
+			result: newTestImage("docker.io/library/alpine:enc", "encrypted"),
+			pushed: "registry.example.com/alpine:enc",
+		},
+		{
+			name:     "encrypted archive and push",
+			args:     []string{"--output-tar", "alpine.tar", "--push", "registry.example.com/alpine:enc"},
+			result:   newTestImage("docker.io/library/alpine:enc", "encrypted"),
+			exported: "alpine.tar",
+			pushed:   "registry.example.com/alpine:enc",
+		},
+		{
+			name:   "encrypted without publishing",
+			result: newTestImage("docker.io/library/alpine:enc", "encrypted"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var exported, pushed string
+			context := testContext(t, encryptCommand.Flags, tc.args...)
+			err := publishEncrypted(context, source, tc.result, func(path string) error {
+				exported = path
+				return nil
+			}, func(ref string) error {
+				pushed = ref
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exported != tc.exported {
+				t.Errorf("exported to %q, expected %q", exported, tc.exported)
+			}
+			if pushed != tc.pushed {
+				t.Errorf("pushed to %q, expected %q", pushed, tc.pushed)
+			}
+		})
+	}
+}
+
+func TestPublishEncryptedPushError(t *testing.T) {
+	source := newTestImage("docker.io/library/alpine:latest", "plaintext")
+	result := newTestImage("docker.io/library/alpine:enc", "encrypted")
+	context := testContext(t, encryptCommand.Flags, "--push", "registry.example.com/alpine:enc")
+
+	pushErr := errors.New("push failed")
+	err := publishEncrypted(context, source, result, func(string) error {
+		return nil
+	}, func(string) error {
+		return pushErr
+	})
+	if err != pushErr {
+		t.Fatalf("got error %v, expected the one of the push", err)
+	}
+}
+
+func TestParseLayerRecipients(t *testing.T) {
+	recipients, err := parseLayerRecipients([]string{"0=jwe:a.pem", "-1=pgp:alice@example.com", "0=pkcs7:b.crt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recipients[0]; len(got) != 2 || got[0] != "jwe:a.pem" || got[1] != "pkcs7:b.crt" {
+		t.Errorf("got recipients %v for layer 0", got)
+	}
+	if got := recipients[-1]; len(got) != 1 || got[0] != "pgp:alice@example.com" {
+		t.Errorf("got recipients %v for layer -1", got)
+	}
+
+	for _, v := range []string{"jwe:a.pem", "=jwe:a.pem", "x=jwe:a.pem", "99999999999=jwe:a.pem"} {
+		if _, err := parseLayerRecipients([]string{v}); err == nil {
+			t.Errorf("expected an error for %q", v)
+		}
+	}
+}
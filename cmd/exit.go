@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containerd/containerd"
+	"github.com/pkg/errors"
+)
+
+// the exit codes of the commands besides 0 for success; see "Exit codes" in the README
+const (
+	exitCodeError   = 1
+	exitCodeNoop    = 3
+	exitCodePartial = 4
+)
+
+// exitStatus is returned by a command that succeeded but has to tell scripts that it
+// did nothing or only part of the work
+type exitStatus struct {
+	code int
+	msg  string
+}
+
+func (s *exitStatus) Error() string {
+	return s.msg
+}
+
+func noopStatus(format string, args ...interface{}) error {
+	return &exitStatus{code: exitCodeNoop, msg: fmt.Sprintf(format, args...)}
+}
+
+func partialStatus(format string, args ...interface{}) error {
+	return &exitStatus{code: exitCodePartial, msg: fmt.Sprintf(format, args...)}
+}
+
+// unchangedStatus returns a no-op status if the image created from source has the
+// target of source, that is no layer was encrypted or decrypted
+func unchangedStatus(source, result containerd.Image) error {
+	if result.Target().Digest != source.Target().Digest {
+		return nil
+	}
+	return noopStatus("nothing to do: %s was left unchanged", source.Name())
+}
+
+// exitCode returns the exit code of the process for the error of a command
+func exitCode(err error) int {
+	if s, ok := errors.Cause(err).(*exitStatus); ok {
+		return s.code
+	}
+	return exitCodeError
+}
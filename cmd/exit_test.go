@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{name: "error", err: errors.New("failed"), code: exitCodeError},
+		{name: "no-op", err: noopStatus("nothing to do"), code: exitCodeNoop},
+		{name: "partial", err: partialStatus("%d layers skipped", 2), code: exitCodePartial},
+		{name: "wrapped no-op", err: errors.Wrap(noopStatus("nothing to do"), "encrypt"), code: exitCodeNoop},
+		{name: "wrapped partial", err: errors.Wrap(partialStatus("layers skipped"), "recrypt"), code: exitCodePartial},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := exitCode(tc.err); code != tc.code {
+				t.Fatalf("got exit code %d, expected %d", code, tc.code)
+			}
+		})
+	}
+}
+
+func TestUnchangedStatus(t *testing.T) {
+	source := newTestImage("docker.io/library/alpine:latest", "plaintext")
+	for _, tc := range []struct {
+		name   string
+		result testImage
+		code   int
+	}{
+		{name: "same image", result: source.(testImage), code: exitCodeNoop},
+		{name: "same target", result: newTestImage("docker.io/library/alpine:enc", "plaintext").(testImage), code: exitCodeNoop},
+		{name: "new target", result: newTestImage("docker.io/library/alpine:enc", "encrypted").(testImage)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := unchangedStatus(source, tc.result)
+			if tc.code == 0 {
+				if err != nil {
+					t.Fatalf("got %v for a changed image", err)
+				}
+				return
+			}
+			if code := exitCode(err); code != tc.code {
+				t.Fatalf("got exit code %d, expected %d", code, tc.code)
+			}
+		})
+	}
+}
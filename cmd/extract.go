@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/pkg/encryption"
+	"github.com/crosbymichael/cryptd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var extractLayerCommand = cli.Command{
+	Name:      "extract-layer",
+	Usage:     "Decrypt a single layer of an image to an uncompressed tar file",
+	ArgsUsage: "<ref>",
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "digest",
+			Usage: "The digest of the layer to extract",
+		},
+		cli.StringFlag{
+			Name:  "out",
+			Usage: "The file to write the layer to",
+		},
+		cli.StringFlag{
+			Name:  "recovery-bundle",
+			Usage: "Unwrap the layer key from the recovery bundle written by recovery-bundle, with the private key of the recovery recipient given with --key",
+		},
+	}, ImageDecryptionFlags...),
+	Action: func(context *cli.Context) error {
+		local := context.Args().First()
+		if local == "" {
+			return errors.New("please provide the name of an image")
+		}
+		dgst, err := digest.Parse(context.String("digest"))
+		if err != nil {
+			return errors.Wrap(err, "please provide the digest of the layer to extract")
+		}
+		out := context.String("out")
+		if out == "" {
+			return errors.New("please provide the file to write the layer to")
+		}
+		cleanup, err := createGPGHomedir(context)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		ctx := appContext()
+		ctdClient, err := newContainerdClient(ctx, context)
+		if err != nil {
+			return err
+		}
+
+		_, descs, err := getImageLayerInfos(ctdClient, ctx, local, nil, nil, nil, "")
+		if err != nil {
+			return err
+		}
+		var (
+			desc  ocispec.Descriptor
+			found bool
+		)
+		for _, d := range descs {
+			if d.Digest == dgst {
+				desc, found = d, true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("layer %s not found in image %s", dgst, local)
+		}
+
+		ra, err := ctdClient.ContentStore().ReaderAt(ctx, desc)
+		if err != nil {
+			return err
+		}
+		defer ra.Close()
+
+		if path := context.String("recovery-bundle"); path != "" {
+			if desc, err = readRecoveryBundle(path, dgst); err != nil {
+				return err
+			}
+		}
+
+		var r io.Reader = content.NewReader(ra)
+		if cryptd.IsEncryptedMediaType(desc.MediaType) {
+			cc, err := CreateDecryptCryptoConfig(context, []ocispec.Descriptor{desc})
+			if err != nil {
+				return err
+			}
+			if _, r, _, err = encryption.DecryptLayer(cc.DecryptConfig, r, desc, false); err != nil {
+				return errors.Wrapf(err, "call to DecryptLayer failed")
+			}
+		}
+		dr, err := compression.DecompressStream(r)
+		if err != nil {
+			return err
+		}
+		defer dr.Close()
+
+		f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		digester := digest.Canonical.Digester()
+		if _, err := copyLayer(ctx, io.MultiWriter(f, digester.Hash()), dr); err != nil {
+			return errors.Wrapf(err, "could not copy data")
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("Extracted layer %s with DiffID %s to %s\n", dgst, digester.Digest(), out)
+		return nil
+	},
+}
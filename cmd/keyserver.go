@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// defaultKeyserver is the HKP keyserver queried for pgp:keyserver:<keyid> recipients
+const defaultKeyserver = "https://keys.openpgp.org"
+
+// keyserverURL converts the hkp:// and hkps:// schemes of a keyserver into the
+// http and https urls that are queried
+func keyserverURL(keyserver string) (*url.URL, error) {
+	u, err := url.Parse(keyserver)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid keyserver %s", keyserver)
+	}
+	switch u.Scheme {
+	case "hkps":
+		u.Scheme = "https"
+	case "hkp":
+		u.Scheme = "http"
+		if u.Port() == "" {
+			u.Host = u.Host + ":11371"
+		}
+	case "http", "https":
+	default:
+		return nil, errors.Errorf("keyserver %s has an unsupported scheme", keyserver)
+	}
+	return u, nil
+}
+
+// fetchGPGPublicKey fetches the public key with the given key id or fingerprint from
+// the keyserver. It returns an identity of the key usable as a PGP recipient and the
+// key in the binary format of a GPG public keyring.
+func fetchGPGPublicKey(keyserver, keyid string) ([]byte, []byte, error) {
+	keyid = strings.TrimPrefix(strings.ToLower(keyid), "0x")
+	if _, err := hex.DecodeString(keyid); err != nil || len(keyid) < 8 {
+		return nil, nil, errors.Errorf("invalid PGP key id %s", keyid)
+	}
+
+	u, err := keyserverURL(keyserver)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.Path = "/pks/lookup"
+	u.RawQuery = url.Values{
+		"op":      []string{"get"},
+		"options": []string{"mr"},
+		"search":  []string{"0x" + keyid},
+	}.Encode()
+
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not query keyserver %s", keyserver)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.Errorf("keyserver %s returned %s for key %s", keyserver, resp.Status, keyid)
+	}
+	el, err := openpgp.ReadArmoredKeyRing(resp.Body)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not read key %s from keyserver %s", keyid, keyserver)
+	}
+	if len(el) != 1 {
+		return nil, nil, errors.Errorf("keyserver %s returned %d keys for key %s", keyserver, len(el), keyid)
+	}
+
+	var recipient string
+	for _, identity := range el[0].Identities {
+		if identity.UserId.Email != "" {
+			recipient = identity.UserId.Email
+			break
+		}
+	}
+	if recipient == "" {
+		return nil, nil, errors.Errorf("key %s from keyserver %s has no identity with an email address", keyid, keyserver)
+	}
+
+	var pubKey bytes.Buffer
+	if err := el[0].Serialize(&pubKey); err != nil {
+		return nil, nil, err
+	}
+	return []byte(recipient), pubKey.Bytes(), nil
+}
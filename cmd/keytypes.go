@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	"github.com/pkg/errors"
+)
+
+// checkJWEKeyType ensures that the public key of a jwe recipient can wrap a layer key;
+// the JWE key wrapping uses RSA-OAEP for RSA keys and ECDH-ES+A256KW for EC keys on the
+// NIST curves. Keys that cannot be parsed as PKIX (i.e. JWKs) are left to the layer
+// encryption.
+func checkJWEKeyType(recipient string, key []byte) error {
+	der := key
+	if block, _ := pem.Decode(key); block != nil {
+		der = block.Bytes
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			return nil
+		}
+		return errors.Errorf("recipient %s has an EC key on curve %s; jwe supports the curves P-256, P-384 and P-521", recipient, k.Curve.Params().Name)
+	}
+	return errors.Errorf("recipient %s has a %s key; jwe supports RSA and EC keys", recipient, keyTypeName(pub))
+}
+
+// checkPKCS7KeyType ensures that the certificate of a pkcs7 recipient holds an RSA key,
+// the only key type the PKCS7 envelope supports
+func checkPKCS7KeyType(recipient string, cert []byte) error {
+	der := cert
+	if block, _ := pem.Decode(cert); block != nil {
+		der = block.Bytes
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		return errors.Wrapf(err, "could not parse the certificate of recipient %s", recipient)
+	}
+	if _, ok := c.PublicKey.(*rsa.PublicKey); !ok {
+		return errors.Errorf("recipient %s has a certificate with a %s key; pkcs7 supports RSA keys only", recipient, keyTypeName(c.PublicKey))
+	}
+	return nil
+}
+
+// checkRecipientKeyTypes checks the public keys and certificates a resolver returned
+// for the recipient the same way as the ones of jwe and pkcs7 recipients
+func checkRecipientKeyTypes(recipient string, ec *encconfig.EncryptConfig) error {
+	if ec == nil {
+		return nil
+	}
+	for _, key := range ec.Parameters["pubkeys"] {
+		if err := checkJWEKeyType(recipient, key); err != nil {
+			return err
+		}
+	}
+	for _, cert := range ec.Parameters["x509s"] {
+		if err := checkPKCS7KeyType(recipient, cert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func keyTypeName(pub interface{}) string {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return "EC"
+	}
+	return fmt.Sprintf("%T", pub)
+}
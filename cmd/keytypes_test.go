@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	"github.com/crosbymichael/cryptd"
+)
+
+func marshalPublicKey(t *testing.T, pub interface{}) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// createCertificate returns a PEM encoded self-signed certificate of the key
+func createCertificate(t *testing.T, pub, priv interface{}) []byte {
+	t.Helper()
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func generateECKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCheckJWEKeyType(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		key  []byte
+		err  bool
+	}{
+		{name: "RSA", key: marshalPublicKey(t, &rsaKey.PublicKey)},
+		{name: "EC P-256", key: marshalPublicKey(t, &generateECKey(t, elliptic.P256()).PublicKey)},
+		{name: "EC P-384", key: marshalPublicKey(t, &generateECKey(t, elliptic.P384()).PublicKey)},
+		{name: "EC P-521", key: marshalPublicKey(t, &generateECKey(t, elliptic.P521()).PublicKey)},
+		{name: "EC P-224", key: marshalPublicKey(t, &generateECKey(t, elliptic.P224()).PublicKey), err: true},
+		{name: "Ed25519", key: marshalPublicKey(t, edPub), err: true},
+		{name: "JWK", key: []byte(`{"kty":"oct","k":"AAAA"}`)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkJWEKeyType("jwe:key.pem", tc.key)
+			if tc.err && err == nil {
+				t.Fatal("expected a key type mismatch")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCheckPKCS7KeyType(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey := generateECKey(t, elliptic.P256())
+
+	for _, tc := range []struct {
+		name string
+		cert []byte
+		err  bool
+	}{
+		{name: "RSA", cert: createCertificate(t, &rsaKey.PublicKey, rsaKey)},
+		{name: "EC", cert: createCertificate(t, &ecKey.PublicKey, ecKey), err: true},
+		{name: "not a certificate", cert: marshalPublicKey(t, &rsaKey.PublicKey), err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkPKCS7KeyType("pkcs7:cert.pem", tc.cert)
+			if tc.err && err == nil {
+				t.Fatal("expected a key type mismatch")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// p224Resolver resolves all values to a JWE recipient with a key on a curve jwe
+// does not support
+type p224Resolver struct {
+	pubKey []byte
+}
+
+func (p224Resolver) Scheme() string {
+	return "resolver-p224"
+}
+
+func (r p224Resolver) Resolve(value string) (encconfig.CryptoConfig, error) {
+	return encconfig.EncryptWithJwe([][]byte{r.pubKey})
+}
+
+func TestRecipientKeyTypesChecked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p224 := &generateECKey(t, elliptic.P224()).PublicKey
+	if _, ok := cryptd.GetRecipientResolver("resolver-p224"); !ok {
+		cryptd.RegisterRecipientResolver(p224Resolver{pubKey: marshalPublicKey(t, p224)})
+	}
+
+	context := testContext(t, encryptCommand.Flags)
+	for _, recipient := range []string{
+		"jwe:" + writePublicKey(t, dir, "p224.pem", p224),
+		"jwe:" + dir + "/p224*.pem",
+		"resolver-p224:alice",
+	} {
+		t.Run(recipient, func(t *testing.T) {
+			if _, err := createEncryptCryptoConfig(context, []string{recipient}); err == nil {
+				t.Fatal("expected a key type mismatch")
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/platforms"
+	"github.com/crosbymichael/cryptd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// layerEntry describes a layer with the numbers it is selected by with --layer
+type layerEntry struct {
+	Platform      string `json:"platform,omitempty"`
+	Index         int32  `json:"index"`
+	NegativeIndex int32  `json:"negative_index"`
+	Digest        string `json:"digest"`
+	Size          int64  `json:"size"`
+	MediaType     string `json:"mediaType"`
+}
+
+// encAnnotationPrefix is the prefix of the annotations written by the layer encryption
+const encAnnotationPrefix = "org.opencontainers.image.enc."
+
+// rawLayerAnnotations holds the encryption annotations of a layer exactly as they
+// are in the manifest
+type rawLayerAnnotations struct {
+	Platform    string            `json:"platform,omitempty"`
+	Index       int32             `json:"index"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+var layersCommand = cli.Command{
+	Name:      "layers",
+	Usage:     "List the layers of an image per platform with the numbers selecting them with --layer",
+	ArgsUsage: "<ref>",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "platform",
+			Usage: "For which platform to list the layers; by default all platforms are listed",
+		}, cli.StringFlag{
+			Name:  "platform-default-os",
+			Usage: "The OS used to complete platforms that only name an architecture (i.e. amd64)",
+			Value: "linux",
+		}, cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the layers as JSON",
+		}, cli.BoolFlag{
+			Name:  "manifest-only",
+			Usage: "Print the raw org.opencontainers.image.enc.* annotations of each layer as JSON, without interpreting them",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		local := context.Args().First()
+		if local == "" {
+			return errors.New("please provide the name of an image")
+		}
+
+		ctx := appContext()
+		ctdClient, err := newContainerdClient(ctx, context)
+		if err != nil {
+			return err
+		}
+
+		lis, descs, err := listLayerInfos(ctx, ctdClient, local, context.StringSlice("platform"), context.String("platform-default-os"))
+		if err != nil {
+			return err
+		}
+
+		if context.Bool("manifest-only") {
+			raw := make([]rawLayerAnnotations, 0, len(lis))
+			for _, li := range lis {
+				r := rawLayerAnnotations{
+					Index:       int32(li.Index),
+					Digest:      li.Descriptor.Digest.String(),
+					Annotations: make(map[string]string),
+				}
+				if li.Descriptor.Platform != nil {
+					r.Platform = platforms.Format(*li.Descriptor.Platform)
+				}
+				for k, v := range li.Descriptor.Annotations {
+					if strings.HasPrefix(k, encAnnotationPrefix) {
+						r.Annotations[k] = v
+					}
+				}
+				raw = append(raw, r)
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(raw)
+		}
+
+		entries := make([]layerEntry, 0, len(lis))
+		for _, li := range lis {
+			desc := li.Descriptor
+			e := layerEntry{
+				Index:         int32(li.Index),
+				NegativeIndex: int32(li.Index) - cryptd.CountLayers(descs, desc.Platform),
+				Digest:        desc.Digest.String(),
+				Size:          desc.Size,
+				MediaType:     desc.MediaType,
+			}
+			if desc.Platform != nil {
+				e.Platform = platforms.Format(*desc.Platform)
+			}
+			entries = append(entries, e)
+		}
+
+		if context.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(entries)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+		fmt.Fprintln(tw, "PLATFORM\tINDEX\tNEGATIVE\tDIGEST\tSIZE\tMEDIA TYPE")
+		for _, e := range entries {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%d\t%s\n", e.Platform, e.Index, e.NegativeIndex, e.Digest, e.Size, e.MediaType)
+		}
+		return tw.Flush()
+	},
+}
+
+// listLayerInfos returns the layers of the platforms of the image with the numbers
+// --layer selects them by. Layers that cannot be numbered by their DiffIDs are listed
+// by their position in the manifest with a warning, as --layer fails for the image.
+func listLayerInfos(ctx gocontext.Context, client *containerd.Client, name string, platformList []string, defaultOS string) ([]cryptd.LayerInfo, []ocispec.Descriptor, error) {
+	image, err := client.ImageService().Get(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	pl, err := cryptd.ParsePlatformArray(platformList, defaultOS)
+	if err != nil {
+		return nil, nil, err
+	}
+	cs := client.ContentStore()
+	alldescs, numbers, _, err := cryptd.NumberedLayerDescriptors(ctx, cs, image.Target, false)
+	if err != nil {
+		logrus.WithError(err).Warn("cannot number the layers by their diffids; listing them by their position in the manifest, --layer and --exclude-layer fail for this image")
+		if alldescs, _, err = cryptd.LayerDescriptors(ctx, cs, image.Target, false); err != nil {
+			return nil, nil, err
+		}
+		numbers = nil
+	}
+	return cryptd.FilterLayerDescriptors(alldescs, numbers, nil, nil, pl)
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	gocontext "context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"go.opentelemetry.io/otel"
 )
 
 func main() {
@@ -18,37 +22,194 @@ func main() {
 			Name:  "debug",
 			Usage: "enable debug output in the logs",
 		},
+		cli.BoolFlag{
+			Name:  "trace",
+			Usage: "export OpenTelemetry spans of the operation over OTLP, configured by the OTEL_EXPORTER_OTLP_* environment variables",
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "config file holding the profiles selected with --profile; defaults to $XDG_CONFIG_HOME/cryptd/config.json",
+		},
+		cli.StringFlag{
+			Name:  "profile",
+			Usage: "set command flags from the named profile of the config file",
+		},
+		cli.BoolFlag{
+			Name:  "no-color",
+			Usage: "do not color the output; colors are only used when writing to a terminal",
+		},
+		cli.DurationFlag{
+			Name:  "wait-for-containerd",
+			Usage: "retry connecting to containerd for up to the duration (i.e. 30s) if the daemon is not reachable yet",
+		},
 	}
 	app.Before = func(clix *cli.Context) error {
+		setupColor(clix)
 		if clix.GlobalBool("debug") {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+		if clix.GlobalBool("trace") {
+			shutdown, err := setupTracing()
+			if err != nil {
+				return err
+			}
+			shutdownTracing = shutdown
+		}
+		return nil
+	}
+	// app.After is deferred by app.Run before app.Before runs, so it cannot be set there
+	app.After = func(*cli.Context) error {
+		flushTracing()
 		return nil
 	}
 	app.Commands = []cli.Command{
 		encryptCommand,
 		decryptCommand,
+		recryptCommand,
+		reencryptAllCommand,
+		recoveryBundleCommand,
+		layersCommand,
+		compareCommand,
+		extractLayerCommand,
+		verifyCommand,
 		streamCommand,
 	}
+	for i := range app.Commands {
+		app.Commands[i].Before = applyProfile
+	}
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		flushTracing()
+		os.Exit(exitCode(err))
 	}
 }
 
+// appContext returns the root context of a command; it is cancelled on SIGINT or
+// SIGTERM so that the operation stops and cleans up, a second signal terminates
+// the process right away. The context carries the trace context of TRACEPARENT.
+func appContext() gocontext.Context {
+	// continue the trace of the calling process, if any
+	ctx := otel.GetTextMapPropagator().Extract(gocontext.Background(), envCarrier{})
+	ctx, cancel := gocontext.WithCancel(ctx)
+	s := make(chan os.Signal, 1)
+	signal.Notify(s, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-s
+		logrus.Warnf("received %s, cancelling", sig)
+		signal.Stop(s)
+		cancel()
+	}()
+	return ctx
+}
+
+// ImageLayerFlags are cli flags selecting the layers of an image to operate on
+var ImageLayerFlags = []cli.Flag{
+	cli.IntSliceFlag{
+		Name:  "layer",
+		Usage: "The layer to operate on; this must be either the layer number or a negative number starting with -1 for topmost layer. Layers are numbered by the position of their DiffID in the image config, as listed by the layers command",
+	}, cli.IntSliceFlag{
+		Name:  "exclude-layer",
+		Usage: "The layer to exclude from the selected layers; numbered the same way as --layer",
+	}, cli.StringSliceFlag{
+		Name:  "platform",
+		Usage: "For which platform to operate, * matches any OS, architecture or variant (i.e. linux/*); by default all platforms are selected",
+	}, cli.StringFlag{
+		Name:  "platform-default-os",
+		Usage: "The OS used to complete platforms that only name an architecture (i.e. amd64)",
+		Value: "linux",
+	}, cli.BoolFlag{
+		Name:  "ignore-missing-layers",
+		Usage: "Only warn about layer numbers given with --layer or --exclude-layer that match no layer of the image instead of failing",
+	},
+}
+
+// ImageCryptFlags are cli flags common to encrypting and decrypting an image
+var ImageCryptFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "strict-annotations",
+		Usage: "Fail on encrypted layers carrying annotations other than the ones written by the layer encryption",
+	}, cli.BoolFlag{
+		Name:  "strip-unknown",
+		Usage: "In strict annotations mode remove unknown annotations instead of failing",
+	}, cli.StringFlag{
+		Name:  "dump-config",
+		Usage: "Write a redacted view of the assembled crypto config to the given file",
+	}, cli.IntFlag{
+		Name:  "concurrency",
+		Usage: "The number of platforms of a multi-platform image to process in parallel",
+		Value: 1,
+	}, cli.IntFlag{
+		Name:  "content-concurrency",
+		Usage: "The number of content store readers and, separately, writers open at a time, to protect the daemon; 0 does not limit them",
+	}, cli.BoolFlag{
+		Name:  "summary",
+		Usage: "Print a summary of the processed layers at the end of the run",
+	}, cli.StringFlag{
+		Name:  "report-file",
+		Usage: "Write a JSON report of the images, layers, recipients and keys of the operation to the file",
+	}, cli.BoolFlag{
+		Name:  "no-lease",
+		Usage: "Do not create a lease; written content is not protected from garbage collection",
+	}, cli.StringFlag{
+		Name:  "layer-filter-expr",
+		Usage: "Only operate on the selected layers matching the expression (i.e. 'size > 100MB and mediaType contains gzip'); see the README for the grammar",
+	}, cli.StringFlag{
+		Name:  "pin-digest",
+		Usage: "Fail unless the image resolves to the manifest with this digest (i.e. sha256:...)",
+	}, cli.StringSliceFlag{
+		Name:  "redact-labels",
+		Usage: "Label key not to copy to the new image; a key ending with * removes all labels with the prefix",
+	}, cli.BoolTFlag{
+		Name:  "sbom-passthrough",
+		Usage: "Pass the attestation manifests (SBOMs, provenance) of an index through untouched; with --sbom-passthrough=false their layers are selected as well",
+	}, cli.BoolTFlag{
+		Name:  "preserve-history",
+		Usage: "Keep the history of the image config; with --preserve-history=false the history entries are removed from the configs of the new image",
+	}, cli.BoolFlag{
+		Name:  "require-all-platforms",
+		Usage: "Fail if the index references platform manifests missing from the content store instead of skipping these platforms",
+	},
+}
+
 // ImageDecryptionFlags are cli flags needed when decrypting an image
 var ImageDecryptionFlags = []cli.Flag{
 	cli.StringFlag{
 		Name:  "gpg-homedir",
 		Usage: "The GPG homedir to use; by default gpg uses ~/.gnupg",
+	}, cli.BoolFlag{
+		Name:  "homedir-create",
+		Usage: "Create a temporary GPG homedir, import the GPG keyrings given with --key into it and remove it at exit",
 	}, cli.StringFlag{
 		Name:  "gpg-version",
 		Usage: "The GPG version (\"v1\" or \"v2\"), default will make an educated guess",
+	}, cli.StringFlag{
+		Name:  "gpg-binary",
+		Usage: "The path of the GPG binary to invoke instead of the gpg or gpg2 found in PATH",
 	}, cli.StringSliceFlag{
 		Name:  "key",
-		Usage: "A secret key's filename and an optional password separated by colon; this option may be provided multiple times",
+		Usage: "A secret key's filename, k8s:// or vault://<path>#<field> source and an optional password separated by colon; this option may be provided multiple times. A key of a GPG secret keyring is given its own password with <keyring>:<key id or fingerprint>=<password>",
+	}, cli.StringFlag{
+		Name:  "key-order",
+		Usage: "The order the keys given with --key are tried in: as-given, or local-first to try keys from files before keys from remote sources such as k8s://",
+		Value: "as-given",
 	}, cli.StringSliceFlag{
 		Name:  "dec-recipient",
 		Usage: "Recipient of the image; used only for PKCS7 and must be an x509 certificate",
+	}, cli.BoolFlag{
+		Name:  "allow-empty-glob",
+		Usage: "Do not fail if the file name glob of a jwe or pkcs7 recipient (i.e. jwe:/keys/*.pem) matches no files",
+	}, cli.StringFlag{
+		Name:  "cert-dir",
+		Usage: "The directory searched for pkcs7:subject:<cn> certificates",
+		Value: defaultCertDir,
+	}, cli.StringFlag{
+		Name:  "kubeconfig",
+		Usage: "The kubeconfig used to read keys given as k8s://<namespace>/<secret>/<key>; by default the in-cluster config is used",
+	}, cli.StringFlag{
+		Name:  "vault-addr",
+		Usage: "The address of the HashiCorp Vault server keys and recipients given as vault://<path>#<field> are read from; defaults to VAULT_ADDR",
+	}, cli.StringFlag{
+		Name:  "vault-token",
+		Usage: "The token used to read vault:// keys and recipients; defaults to VAULT_TOKEN, which keeps the token out of the process list",
 	},
 }
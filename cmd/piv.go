@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/pem"
+	"strings"
+
+	"github.com/go-piv/piv-go/piv"
+	"github.com/pkg/errors"
+)
+
+// pivScheme prefixes recipients whose certificate is read from a PIV token
+const pivScheme = "piv"
+
+// pivSlots maps the slot names accepted in piv:[<card>/]<slot> recipients to the slots
+var pivSlots = map[string]piv.Slot{
+	"9a": piv.SlotAuthentication,
+	"9c": piv.SlotSignature,
+	"9d": piv.SlotKeyManagement,
+	"9e": piv.SlotCardAuthentication,
+}
+
+// readPIVCertificate reads the PEM encoded certificate stored in a slot of a PIV
+// token given as [<card>/]<slot>; without a card name the only token present is used
+func readPIVCertificate(value string) ([]byte, error) {
+	var card, slotName string
+	if idx := strings.LastIndex(value, "/"); idx >= 0 {
+		card, slotName = value[:idx], value[idx+1:]
+	} else {
+		slotName = value
+	}
+	slot, ok := pivSlots[strings.ToLower(slotName)]
+	if !ok {
+		return nil, errors.Errorf("unknown PIV slot %s", slotName)
+	}
+
+	cards, err := piv.Cards()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list PIV tokens")
+	}
+	var matches []string
+	for _, c := range cards {
+		if card == "" || strings.Contains(strings.ToLower(c), strings.ToLower(card)) {
+			matches = append(matches, c)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, errors.Errorf("no PIV token %s found", card)
+	case 1:
+	default:
+		return nil, errors.Errorf("%d PIV tokens found; please name the token as piv:<card>/<slot>", len(matches))
+	}
+
+	yk, err := piv.Open(matches[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open PIV token %s", matches[0])
+	}
+	defer yk.Close()
+
+	cert, err := yk.Certificate(slot)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read the certificate of slot %s of PIV token %s", slotName, matches[0])
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), nil
+}
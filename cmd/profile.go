@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// configFile holds named profiles, each setting command flags to values; a value is
+// a string, boolean or number, or a list of these for flags that may be given multiple
+// times:
+//
+//	{"profiles": {"team-a": {"key": ["/keys/team-a.pem"], "concurrency": 4, "fail-fast": false}}}
+type configFile struct {
+	Profiles map[string]map[string]json.RawMessage `json:"profiles"`
+}
+
+// defaultConfigPath returns the config file used when --config is not given
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "cryptd", "config.json")
+}
+
+// applyProfile sets the flags of the command from the profile selected with --profile.
+// Flags given on the command line take precedence; values of flags that may be given
+// multiple times are added to those of the command line. Settings for flags the command
+// does not have are ignored so that a profile can serve several commands.
+func applyProfile(context *cli.Context) error {
+	name := context.GlobalString("profile")
+	if name == "" {
+		return nil
+	}
+	path := context.GlobalString("config")
+	if path == "" {
+		path = defaultConfigPath()
+	}
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "could not read config file %s", path)
+	}
+	var config configFile
+	if err := json.Unmarshal(p, &config); err != nil {
+		return errors.Wrapf(err, "could not parse config file %s", path)
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return errors.Errorf("unknown profile %s in config file %s", name, path)
+	}
+
+	flags := make(map[string]cli.Flag)
+	for _, f := range context.Command.Flags {
+		for _, n := range strings.Split(f.GetName(), ",") {
+			flags[strings.TrimSpace(n)] = f
+		}
+	}
+	for flagName, raw := range profile {
+		f, ok := flags[flagName]
+		if !ok {
+			continue
+		}
+		values, err := profileValues(raw)
+		if err != nil {
+			return errors.Errorf("profile %s: value of %s must be a string, boolean, number or a list of these", name, flagName)
+		}
+		switch f.(type) {
+		case cli.StringSliceFlag, cli.IntSliceFlag:
+		default:
+			if context.IsSet(flagName) {
+				continue
+			}
+			if len(values) != 1 {
+				return errors.Errorf("profile %s: %s takes a single value", name, flagName)
+			}
+		}
+		for _, v := range values {
+			if err := context.Set(flagName, v); err != nil {
+				return errors.Wrapf(err, "profile %s: could not set %s", name, flagName)
+			}
+		}
+	}
+	return nil
+}
+
+// profileValues returns the flag values of a profile setting; booleans and numbers are
+// formatted as given on the command line, i.e. "fail-fast": false as false
+func profileValues(raw json.RawMessage) ([]string, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		switch item := item.(type) {
+		case string:
+			values = append(values, item)
+		case bool:
+			values = append(values, strconv.FormatBool(item))
+		case json.Number:
+			values = append(values, item.String())
+		default:
+			return nil, errors.Errorf("unsupported value %v", item)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestProfileValues(t *testing.T) {
+	for _, tc := range []struct {
+		raw      string
+		expected []string
+		err      bool
+	}{
+		{raw: `"/keys/a.pem"`, expected: []string{"/keys/a.pem"}},
+		{raw: `["/keys/a.pem", "/keys/b.pem"]`, expected: []string{"/keys/a.pem", "/keys/b.pem"}},
+		{raw: `false`, expected: []string{"false"}},
+		{raw: `true`, expected: []string{"true"}},
+		{raw: `4`, expected: []string{"4"}},
+		{raw: `10000000000`, expected: []string{"10000000000"}},
+		{raw: `[0, -1]`, expected: []string{"0", "-1"}},
+		{raw: `[]`, expected: []string{}},
+		{raw: `null`, err: true},
+		{raw: `{"a": "b"}`, err: true},
+		{raw: `[["a"]]`, err: true},
+	} {
+		t.Run(tc.raw, func(t *testing.T) {
+			values, err := profileValues(json.RawMessage(tc.raw))
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, tc.expected) {
+				t.Fatalf("got %v, expected %v", values, tc.expected)
+			}
+		})
+	}
+}
+
+// profileContext returns the context of the command, parsed from args, below a global
+// context selecting the profile of the config file
+func profileContext(t *testing.T, command cli.Command, config, profile string, args ...string) *cli.Context {
+	t.Helper()
+
+	globalSet := flag.NewFlagSet("cryptd", flag.ContinueOnError)
+	globalSet.String("config", config, "")
+	globalSet.String("profile", profile, "")
+	parent := cli.NewContext(cli.NewApp(), globalSet, nil)
+
+	set := flag.NewFlagSet(command.Name, flag.ContinueOnError)
+	for _, f := range command.Flags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	context := cli.NewContext(parent.App, set, parent)
+	context.Command = command
+	return context
+}
+
+func TestApplyProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(config, []byte(`{"profiles": {
+		"team-a": {"key": ["/keys/a.pem"], "concurrency": 4, "fail-fast": false, "not-a-flag": "x"},
+		"invalid": {"concurrency": [1, 2]}
+	}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	context := profileContext(t, reencryptAllCommand, config, "team-a", "--key", "/keys/cli.pem", "--concurrency", "2")
+	if err := applyProfile(context); err != nil {
+		t.Fatal(err)
+	}
+	if keys := context.StringSlice("key"); !reflect.DeepEqual(keys, []string{"/keys/cli.pem", "/keys/a.pem"}) {
+		t.Errorf("got keys %v, expected those of the command line and the profile", keys)
+	}
+	if n := context.Int("concurrency"); n != 2 {
+		t.Errorf("got concurrency %d, expected the one of the command line", n)
+	}
+	if context.BoolT("fail-fast") {
+		t.Error("fail-fast was not disabled by the profile")
+	}
+
+	for _, profile := range []string{"invalid", "unknown"} {
+		if err := applyProfile(profileContext(t, reencryptAllCommand, config, profile)); err == nil {
+			t.Errorf("expected profile %s to be rejected", profile)
+		}
+	}
+	if err := applyProfile(profileContext(t, reencryptAllCommand, filepath.Join(dir, "missing.json"), "team-a")); err == nil {
+		t.Error("expected a missing config file to be rejected")
+	}
+}
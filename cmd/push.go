@@ -0,0 +1,42 @@
+package main
+
+import (
+	gocontext "context"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// pushImage pushes the image to ref, retrying failed pushes up to --push-retries times;
+// blobs that were pushed completely before are not uploaded again on a retry
+func pushImage(ctx gocontext.Context, context *cli.Context, client *containerd.Client, ref string, image containerd.Image) error {
+	resolver, err := commands.GetResolver(ctx, context)
+	if err != nil {
+		return err
+	}
+
+	var (
+		retries = context.Int("push-retries")
+		backoff = time.Second
+	)
+	for attempt := 0; ; attempt++ {
+		err := client.Push(ctx, ref, image.Target(), containerd.WithResolver(resolver))
+		if err == nil {
+			return nil
+		}
+		if attempt >= retries || ctx.Err() != nil {
+			return errors.Wrapf(err, "could not push %s", ref)
+		}
+		logrus.WithError(err).Warnf("push of %s failed, retrying in %s", ref, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
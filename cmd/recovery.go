@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/pkg/encryption"
+	"github.com/crosbymichael/cryptd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// recoveryBundle holds the layer keys of the encrypted layers of an image wrapped for
+// a recovery recipient only, kept apart from the image for emergency decryption
+type recoveryBundle struct {
+	Image     string `json:"image"`
+	Target    string `json:"target"`
+	Recipient string `json:"recipient"`
+	// Layers are the descriptors of the encrypted layers with the encryption
+	// annotations of the recovery recipient in place of the ones of the image
+	Layers []ocispec.Descriptor `json:"layers"`
+}
+
+var recoveryBundleCommand = cli.Command{
+	Name:      "recovery-bundle",
+	Usage:     "Write the layer keys of an encrypted image wrapped for a recovery recipient to a file",
+	ArgsUsage: "<ref>",
+	Description: `The layer keys of the selected encrypted layers are unwrapped with the
+keys given with --key and wrapped again for the recovery recipient only. The
+image is not changed. A layer can later be decrypted with the private key of
+the recovery recipient by passing the bundle to 'extract-layer'.`,
+	Flags: append(append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "recovery-recipient",
+			Usage: "The recipient to wrap the layer keys for, in the form specified for encrypt (i.e. jwe:/path/to/recovery.pub)",
+		},
+		cli.StringFlag{
+			Name:  "out",
+			Usage: "The file to write the bundle to",
+		},
+		cli.StringFlag{
+			Name:  "keyserver",
+			Usage: "The HKP keyserver to fetch a pgp:keyserver:<keyid> recipient from",
+			Value: defaultKeyserver,
+		},
+	}, ImageLayerFlags...), ImageDecryptionFlags...),
+	Action: func(context *cli.Context) error {
+		local := context.Args().First()
+		if local == "" {
+			return errors.New("please provide the name of an image")
+		}
+		recipient := context.String("recovery-recipient")
+		if recipient == "" {
+			return errors.New("please provide the recovery recipient")
+		}
+		out := context.String("out")
+		if out == "" {
+			return errors.New("please provide the file to write the bundle to")
+		}
+		cleanup, err := createGPGHomedir(context)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		ctx := appContext()
+		ctdClient, err := newContainerdClient(ctx, context)
+		if err != nil {
+			return err
+		}
+		local, err = resolveImageName(ctx, ctdClient, local)
+		if err != nil {
+			return err
+		}
+		image, err := ctdClient.GetImage(ctx, local)
+		if err != nil {
+			return err
+		}
+		if err := checkLayerRange(ctx, context, image); err != nil {
+			return err
+		}
+
+		_, descs, err := getImageLayerInfos(ctdClient, ctx, local, commands.IntToInt32Array(context.IntSlice("layer")), commands.IntToInt32Array(context.IntSlice("exclude-layer")), context.StringSlice("platform"), context.String("platform-default-os"))
+		if err != nil {
+			return err
+		}
+		descs = encryptedDescriptors(descs)
+		if len(descs) == 0 {
+			return errors.Errorf("image %s has no encrypted layers", local)
+		}
+
+		cc, err := createEncryptCryptoConfig(context, []string{recipient})
+		if err != nil {
+			return err
+		}
+		decryptCc, err := CreateDecryptCryptoConfig(context, descs)
+		if err != nil {
+			return err
+		}
+		if !hasDecryptionKeys(decryptCc.DecryptConfig) {
+			return errors.New("a recovery bundle requires a private key (--key) of one of the recipients of the image")
+		}
+		cc.EncryptConfig.AttachDecryptConfig(decryptCc.DecryptConfig)
+
+		bundle := recoveryBundle{
+			Image:     image.Name(),
+			Target:    image.Target().Digest.String(),
+			Recipient: recipient,
+		}
+		seen := make(map[digest.Digest]bool)
+		for _, desc := range descs {
+			if seen[desc.Digest] {
+				continue
+			}
+			seen[desc.Digest] = true
+			// the layer is already encrypted, only its layer key is wrapped again
+			_, _, finalizer, err := encryption.EncryptLayer(cc.EncryptConfig, nil, desc)
+			if err != nil {
+				return errors.Wrapf(err, "could not unwrap the key of layer %s", desc.Digest)
+			}
+			annotations, err := finalizer()
+			if err != nil {
+				return errors.Wrapf(err, "could not wrap the key of layer %s", desc.Digest)
+			}
+			bundle.Layers = append(bundle.Layers, ocispec.Descriptor{
+				MediaType:   desc.MediaType,
+				Digest:      desc.Digest,
+				Size:        desc.Size,
+				Annotations: recoveryAnnotations(desc.Annotations, annotations),
+			})
+		}
+
+		p, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(out, p, 0600); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote the keys of %d layers of %s for %s to %s\n", len(bundle.Layers), local, recipient, out)
+		return nil
+	},
+}
+
+// recoveryAnnotations returns the encryption annotations holding only the keys wrapped
+// for the recovery recipient; these are the wrapped keys of updated missing in orig
+func recoveryAnnotations(orig, updated map[string]string) map[string]string {
+	annotations := make(map[string]string)
+	for key := range keyAnnotations {
+		old := make(map[string]bool)
+		for _, v := range strings.Split(orig[key], ",") {
+			old[v] = true
+		}
+		var added []string
+		for _, v := range strings.Split(updated[key], ",") {
+			if v != "" && !old[v] {
+				added = append(added, v)
+			}
+		}
+		if len(added) > 0 {
+			annotations[key] = strings.Join(added, ",")
+		}
+	}
+	for key, v := range updated {
+		if _, ok := keyAnnotations[key]; !ok && strings.HasPrefix(key, encAnnotationPrefix) {
+			annotations[key] = v
+		}
+	}
+	return annotations
+}
+
+// readRecoveryBundle reads the descriptor of the layer from the recovery bundle
+func readRecoveryBundle(path string, dgst digest.Digest) (ocispec.Descriptor, error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var bundle recoveryBundle
+	if err := json.Unmarshal(p, &bundle); err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "could not parse recovery bundle %s", path)
+	}
+	for _, desc := range bundle.Layers {
+		if desc.Digest == dgst {
+			if !cryptd.IsEncryptedMediaType(desc.MediaType) {
+				return ocispec.Descriptor{}, errors.Errorf("layer %s of recovery bundle %s is not encrypted", dgst, path)
+			}
+			return desc, nil
+		}
+	}
+	return ocispec.Descriptor{}, errors.Errorf("layer %s not found in recovery bundle %s", dgst, path)
+}
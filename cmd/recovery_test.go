@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecoveryAnnotations(t *testing.T) {
+	const (
+		jwe   = "org.opencontainers.image.enc.keys.jwe"
+		pkcs7 = "org.opencontainers.image.enc.keys.pkcs7"
+		pgp   = "org.opencontainers.image.enc.keys.pgp"
+		opts  = "org.opencontainers.image.enc.pubopts"
+	)
+	for _, tc := range []struct {
+		name     string
+		orig     map[string]string
+		updated  map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "recovery key of the same scheme",
+			orig:     map[string]string{jwe: "a,b", opts: "opts"},
+			updated:  map[string]string{jwe: "a,b,r", opts: "opts"},
+			expected: map[string]string{jwe: "r", opts: "opts"},
+		},
+		{
+			name:     "recovery key of another scheme",
+			orig:     map[string]string{pgp: "a", opts: "opts"},
+			updated:  map[string]string{pgp: "a", pkcs7: "r", opts: "opts"},
+			expected: map[string]string{pkcs7: "r", opts: "opts"},
+		},
+		{
+			name:     "recovery key in the middle",
+			orig:     map[string]string{jwe: "a,b"},
+			updated:  map[string]string{jwe: "a,r,b"},
+			expected: map[string]string{jwe: "r"},
+		},
+		{
+			name:     "no recovery key",
+			orig:     map[string]string{jwe: "a"},
+			updated:  map[string]string{jwe: "a"},
+			expected: map[string]string{},
+		},
+		{
+			name:     "other annotations",
+			orig:     map[string]string{jwe: "a"},
+			updated:  map[string]string{jwe: "a,r", "org.opencontainers.image.title": "layer"},
+			expected: map[string]string{jwe: "r"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			annotations := recoveryAnnotations(tc.orig, tc.updated)
+			if !reflect.DeepEqual(annotations, tc.expected) {
+				t.Fatalf("got %v, expected %v", annotations, tc.expected)
+			}
+		})
+	}
+}
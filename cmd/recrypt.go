@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	gocontext "context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/crosbymichael/cryptd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/openpgp"
+)
+
+var recryptCommand = cli.Command{
+	Name:      "recrypt",
+	Usage:     "Add recipients to the encrypted layers of an image, or encrypt the layers again to remove recipients or rotate layer keys",
+	ArgsUsage: "<ref> <new-ref>",
+	Description: `By default the layer keys of the selected encrypted layers are unwrapped with
+the keys given with --key and wrapped for the recipients given with --recipient
+in addition; only the layer annotations change, the layer blobs are kept byte
+for byte.
+
+With --remove-recipient or --dek-rotate the layers are decrypted and encrypted
+again with new layer keys for exactly the recipients given with --recipient.
+This rewrites the layer blobs and changes their digests.`,
+	Flags: append(append([]cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "recipient",
+			Usage: "Recipient to add to the image in the form specified for encrypt (i.e. jwe:/path/to/key)",
+		},
+		cli.StringSliceFlag{
+			Name:  "remove-recipient",
+			Usage: "Recipient to remove from the image; the layers are encrypted again for the recipients given with --recipient, which must list all that keep access",
+		},
+		cli.BoolFlag{
+			Name:  "dek-rotate",
+			Usage: "Decrypt the layers and encrypt them again with new layer keys (DEKs) for the recipients given with --recipient; the layer blobs and their digests change",
+		},
+		cli.BoolFlag{
+			Name:  "best-effort",
+			Usage: "Skip the selected encrypted layers none of the keys given with --key can decrypt instead of failing; the skipped layers are reported and kept as they are",
+		},
+		cli.StringFlag{
+			Name:  "recipient-aliases",
+			Usage: "JSON file mapping alias names to recipients; aliases are given as @<name> recipients",
+		},
+		cli.StringFlag{
+			Name:  "keyserver",
+			Usage: "The HKP keyserver to fetch pgp:keyserver:<keyid> recipients from",
+			Value: defaultKeyserver,
+		},
+	}, append(ImageLayerFlags, ImageCryptFlags...)...),
+		ImageDecryptionFlags...),
+	Action: func(context *cli.Context) error {
+		local := context.Args().First()
+		if local == "" {
+			return errors.New("please provide the name of an image to recrypt")
+		}
+
+		newName := context.Args().Get(1)
+		if err := validateNewName(newName); err != nil {
+			return err
+		}
+		fmt.Printf("Recrypting %s to %s\n", local, newName)
+		cleanup, err := createGPGHomedir(context)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		sum := newSummary()
+		ctx := appContext()
+		ctdClient, err := newContainerdClient(ctx, context)
+		if err != nil {
+			return err
+		}
+
+		local, err = resolveImageName(ctx, ctdClient, local)
+		if err != nil {
+			return err
+		}
+		image, err := ctdClient.GetImage(ctx, local)
+		if err != nil {
+			return err
+		}
+		if err := checkPinnedDigest(context, image); err != nil {
+			return err
+		}
+		if err := checkLayerRange(ctx, context, image); err != nil {
+			return err
+		}
+
+		recipients := context.StringSlice("recipient")
+		if len(recipients) == 0 {
+			return errors.New("no recipients given -- nothing to do")
+		}
+		layers32 := commands.IntToInt32Array(context.IntSlice("layer"))
+
+		cc, err := createEncryptCryptoConfig(context, recipients)
+		if err != nil {
+			return err
+		}
+
+		_, descs, err := getImageLayerInfos(ctdClient, ctx, local, layers32, commands.IntToInt32Array(context.IntSlice("exclude-layer")), context.StringSlice("platform"), context.String("platform-default-os"))
+		if err != nil {
+			return err
+		}
+
+		decryptCc, err := CreateDecryptCryptoConfig(context, descs)
+		if err != nil {
+			return err
+		}
+		if !hasDecryptionKeys(decryptCc.DecryptConfig) {
+			return errors.New("recrypting requires a private key (--key) of one of the existing recipients")
+		}
+		cc.EncryptConfig.AttachDecryptConfig(decryptCc.DecryptConfig)
+		if path := context.String("dump-config"); path != "" {
+			if err := dumpCryptoConfig(path, cc); err != nil {
+				return err
+			}
+		}
+
+		opts := cryptOpts(context, layers32)
+		removed := context.StringSlice("remove-recipient")
+		if len(removed) > 0 {
+			if err := checkRemovedRecipients(context, recipients, removed); err != nil {
+				return err
+			}
+			ids, err := removedRecipientIDs(context, removed)
+			if err != nil {
+				return err
+			}
+			// the new image is only created if the removed recipients lost access
+			opts = append(opts, cryptd.WithImageCreateOpts(verifyRecipientsRemoved(context, ctdClient.ContentStore(), layers32, ids, len(cc.EncryptConfig.Parameters["pubkeys"]))))
+		}
+		if len(removed) > 0 || context.Bool("dek-rotate") {
+			opts = append(opts, cryptd.WithReencrypt())
+		}
+		var skipped int
+		if context.Bool("best-effort") {
+			opts = append(opts, cryptd.WithBestEffort(func(ocispec.Descriptor) {
+				skipped++
+			}))
+		}
+
+		client := cryptd.New(ctdClient)
+		recImage, err := client.RecryptImage(ctx, image, newName, &cc, opts...)
+		if err != nil {
+			return err
+		}
+
+		sum.addRecipients(cc.EncryptConfig)
+		if err := finishSummary(ctx, context, sum, image, recImage); err != nil {
+			return err
+		}
+		if skipped > 0 {
+			return partialStatus("%d encrypted layers were skipped as none of the keys unwraps their layer key", skipped)
+		}
+		return unchangedStatus(image, recImage)
+	},
+}
+
+// checkRemovedRecipients ensures that none of the recipients to remove is also one of
+// the recipients of the re-encrypted image, even when named differently
+func checkRemovedRecipients(context *cli.Context, recipients, removed []string) error {
+	kept, err := recipientFingerprints(context, recipients)
+	if err != nil {
+		return err
+	}
+	gone, err := recipientFingerprints(context, removed)
+	if err != nil {
+		return err
+	}
+	for fp, recipient := range gone {
+		if r, ok := kept[fp]; ok {
+			return errors.Errorf("recipient %s to remove is the same as recipient %s to keep", recipient, r)
+		}
+	}
+	return nil
+}
+
+// removedRecipientIDs maps the recipient identifiers describeLayerEncryption lists for
+// the wrapped keys of the recipients to remove to these recipients: the key ids of PGP
+// recipients and the issuer and serial number of the certificates of PKCS7 recipients.
+// JWE key wrapping does not identify the recipient.
+func removedRecipientIDs(context *cli.Context, removed []string) (map[string]string, error) {
+	removed, err := expandRecipients(context, removed)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]string)
+	for _, recipient := range removed {
+		cc, err := encryptCryptoConfig(context, []string{recipient})
+		if err != nil {
+			return nil, err
+		}
+		params := cc.EncryptConfig.Parameters
+		for _, c := range params["x509s"] {
+			id, err := certificateRecipientID(c)
+			if err != nil {
+				return nil, errors.Wrapf(err, "recipient %s", recipient)
+			}
+			ids[id] = recipient
+		}
+		if gpgRecipients := params["gpg-recipients"]; len(gpgRecipients) > 0 {
+			var pubRing []byte
+			for _, r := range params["gpg-pubkeyringfile"] {
+				pubRing = append(pubRing, r...)
+			}
+			keyids, err := gpgRecipientKeyIds(gpgRecipients, pubRing)
+			if err != nil {
+				return nil, errors.Wrapf(err, "recipient %s", recipient)
+			}
+			for _, keyid := range keyids {
+				ids[fmt.Sprintf("pgp:%016X", keyid)] = recipient
+			}
+		}
+	}
+	return ids, nil
+}
+
+// certificateRecipientID returns the identifier pkcs7Recipients lists the recipient of
+// the certificate by
+func certificateRecipientID(cert []byte) (string, error) {
+	der := cert
+	if block, _ := pem.Decode(cert); block != nil {
+		der = block.Bytes
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", errors.Wrap(err, "could not parse certificate")
+	}
+	var issuer pkix.RDNSequence
+	if _, err := asn1.Unmarshal(c.RawIssuer, &issuer); err != nil {
+		return "", errors.Wrap(err, "could not parse certificate issuer")
+	}
+	var name pkix.Name
+	name.FillFromRDNSequence(&issuer)
+	return fmt.Sprintf("pkcs7:%s/%s", name.String(), c.SerialNumber), nil
+}
+
+// gpgRecipientKeyIds returns the ids of the primary keys and subkeys of the keys of the
+// PGP recipients, given by email address or name, in the public keyring
+func gpgRecipientKeyIds(recipients [][]byte, pubRing []byte) ([]uint64, error) {
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(pubRing))
+	if err != nil {
+		if el, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(pubRing)); err != nil {
+			return nil, errors.Wrap(err, "could not read the GPG public keyring")
+		}
+	}
+	var keyids []uint64
+	for _, recipient := range recipients {
+		r := strings.ToLower(string(recipient))
+		for _, entity := range el {
+			var match bool
+			for _, identity := range entity.Identities {
+				if strings.ToLower(identity.UserId.Email) == r || strings.ToLower(identity.UserId.Name) == r {
+					match = true
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+			keyids = append(keyids, entity.PrimaryKey.KeyId)
+			for _, subkey := range entity.Subkeys {
+				keyids = append(keyids, subkey.PublicKey.KeyId)
+			}
+		}
+	}
+	return keyids, nil
+}
+
+// verifyRecipientsRemoved returns an image create option failing if a selected layer of
+// the new image still has a layer key wrapped for one of the removed recipients, listed
+// by removedRecipientIDs, or more JWE wrapped keys than jweRecipients, the number of JWE
+// recipients to keep
+func verifyRecipientsRemoved(context *cli.Context, cs content.Store, layers []int32, ids map[string]string, jweRecipients int) cryptd.ImageCreateOpt {
+	return func(ctx gocontext.Context, image *images.Image) error {
+		pl, err := cryptd.ParsePlatformArray(context.StringSlice("platform"), context.String("platform-default-os"))
+		if err != nil {
+			return err
+		}
+		_, descs, _, err := cryptd.SelectLayerDescriptors(ctx, cs, image.Target, layers, commands.IntToInt32Array(context.IntSlice("exclude-layer")), pl, false)
+		if err != nil {
+			return err
+		}
+		for _, desc := range descs {
+			enc, err := describeLayerEncryption(desc)
+			if err != nil {
+				return errors.Wrapf(err, "layer %s", desc.Digest)
+			}
+			var jwe int
+			for _, id := range enc.Recipients {
+				if recipient, ok := ids[id]; ok {
+					return errors.Errorf("layer %s still has a layer key wrapped for removed recipient %s", desc.Digest, recipient)
+				}
+				if strings.HasPrefix(id, "jwe:") {
+					jwe++
+				}
+			}
+			if jwe > jweRecipients {
+				return errors.Errorf("layer %s has %d JWE wrapped layer keys for %d JWE recipients", desc.Digest, jwe, jweRecipients)
+			}
+		}
+		return nil
+	}
+}
+
+// recipientFingerprints maps the fingerprints of the keys of the recipients to the
+// recipient; PGP recipients are identified by their lowercased name or email address
+func recipientFingerprints(context *cli.Context, recipients []string) (map[string]string, error) {
+	recipients, err := expandRecipients(context, recipients)
+	if err != nil {
+		return nil, err
+	}
+	fps := make(map[string]string)
+	for _, recipient := range recipients {
+		gpgRecipients, _, pubKeys, x509s, err := processRecipientKeys(context, []string{recipient})
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range gpgRecipients {
+			fps["pgp:"+strings.ToLower(string(r))] = recipient
+		}
+		for _, k := range pubKeys {
+			fps[publicKeyFingerprint(k)] = recipient
+		}
+		for _, c := range x509s {
+			fps[certificateFingerprint(c)] = recipient
+		}
+	}
+	return fps, nil
+}
+
+// publicKeyFingerprint returns the digest of the DER encoding of a PEM or DER encoded
+// public key, so that both encodings of a key yield the same fingerprint
+func publicKeyFingerprint(key []byte) string {
+	der := key
+	if block, _ := pem.Decode(key); block != nil {
+		der = block.Bytes
+	}
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		if der, err = x509.MarshalPKIXPublicKey(pub); err == nil {
+			return digest.FromBytes(der).String()
+		}
+	}
+	return digest.FromBytes(key).String()
+}
+
+// certificateFingerprint returns the fingerprint of the public key of a certificate
+func certificateFingerprint(cert []byte) string {
+	der := cert
+	if block, _ := pem.Decode(cert); block != nil {
+		der = block.Bytes
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		return digest.FromBytes(cert).String()
+	}
+	return digest.FromBytes(c.RawSubjectPublicKeyInfo).String()
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/namespaces"
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	"github.com/crosbymichael/cryptd"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"golang.org/x/sync/semaphore"
+)
+
+// rotation is the outcome of recrypting one image with reencrypt-all
+type rotation struct {
+	Image  string `json:"image"`
+	Source string `json:"source"`
+	Target string `json:"target,omitempty"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+var reencryptAllCommand = cli.Command{
+	Name:      "reencrypt-all",
+	Usage:     "Recrypt all encrypted images of a namespace in place for a new set of recipients",
+	ArgsUsage: "[filter, ...]",
+	Description: `The images of the namespace matching the filters, in the syntax of
+'ctr images list', whose selected layers are encrypted are recrypted as with
+'recrypt' and keep their names. By default the first image that fails stops
+the command; with --fail-fast=false the remaining images are recrypted and
+all failures are reported at the end.`,
+	Flags: append(append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "namespace",
+			Usage: "The containerd namespace of the images",
+			Value: namespaces.Default,
+		},
+		cli.StringSliceFlag{
+			Name:  "recipient",
+			Usage: "Recipient to add to the images in the form specified for encrypt (i.e. jwe:/path/to/key)",
+		},
+		cli.StringSliceFlag{
+			Name:  "remove-recipient",
+			Usage: "Recipient to remove from the images; the layers are encrypted again for the recipients given with --recipient, which must list all that keep access",
+		},
+		cli.StringFlag{
+			Name:  "recipient-aliases",
+			Usage: "JSON file mapping alias names to recipients; aliases are given as @<name> recipients",
+		},
+		cli.StringFlag{
+			Name:  "keyserver",
+			Usage: "The HKP keyserver to fetch pgp:keyserver:<keyid> recipients from",
+			Value: defaultKeyserver,
+		},
+		cli.IntFlag{
+			Name:  "parallel-images",
+			Usage: "The number of images to recrypt in parallel; each processes --concurrency platforms at a time, --content-concurrency is shared between them",
+			Value: 1,
+		},
+		cli.IntFlag{
+			Name:  "max-workers",
+			Usage: "The most platforms processed at once by all images recrypted in parallel; --concurrency, then --parallel-images, is lowered to stay within it (default 4 per CPU)",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only list the images that would be recrypted",
+		},
+		cli.BoolTFlag{
+			Name:  "fail-fast",
+			Usage: "Stop at the first image that cannot be recrypted; with --fail-fast=false all images are attempted and the failures reported at the end",
+		},
+	}, append(ImageLayerFlags, ImageCryptFlags...)...),
+		ImageDecryptionFlags...),
+	Action: func(context *cli.Context) error {
+		recipients := context.StringSlice("recipient")
+		if len(recipients) == 0 {
+			return errors.New("no recipients given -- nothing to do")
+		}
+		cleanup, err := createGPGHomedir(context)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		ctx := namespaces.WithNamespace(appContext(), context.String("namespace"))
+		ctdClient, err := newContainerdClient(ctx, context)
+		if err != nil {
+			return err
+		}
+
+		imgs, err := encryptedImages(ctx, ctdClient, context)
+		if err != nil {
+			return err
+		}
+		if context.Bool("dry-run") {
+			for _, image := range imgs {
+				fmt.Printf("would recrypt %s\n", image.Name())
+			}
+			return nil
+		}
+		if len(imgs) == 0 {
+			fmt.Println("no encrypted images found")
+			return nil
+		}
+
+		// the keys are the same for all images, read and parse them once
+		cacheKeySources()
+		configs := newEncryptConfigCache()
+		cc, err := configs.get(context, recipients)
+		if err != nil {
+			return err
+		}
+		opts := cryptOpts(context, commands.IntToInt32Array(context.IntSlice("layer")))
+		if removed := context.StringSlice("remove-recipient"); len(removed) > 0 {
+			if err := checkRemovedRecipients(context, recipients, removed); err != nil {
+				return err
+			}
+			opts = append(opts, cryptd.WithReencrypt())
+		}
+
+		parallel, concurrency := workerBudget(context.Int("parallel-images"), context.Int("concurrency"), context.Int("max-workers"))
+		// --content-concurrency is a budget for all images together
+		if n := context.Int("content-concurrency"); n > 0 {
+			if parallel > n {
+				logrus.Warnf("recrypting %d images in parallel instead of %d to stay within --content-concurrency %d", n, parallel, n)
+				parallel = n
+			}
+			opts = append(opts, cryptd.WithContentConcurrency(n/parallel))
+		}
+		opts = append(opts, cryptd.WithConcurrency(concurrency))
+
+		var (
+			client    = cryptd.New(ctdClient)
+			rotations = make([]rotation, len(imgs))
+			failFast  = context.BoolT("fail-fast")
+		)
+		runParallel(ctx, len(imgs), parallel, func(i int) bool {
+			// images already being recrypted are completed when failing fast
+			rotations[i] = recryptInPlace(ctx, context, client, imgs[i], cc, opts)
+			return rotations[i].Error == "" || !failFast
+		})
+
+		var failures []string
+		for i, image := range imgs {
+			if rotations[i].Result == "" {
+				rotations[i] = rotation{
+					Image:  image.Name(),
+					Source: image.Target().Digest.String(),
+					Result: "skipped",
+				}
+				continue
+			}
+			if rotations[i].Error != "" {
+				failures = append(failures, fmt.Sprintf("%s: %s", image.Name(), rotations[i].Error))
+			}
+		}
+		if err := printRotations(context, rotations); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(failures) > 0 {
+			return errors.Errorf("%d of %d images could not be recrypted:\n%s", len(failures), len(imgs), strings.Join(failures, "\n"))
+		}
+		return nil
+	},
+}
+
+// encryptConfigCache holds the encrypt configs built for sets of recipients; it
+// is safe for concurrent use
+type encryptConfigCache struct {
+	mu      sync.Mutex
+	configs map[string]encconfig.CryptoConfig
+}
+
+func newEncryptConfigCache() *encryptConfigCache {
+	return &encryptConfigCache{
+		configs: make(map[string]encconfig.CryptoConfig),
+	}
+}
+
+// get returns the encrypt config of the recipients, building it on first use; the
+// order of the recipients does not matter
+func (c *encryptConfigCache) get(context *cli.Context, recipients []string) (encconfig.CryptoConfig, error) {
+	sorted := append([]string{}, recipients...)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, "\x00")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cc, ok := c.configs[key]; ok {
+		return cc, nil
+	}
+	cc, err := createEncryptCryptoConfig(context, recipients)
+	if err != nil {
+		return encconfig.CryptoConfig{}, err
+	}
+	c.configs[key] = cc
+	return cc, nil
+}
+
+// encryptedImages lists the images matching the filters of the command line whose
+// selected layers include encrypted ones
+func encryptedImages(ctx gocontext.Context, client *containerd.Client, context *cli.Context) ([]containerd.Image, error) {
+	imgs, err := client.ListImages(ctx, context.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	layers32 := commands.IntToInt32Array(context.IntSlice("layer"))
+	var encrypted []containerd.Image
+	for _, image := range imgs {
+		_, descs, err := getImageLayerInfos(client, ctx, image.Name(), layers32, commands.IntToInt32Array(context.IntSlice("exclude-layer")), context.StringSlice("platform"), context.String("platform-default-os"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get the layers of %s", image.Name())
+		}
+		if len(encryptedDescriptors(descs)) > 0 {
+			encrypted = append(encrypted, image)
+		}
+	}
+	return encrypted, nil
+}
+
+// recryptInPlace recrypts the image for the recipients of cc, replacing its target
+func recryptInPlace(ctx gocontext.Context, context *cli.Context, client *cryptd.CryptoClient, image containerd.Image, cc encconfig.CryptoConfig, opts []cryptd.CryptOpt) rotation {
+	r := rotation{
+		Image:  image.Name(),
+		Source: image.Target().Digest.String(),
+	}
+	fail := func(err error) rotation {
+		r.Result, r.Error = "failed", err.Error()
+		return r
+	}
+
+	alldescs, _, err := cryptd.LayerDescriptors(ctx, image.ContentStore(), image.Target(), false)
+	if err != nil {
+		return fail(err)
+	}
+	decryptCc, err := CreateDecryptCryptoConfig(context, encryptedDescriptors(alldescs))
+	if err != nil {
+		return fail(err)
+	}
+	if !hasDecryptionKeys(decryptCc.DecryptConfig) {
+		return fail(errors.New("recrypting requires a private key (--key) of one of the existing recipients"))
+	}
+	// every image gets its own copy, the attached decrypt config differs per image
+	ec := copyEncryptConfig(cc.EncryptConfig)
+	ec.AttachDecryptConfig(decryptCc.DecryptConfig)
+	imageCc := encconfig.CryptoConfig{EncryptConfig: ec}
+
+	recImage, err := client.RecryptImage(ctx, image, image.Name(), &imageCc, opts...)
+	if err != nil {
+		return fail(err)
+	}
+	r.Target = recImage.Target().Digest.String()
+	r.Result = "recrypted"
+	if r.Target == r.Source {
+		r.Result = "unchanged"
+	}
+	return r
+}
+
+// copyEncryptConfig returns a copy of ec that shares none of its parameters, so that
+// attaching a decrypt config to the copy, which appends to the parameter slices, does
+// not change ec or the copies made for other images
+func copyEncryptConfig(ec *encconfig.EncryptConfig) *encconfig.EncryptConfig {
+	return &encconfig.EncryptConfig{
+		Parameters: copyParameters(ec.Parameters),
+		DecryptConfig: encconfig.DecryptConfig{
+			Parameters: copyParameters(ec.DecryptConfig.Parameters),
+		},
+	}
+}
+
+func copyParameters(params map[string][][]byte) map[string][][]byte {
+	c := make(map[string][][]byte, len(params))
+	for k, v := range params {
+		c[k] = append([][]byte(nil), v...)
+	}
+	return c
+}
+
+// printRotations prints the outcome per image and writes it to --report-file
+func printRotations(context *cli.Context, rotations []rotation) error {
+	if path := context.String("report-file"); path != "" {
+		p, err := json.MarshalIndent(rotations, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, p, 0644); err != nil {
+			return err
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 4, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "IMAGE\t%s\tTARGET\tERROR\n", colorize(colorDefault, "RESULT"))
+	for _, r := range rotations {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Image, colorize(resultColor(r.Result), r.Result), r.Target, colorize(colorRed, r.Error))
+	}
+	return w.Flush()
+}
+
+// defaultWorkersPerCPU is the number of platforms processed at once per CPU by all
+// images of reencrypt-all together when --max-workers is not given
+const defaultWorkersPerCPU = 4
+
+// workerBudget returns the number of images to process in parallel and the number of
+// platforms each image processes at a time such that together they process at most
+// max platforms at once. The concurrency of the images is lowered first, down to one
+// platform each, and then the number of images; a max of 0 allows defaultWorkersPerCPU
+// platforms per CPU.
+func workerBudget(parallel, concurrency, max int) (int, int) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if max < 1 {
+		max = defaultWorkersPerCPU * runtime.NumCPU()
+	}
+	if parallel*concurrency <= max {
+		return parallel, concurrency
+	}
+	n := max / parallel
+	if n < 1 {
+		logrus.Warnf("recrypting %d images in parallel instead of %d, one platform at a time, to stay within %d workers", max, parallel, max)
+		return max, 1
+	}
+	logrus.Warnf("processing %d platforms of each image at a time instead of %d to stay within %d workers", n, concurrency, max)
+	return parallel, n
+}
+
+// runParallel calls fn for the indexes 0 to n-1, for at most parallel of them at a
+// time. Once fn returns false no further indexes are started, while the calls already
+// running are completed; runParallel returns when all calls that were started have
+// returned. The calls stop being started when ctx is done.
+func runParallel(ctx gocontext.Context, n, parallel int, fn func(i int) bool) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	var (
+		sem            = semaphore.NewWeighted(int64(parallel))
+		wg             sync.WaitGroup
+		runCtx, cancel = gocontext.WithCancel(ctx)
+	)
+	defer cancel()
+	for i := 0; i < n; i++ {
+		if err := sem.Acquire(runCtx, 1); err != nil {
+			break
+		}
+		if runCtx.Err() != nil {
+			sem.Release(1)
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer sem.Release(1)
+			if !fn(i) {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+}
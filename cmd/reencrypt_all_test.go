@@ -0,0 +1,183 @@
+package main
+
+import (
+	gocontext "context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+)
+
+func TestCopyEncryptConfig(t *testing.T) {
+	ec := &encconfig.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"pubkeys": make([][]byte, 1, 4),
+		},
+		DecryptConfig: encconfig.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"privkeys": make([][]byte, 1, 4),
+			},
+		},
+	}
+	ec.Parameters["pubkeys"][0] = []byte("pub")
+	ec.DecryptConfig.Parameters["privkeys"][0] = []byte("shared")
+
+	for _, key := range []string{"first", "second"} {
+		c := copyEncryptConfig(ec)
+		c.AttachDecryptConfig(&encconfig.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"privkeys": {[]byte(key)},
+			},
+		})
+		c.Parameters["pubkeys"] = append(c.Parameters["pubkeys"], []byte(key))
+
+		privKeys := c.DecryptConfig.Parameters["privkeys"]
+		if len(privKeys) != 2 || string(privKeys[0]) != "shared" || string(privKeys[1]) != key {
+			t.Errorf("copy for %s has private keys %q", key, privKeys)
+		}
+	}
+
+	if n := len(ec.DecryptConfig.Parameters["privkeys"]); n != 1 {
+		t.Errorf("the original has %d private keys, expected 1", n)
+	}
+	if n := len(ec.Parameters["pubkeys"]); n != 1 {
+		t.Errorf("the original has %d public keys, expected 1", n)
+	}
+	// the copies must not have written into the spare capacity of the original slices
+	if spare := ec.DecryptConfig.Parameters["privkeys"][:2][1]; spare != nil {
+		t.Errorf("a copy wrote %q into the private keys of the original", spare)
+	}
+	if spare := ec.Parameters["pubkeys"][:2][1]; spare != nil {
+		t.Errorf("a copy wrote %q into the public keys of the original", spare)
+	}
+}
+
+func TestWorkerBudget(t *testing.T) {
+	for _, tc := range []struct {
+		parallel, concurrency, max int
+		expectedParallel           int
+		expectedConcurrency        int
+	}{
+		{parallel: 2, concurrency: 3, max: 8, expectedParallel: 2, expectedConcurrency: 3},
+		{parallel: 2, concurrency: 3, max: 6, expectedParallel: 2, expectedConcurrency: 3},
+		{parallel: 2, concurrency: 8, max: 6, expectedParallel: 2, expectedConcurrency: 3},
+		{parallel: 4, concurrency: 4, max: 6, expectedParallel: 4, expectedConcurrency: 1},
+		{parallel: 8, concurrency: 2, max: 6, expectedParallel: 6, expectedConcurrency: 1},
+		{parallel: 0, concurrency: 0, max: 6, expectedParallel: 1, expectedConcurrency: 1},
+	} {
+		parallel, concurrency := workerBudget(tc.parallel, tc.concurrency, tc.max)
+		if parallel != tc.expectedParallel || concurrency != tc.expectedConcurrency {
+			t.Errorf("%d images of %d platforms within %d: got %d of %d, expected %d of %d", tc.parallel, tc.concurrency, tc.max, parallel, concurrency, tc.expectedParallel, tc.expectedConcurrency)
+		}
+		if parallel*concurrency > tc.max {
+			t.Errorf("%d images of %d platforms exceed %d workers", parallel, concurrency, tc.max)
+		}
+	}
+
+	parallel, concurrency := workerBudget(1000, 1000, 0)
+	if max := defaultWorkersPerCPU * runtime.NumCPU(); parallel*concurrency > max {
+		t.Errorf("%d images of %d platforms exceed the default of %d workers", parallel, concurrency, max)
+	}
+}
+
+// maxCounter records the most concurrent holders
+type maxCounter struct {
+	mu       sync.Mutex
+	cur, max int
+}
+
+func (c *maxCounter) enter() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cur++
+	if c.cur > c.max {
+		c.max = c.cur
+	}
+}
+
+func (c *maxCounter) leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cur--
+}
+
+func TestRunParallelLimits(t *testing.T) {
+	const (
+		images    = 20
+		platforms = 5
+	)
+	parallel, concurrency := workerBudget(4, 3, 8)
+
+	var (
+		imageCounter, workerCounter maxCounter
+		ran                         int32
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runParallel(gocontext.Background(), images, parallel, func(i int) bool {
+			imageCounter.enter()
+			defer imageCounter.leave()
+			atomic.AddInt32(&ran, 1)
+
+			// the platforms of an image, processed concurrency at a time
+			var (
+				sem = make(chan struct{}, concurrency)
+				wg  sync.WaitGroup
+			)
+			for p := 0; p < platforms; p++ {
+				sem <- struct{}{}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() { <-sem }()
+					workerCounter.enter()
+					defer workerCounter.leave()
+					time.Sleep(time.Millisecond)
+				}()
+			}
+			wg.Wait()
+			return true
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the images were not all processed; the scheduler deadlocked")
+	}
+
+	if ran != images {
+		t.Fatalf("ran %d images, expected %d", ran, images)
+	}
+	if imageCounter.max > parallel {
+		t.Errorf("%d images ran at once, expected at most %d", imageCounter.max, parallel)
+	}
+	if workerCounter.max > 8 {
+		t.Errorf("%d platforms were processed at once, expected at most 8", workerCounter.max)
+	}
+}
+
+func TestRunParallelStops(t *testing.T) {
+	var ran int32
+	runParallel(gocontext.Background(), 10, 1, func(i int) bool {
+		atomic.AddInt32(&ran, 1)
+		return i != 2
+	})
+	if ran != 3 {
+		t.Fatalf("ran %d calls, expected the ones up to the failing one", ran)
+	}
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+	ran = 0
+	runParallel(ctx, 10, 2, func(int) bool {
+		atomic.AddInt32(&ran, 1)
+		return true
+	})
+	if ran != 0 {
+		t.Fatalf("ran %d calls with a done context", ran)
+	}
+}
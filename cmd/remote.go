@@ -0,0 +1,96 @@
+package main
+
+import (
+	gocontext "context"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/crosbymichael/cryptd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// fetchSelectedLayers fetches the image ref from its registry into the image store,
+// downloading only the layers selected with --layer and --exclude-layer of the
+// platforms given with --platform; the other layers are left missing in the store
+func fetchSelectedLayers(ctx gocontext.Context, client *containerd.Client, ref string, layers, excludeLayers []int32, platformList []string, defaultOS string) error {
+	pl, err := cryptd.ParsePlatformArray(platformList, defaultOS)
+	if err != nil {
+		return err
+	}
+	opts := []containerd.RemoteOpt{
+		containerd.WithImageHandlerWrapper(selectLayers(client.ContentStore(), layers, excludeLayers)),
+	}
+	var platformOpts []containerd.RemoteOpt
+	for _, p := range pl {
+		if cryptd.IsWildcardPlatform(p) {
+			// the fetcher cannot match wildcards; all platforms are fetched instead
+			platformOpts = nil
+			break
+		}
+		platformOpts = append(platformOpts, containerd.WithPlatform(platforms.Format(p)))
+	}
+	opts = append(opts, platformOpts...)
+
+	img, err := client.Fetch(ctx, ref, opts...)
+	if err != nil {
+		return errors.Wrapf(err, "could not fetch %s", ref)
+	}
+	is := client.ImageService()
+	if _, err := is.Create(ctx, img); err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return err
+		}
+		if _, err := is.Update(ctx, img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectLayers wraps the fetch handler so that only the selected layers of a manifest
+// are fetched; the children of a manifest are its config followed by its layers. When
+// layers are selected the config is fetched first to number the layers by
+// cryptd.ManifestLayerOrder, as for the selection of the layers to decrypt.
+func selectLayers(cs content.Store, layers, excludeLayers []int32) func(images.Handler) images.Handler {
+	return func(h images.Handler) images.Handler {
+		return images.HandlerFunc(func(ctx gocontext.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			children, err := h.Handle(ctx, desc)
+			if err != nil {
+				return nil, err
+			}
+			switch desc.MediaType {
+			case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+			default:
+				return children, nil
+			}
+			if len(children) == 0 || (len(layers) == 0 && len(excludeLayers) == 0) {
+				return children, nil
+			}
+			if _, err := h.Handle(ctx, children[0]); err != nil {
+				return nil, err
+			}
+			order, err := cryptd.ManifestLayerOrder(ctx, cs, ocispec.Manifest{Config: children[0], Layers: children[1:]})
+			if err != nil {
+				return nil, errors.Wrapf(err, "manifest %s", desc.Digest)
+			}
+			if len(order) != len(children)-1 {
+				return nil, errors.Errorf("manifest %s has %d layers but %d layer numbers", desc.Digest, len(children)-1, len(order))
+			}
+
+			var (
+				selected = children[:1]
+				total    = int32(len(children) - 1)
+			)
+			for i, child := range children[1:] {
+				if cryptd.IsUserSelectedLayer(int32(order[i]), total, layers) && !cryptd.IsUserExcludedLayer(int32(order[i]), total, excludeLayers) {
+					selected = append(selected, child)
+				}
+			}
+			return selected, nil
+		})
+	}
+}
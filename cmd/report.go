@@ -0,0 +1,76 @@
+package main
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/urfave/cli"
+)
+
+// report documents an operation for --report-file; it extends the summary with
+// the images operated on and the tool that did so
+type report struct {
+	Command  string      `json:"command"`
+	Version  string      `json:"version"`
+	Source   reportImage `json:"source"`
+	Target   reportImage `json:"target"`
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+	*summary
+}
+
+type reportImage struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+}
+
+// writeReport writes the report of the command that turned source into target to path
+func writeReport(context *cli.Context, path string, sum *summary, source, target containerd.Image) error {
+	finished := time.Now()
+	sum.Elapsed = finished.Sub(sum.start)
+	r := report{
+		Command: context.Command.Name,
+		Version: context.App.Version,
+		Source: reportImage{
+			Name:   source.Name(),
+			Digest: source.Target().Digest.String(),
+		},
+		Target: reportImage{
+			Name:   target.Name(),
+			Digest: target.Target().Digest.String(),
+		},
+		Started:  sum.start,
+		Finished: finished,
+		summary:  sum,
+	}
+	p, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, p, 0644)
+}
+
+// finishSummary completes the summary of the command that turned source into target
+// and prints it with --summary or writes it as the report of --report-file
+func finishSummary(ctx gocontext.Context, context *cli.Context, sum *summary, source, target containerd.Image) error {
+	reportFile := context.String("report-file")
+	if !context.Bool("summary") && reportFile == "" {
+		return nil
+	}
+	if err := sum.addImage(ctx, source.ContentStore(), source.Target(), target.Target()); err != nil {
+		return err
+	}
+	if reportFile != "" {
+		if err := writeReport(context, reportFile, sum, source, target); err != nil {
+			return err
+		}
+	}
+	if context.Bool("summary") {
+		return sum.print(os.Stdout)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const k8sScheme = "k8s://"
+
+// keySources caches the key material read by readKeySource once caching is enabled
+// with cacheKeySources, so that commands processing many images read every key once
+var keySources = struct {
+	sync.Mutex
+	cache map[string][]byte
+}{}
+
+// cacheKeySources makes readKeySource keep the key material it read for the rest
+// of the command
+func cacheKeySources() {
+	keySources.Lock()
+	defer keySources.Unlock()
+	if keySources.cache == nil {
+		keySources.cache = make(map[string][]byte)
+	}
+}
+
+// readKeySource reads key material from a file or from one of the following sources:
+// - k8s://<namespace>/<secret>/<key>
+// - vault://<path>#<field>
+func readKeySource(context *cli.Context, source string) ([]byte, error) {
+	keySources.Lock()
+	defer keySources.Unlock()
+	if data, ok := keySources.cache[source]; ok {
+		return data, nil
+	}
+	data, err := readKeySourceUncached(context, source)
+	if err != nil {
+		return nil, err
+	}
+	if keySources.cache != nil {
+		keySources.cache[source] = data
+	}
+	return data, nil
+}
+
+func readKeySourceUncached(context *cli.Context, source string) ([]byte, error) {
+	if strings.HasPrefix(source, k8sScheme) {
+		return readKubernetesSecret(context.String("kubeconfig"), strings.TrimPrefix(source, k8sScheme))
+	}
+	if strings.HasPrefix(source, vaultScheme) {
+		return readVaultSecret(context, strings.TrimPrefix(source, vaultScheme))
+	}
+	return ioutil.ReadFile(source)
+}
+
+// splitKeyAndPassword splits a --key value into the key source and the optional password;
+// the colon of the scheme of a key source is not taken as the separator. Only a scheme
+// prefixing the value belongs to the key, a password may be a remote source itself,
+// i.e. key.pem:k8s://ns/secret/pw.
+func splitKeyAndPassword(keyfileAndPwd string) (string, string, bool) {
+	offset := 0
+	if scheme := remoteKeyScheme(keyfileAndPwd); scheme != "" {
+		offset = len(scheme)
+	}
+	idx := strings.Index(keyfileAndPwd[offset:], ":")
+	if idx < 0 {
+		return keyfileAndPwd, "", false
+	}
+	return keyfileAndPwd[:offset+idx], keyfileAndPwd[offset+idx+1:], true
+}
+
+// remoteKeyScheme returns the scheme of a key source read from a remote service, or ""
+// for a key read from a file
+func remoteKeyScheme(source string) string {
+	for _, scheme := range []string{k8sScheme, vaultScheme} {
+		if strings.HasPrefix(source, scheme) {
+			return scheme
+		}
+	}
+	return ""
+}
+
+// readKubernetesSecret reads the data key of a secret given as <namespace>/<secret>/<key>.
+// The in-cluster config is used unless a kubeconfig is given.
+func readKubernetesSecret(kubeconfig, ref string) ([]byte, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, errors.Errorf("invalid kubernetes secret reference %s%s; expected %s<namespace>/<secret>/<key>", k8sScheme, ref, k8sScheme)
+	}
+	namespace, name, key := parts[0], parts[1], parts[2]
+
+	var (
+		config *rest.Config
+		err    error
+	)
+	if kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create kubernetes client config")
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create kubernetes client")
+	}
+	return kubernetesSecretData(clientset, namespace, name, key)
+}
+
+// kubernetesSecretData returns the data key of the secret read with the client
+func kubernetesSecretData(clientset kubernetes.Interface, namespace, name, key string) ([]byte, error) {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get secret %s/%s", namespace, name)
+	}
+	data, ok := secret.Data[key]
+	if !ok {
+		return nil, errors.Errorf("secret %s/%s has no key %s", namespace, name, key)
+	}
+	return data, nil
+}
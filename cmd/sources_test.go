@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSplitKeyAndPassword(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		key      string
+		password string
+		hasPwd   bool
+	}{
+		{value: "key.pem", key: "key.pem"},
+		{value: "key.pem:secret", key: "key.pem", password: "secret", hasPwd: true},
+		{value: "key.pem:pass=a:b", key: "key.pem", password: "pass=a:b", hasPwd: true},
+		{value: "key.pem:", key: "key.pem", hasPwd: true},
+		{value: "k8s://ns/secret/key", key: "k8s://ns/secret/key"},
+		{value: "k8s://ns/secret/key:pw", key: "k8s://ns/secret/key", password: "pw", hasPwd: true},
+		{value: "vault://secret/keys#private:file=/pw", key: "vault://secret/keys#private", password: "file=/pw", hasPwd: true},
+		{value: "key.pem:k8s://ns/secret/pw", key: "key.pem", password: "k8s://ns/secret/pw", hasPwd: true},
+		{value: "ring.gpg:0xDEADBEEF=pass=pw", key: "ring.gpg", password: "0xDEADBEEF=pass=pw", hasPwd: true},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			key, password, hasPwd := splitKeyAndPassword(tc.value)
+			if key != tc.key || password != tc.password || hasPwd != tc.hasPwd {
+				t.Fatalf("got %q, %q, %v, expected %q, %q, %v", key, password, hasPwd, tc.key, tc.password, tc.hasPwd)
+			}
+		})
+	}
+}
+
+func TestKubernetesSecretData(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "keys", Name: "decrypt"},
+		Data: map[string][]byte{
+			"private.pem": []byte("private key"),
+		},
+	})
+
+	for _, tc := range []struct {
+		namespace, name, key string
+		data                 string
+		err                  bool
+	}{
+		{namespace: "keys", name: "decrypt", key: "private.pem", data: "private key"},
+		{namespace: "keys", name: "decrypt", key: "public.pem", err: true},
+		{namespace: "keys", name: "encrypt", key: "private.pem", err: true},
+		{namespace: "default", name: "decrypt", key: "private.pem", err: true},
+	} {
+		t.Run(tc.namespace+"/"+tc.name+"/"+tc.key, func(t *testing.T) {
+			data, err := kubernetesSecretData(clientset, tc.namespace, tc.name, tc.key)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.data {
+				t.Fatalf("got %q, expected %q", data, tc.data)
+			}
+		})
+	}
+}
+
+func TestReadKubernetesSecretInvalidReference(t *testing.T) {
+	for _, ref := range []string{"ns/secret", "ns/secret/key/extra", "/secret/key", "ns//key", "ns/secret/"} {
+		if _, err := readKubernetesSecret("", ref); err == nil {
+			t.Errorf("expected %s to be rejected", ref)
+		}
+	}
+}
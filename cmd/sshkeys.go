@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// isOpenSSHPrivateKey checks whether the key is an OpenSSH private key
+func isOpenSSHPrivateKey(key []byte) bool {
+	block, _ := pem.Decode(bytes.TrimSpace(key))
+	return block != nil && block.Type == "OPENSSH PRIVATE KEY"
+}
+
+// convertOpenSSHPrivateKey parses an OpenSSH private key, decrypting it with the password
+// if one is given, and returns it as an unencrypted PKCS8 key for use with JWE. Only RSA
+// and ECDSA keys can be used since JWE does not support ed25519 keys.
+func convertOpenSSHPrivateKey(key, password []byte) ([]byte, error) {
+	var (
+		priv interface{}
+		err  error
+	)
+	if len(password) > 0 {
+		priv, err = ssh.ParseRawPrivateKeyWithPassphrase(key, password)
+	} else {
+		priv, err = ssh.ParseRawPrivateKey(key)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse OpenSSH private key")
+	}
+	switch k := priv.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	default:
+		return nil, errors.Errorf("OpenSSH private keys of type %T cannot be used for decryption; only RSA and ECDSA keys are supported", priv)
+	}
+}
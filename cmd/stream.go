@@ -1,25 +1,42 @@
 package main
 
 import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"syscall"
 
-	"github.com/containerd/containerd/cmd/ctr-layertool/commands/utils"
+	"github.com/containerd/containerd/archive/compression"
 	"github.com/containerd/containerd/pkg/encryption"
+	"github.com/crosbymichael/cryptd"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
 var streamCommand = cli.Command{
 	Name: "stream",
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "result-fd",
+			Usage: "File descriptor to write the size, digest and DiffID of the decrypted layer to as JSON",
+			Value: -1,
+		},
+		cli.BoolFlag{
+			Name:  "check",
+			Usage: "Only check that the payload unwraps the layer key and decrypts the first block of the layer; nothing is written to stdout",
+		},
+	},
 	Action: func(clix *cli.Context) error {
 		var (
 			layerInFd  = syscall.Stdin
 			layerOutFd = syscall.Stdout
 		)
 
-		decryptData, err := utils.ReadDecryptData()
+		decryptData, err := ReadDecryptData()
 		if err != nil {
 			return errors.Wrapf(err, "could not read config data")
 		}
@@ -36,25 +53,163 @@ var streamCommand = cli.Command{
 		}
 		defer layerInFile.Close()
 
-		ltd, err := utils.UnmarshalLayerToolDecryptData(decryptData)
+		// a cancelled copy may be blocked reading or writing the layer; closing the
+		// files makes these calls return
+		ctx := appContext()
+		stop := closeOnCancel(ctx, layerInFile, layerOutFile)
+		defer stop()
+
+		ltd, err := UnmarshalLayerToolDecryptData(decryptData)
 		if err != nil {
 			return err
 		}
+		if err := ltd.Validate(); err != nil {
+			return err
+		}
 
 		_, plainLayerReader, _, err := encryption.DecryptLayer(&ltd.DecryptConfig, layerInFile, ltd.Descriptor, false)
 		if err != nil {
 			return errors.Wrapf(err, "call to DecryptLayer failed")
 		}
 
-		for {
-			_, err := io.CopyN(layerOutFile, plainLayerReader, 10*1024)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
+		if clix.Bool("check") {
+			if err := checkLayer(plainLayerReader); err != nil {
+				return errors.Wrapf(err, "could not decrypt the layer")
+			}
+			fmt.Fprintln(os.Stderr, "payload decrypts the layer")
+			return nil
+		}
+
+		resultFd := clix.Int("result-fd")
+		if resultFd < 0 {
+			if _, err := copyLayer(ctx, layerOutFile, plainLayerReader); err != nil {
 				return errors.Wrapf(err, "could not copy data")
 			}
+			return nil
 		}
-		return nil
+
+		var (
+			digester = digest.Canonical.Digester()
+			pr, pw   = io.Pipe()
+			diffIDs  = make(chan diffIDResult, 1)
+		)
+		go func() {
+			diffIDs <- computeDiffID(pr)
+		}()
+		size, err := copyLayer(ctx, io.MultiWriter(layerOutFile, digester.Hash(), pw), plainLayerReader)
+		pw.CloseWithError(err)
+		if err != nil {
+			return errors.Wrapf(err, "could not copy data")
+		}
+		diffID := <-diffIDs
+		if diffID.err != nil {
+			return errors.Wrapf(diffID.err, "could not compute the DiffID of the layer")
+		}
+
+		return writeStreamResult(resultFd, &cryptd.StreamResult{
+			Size:   size,
+			Digest: digester.Digest(),
+			DiffID: diffID.diffID,
+		})
 	},
 }
+
+type diffIDResult struct {
+	diffID digest.Digest
+	err    error
+}
+
+// computeDiffID computes the digest of the uncompressed layer read from r; r is
+// always read to its end so that the writer feeding it does not block
+func computeDiffID(r io.Reader) diffIDResult {
+	defer io.Copy(ioutil.Discard, r)
+
+	dr, err := compression.DecompressStream(r)
+	if err != nil {
+		return diffIDResult{err: err}
+	}
+	defer dr.Close()
+
+	diffID, err := digest.Canonical.FromReader(dr)
+	return diffIDResult{diffID: diffID, err: err}
+}
+
+func writeStreamResult(fd int, result *cryptd.StreamResult) error {
+	f := os.NewFile(uintptr(fd), "resultFd")
+	if f == nil {
+		return errors.Errorf("result file descriptor %d is invalid", fd)
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(result)
+}
+
+// checkLayer reads the first block of the decrypted layer
+func checkLayer(r io.Reader) error {
+	buf := make([]byte, layerBufferSize)
+	if _, err := io.ReadFull(r, buf); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return nil
+}
+
+// layerBufferSize is the size of the buffer used to stream layers
+const layerBufferSize = 32 * 1024
+
+// copyLayer copies the layer through a single fixed size buffer so that memory
+// use is bounded regardless of the size of the layer. io.Copy is not used since
+// it hands the copy to io.ReaderFrom implementations, such as *os.File, which
+// allocate buffers of their own. The copy stops with the error of ctx once it is
+// cancelled; see closeOnCancel for interrupting a blocked read or write.
+func copyLayer(ctx gocontext.Context, w io.Writer, r io.Reader) (int64, error) {
+	var (
+		buf     = make([]byte, layerBufferSize)
+		written int64
+	)
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			nw, werr := w.Write(buf[:n])
+			written += int64(nw)
+			if werr != nil {
+				if ctx.Err() != nil {
+					return written, ctx.Err()
+				}
+				return written, werr
+			}
+			if nw != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return written, ctx.Err()
+			}
+			return written, err
+		}
+	}
+}
+
+// closeOnCancel closes the files once ctx is cancelled, which makes reads and writes
+// blocked on them return; the returned function stops watching ctx
+func closeOnCancel(ctx gocontext.Context, files ...*os.File) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			for _, f := range files {
+				f.Close()
+			}
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
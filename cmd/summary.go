@@ -0,0 +1,182 @@
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/pkg/encryption"
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	"github.com/containerd/containerd/platforms"
+	"github.com/crosbymichael/cryptd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+// recipientParameters are the encrypt config parameters holding one entry per recipient
+var recipientParameters = []string{"pubkeys", "x509s", "gpg-recipients"}
+
+// summary is the end of run report of encrypting or decrypting images
+type summary struct {
+	Images          int            `json:"images"`
+	LayersProcessed int            `json:"layers_processed"`
+	LayersSkipped   int            `json:"layers_skipped"`
+	Bytes           int64          `json:"bytes"`
+	Elapsed         time.Duration  `json:"elapsed"`
+	Recipients      map[string]int `json:"recipients,omitempty"`
+	// KeyUsage maps the digests of encrypted layers to the keys passed with
+	// --key that unwrap them
+	KeyUsage map[string][]string `json:"key_usage,omitempty"`
+	Layers   []layerAction       `json:"layers,omitempty"`
+
+	start time.Time
+}
+
+// layerAction records what was done to a layer of the source image
+type layerAction struct {
+	Platform  string `json:"platform,omitempty"`
+	Source    string `json:"source"`
+	Result    string `json:"result"`
+	MediaType string `json:"mediaType"`
+	Action    string `json:"action"`
+}
+
+func newSummary() *summary {
+	return &summary{
+		Recipients: make(map[string]int),
+		KeyUsage:   make(map[string][]string),
+		start:      time.Now(),
+	}
+}
+
+// addRecipients counts the recipients of the encrypt config per scheme
+func (s *summary) addRecipients(ec *encconfig.EncryptConfig) {
+	for _, name := range recipientParameters {
+		if n := len(ec.Parameters[name]); n > 0 {
+			s.Recipients[parameterSchemes[name]] += n
+		}
+	}
+}
+
+// addKeyUsage records which of the keys passed with --key unwrap the layer keys of
+// the encrypted layers; keys are identified by their source without a password
+func (s *summary) addKeyUsage(context *cli.Context, descs []ocispec.Descriptor) error {
+	for _, key := range context.StringSlice("key") {
+		dc, err := createKeyDecryptConfig(context, key)
+		if err != nil {
+			return err
+		}
+		source, _, _ := splitKeyAndPassword(key)
+		for _, desc := range descs {
+			if !cryptd.IsEncryptedMediaType(desc.MediaType) {
+				continue
+			}
+			if _, _, _, err := encryption.DecryptLayer(dc, nil, desc, true); err != nil {
+				continue
+			}
+			s.KeyUsage[desc.Digest.String()] = append(s.KeyUsage[desc.Digest.String()], source)
+		}
+	}
+	return nil
+}
+
+// addImage accounts for the layers of the source image that were changed in the result
+func (s *summary) addImage(ctx gocontext.Context, cs content.Store, source, result ocispec.Descriptor) error {
+	before, _, err := cryptd.LayerDescriptors(ctx, cs, source, false)
+	if err != nil {
+		return err
+	}
+	after, _, err := cryptd.LayerDescriptors(ctx, cs, result, false)
+	if err != nil {
+		return err
+	}
+
+	s.Images++
+	for i, desc := range after {
+		action := layerAction{
+			Result:    desc.Digest.String(),
+			MediaType: desc.MediaType,
+		}
+		if desc.Platform != nil {
+			action.Platform = platforms.Format(*desc.Platform)
+		}
+		if i < len(before) {
+			action.Source = before[i].Digest.String()
+			action.Action = describeLayerAction(before[i], desc)
+		}
+		s.Layers = append(s.Layers, action)
+
+		if i < len(before) && layerUnchanged(before[i], desc) {
+			s.LayersSkipped++
+			continue
+		}
+		s.LayersProcessed++
+		s.Bytes += desc.Size
+	}
+	return nil
+}
+
+// describeLayerAction names what was done to the layer
+func describeLayerAction(before, after ocispec.Descriptor) string {
+	var (
+		wasEncrypted = cryptd.IsEncryptedMediaType(before.MediaType)
+		isEncrypted  = cryptd.IsEncryptedMediaType(after.MediaType)
+	)
+	switch {
+	case layerUnchanged(before, after):
+		return "unchanged"
+	case !wasEncrypted && isEncrypted:
+		return "encrypted"
+	case wasEncrypted && !isEncrypted:
+		return "decrypted"
+	case wasEncrypted && before.Digest == after.Digest:
+		return "rewrapped"
+	case wasEncrypted:
+		return "reencrypted"
+	}
+	return "rewritten"
+}
+
+// layerUnchanged checks whether the layer was left untouched; adding recipients only
+// changes the annotations of a layer
+func layerUnchanged(before, after ocispec.Descriptor) bool {
+	return before.Digest == after.Digest &&
+		before.MediaType == after.MediaType &&
+		reflect.DeepEqual(before.Annotations, after.Annotations)
+}
+
+func (s *summary) print(w io.Writer) error {
+	s.Elapsed = time.Since(s.start)
+
+	var recipients []string
+	for scheme, n := range s.Recipients {
+		recipients = append(recipients, fmt.Sprintf("%s=%d", scheme, n))
+	}
+	sort.Strings(recipients)
+
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "images:\t%d\n", s.Images)
+	fmt.Fprintf(tw, "layers processed:\t%s\n", colorize(colorGreen, strconv.Itoa(s.LayersProcessed)))
+	fmt.Fprintf(tw, "layers skipped:\t%s\n", colorize(colorYellow, strconv.Itoa(s.LayersSkipped)))
+	fmt.Fprintf(tw, "bytes:\t%d\n", s.Bytes)
+	fmt.Fprintf(tw, "elapsed:\t%s\n", s.Elapsed.Round(time.Millisecond))
+	if len(recipients) > 0 {
+		fmt.Fprintf(tw, "recipients:\t%s\n", strings.Join(recipients, " "))
+	}
+	var layers []string
+	for layer := range s.KeyUsage {
+		layers = append(layers, layer)
+	}
+	sort.Strings(layers)
+	for _, layer := range layers {
+		fmt.Fprintf(tw, "key %s:\t%s\n", layer, strings.Join(s.KeyUsage[layer], ", "))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	gocontext "context"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracer creates the spans of the commands
+var tracer = otel.Tracer("github.com/crosbymichael/cryptd/cmd")
+
+// shutdownTracing is the function returned by setupTracing when --trace is set
+var shutdownTracing func()
+
+// flushTracing exports the spans still buffered, once, before the process exits
+func flushTracing() {
+	if shutdownTracing != nil {
+		shutdownTracing()
+		shutdownTracing = nil
+	}
+}
+
+// setupTracing installs a tracer provider exporting spans over OTLP; the exporter is
+// configured with the OTEL_EXPORTER_OTLP_* environment variables. The returned
+// function flushes the remaining spans.
+func setupTracing() (func(), error) {
+	exporter, err := otlptracegrpc.New(gocontext.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create the OTLP trace exporter")
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return func() {
+		tp.Shutdown(gocontext.Background())
+	}, nil
+}
+
+// envCarrier reads the trace context propagated by the calling process from the
+// environment, i.e. the traceparent header from TRACEPARENT
+type envCarrier struct{}
+
+func (envCarrier) Get(key string) string {
+	return os.Getenv(strings.ToUpper(key))
+}
+
+func (envCarrier) Set(key, value string) {}
+
+func (envCarrier) Keys() []string {
+	return []string{"traceparent", "tracestate", "baggage"}
+}
@@ -17,6 +17,8 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/containerd/typeurl"
 	"github.com/crosbymichael/cryptd"
 	"github.com/gogo/protobuf/proto"
@@ -24,8 +26,9 @@ import (
 	"github.com/pkg/errors"
 )
 
-// UnmarshalLayerToolDecryptData unmarshals a byte array to LayerToolDecryptData
-func UnmarshalLayerToolDecryptData(decryptData []byte) (*cryptd.ProcessorPayload, error) {
+// UnmarshalLayerToolDecryptData unmarshals a byte array to a ProcessorPayloadV2;
+// payloads of the first version are converted
+func UnmarshalLayerToolDecryptData(decryptData []byte) (*cryptd.ProcessorPayloadV2, error) {
 	var pb types.Any
 
 	if err := proto.Unmarshal(decryptData, &pb); err != nil {
@@ -33,12 +36,26 @@ func UnmarshalLayerToolDecryptData(decryptData []byte) (*cryptd.ProcessorPayload
 	}
 	v, err := typeurl.UnmarshalAny(&pb)
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not UnmarshalAny() the decrypt data")
+		return nil, errors.Wrapf(unknownPayloadError(pb.TypeUrl), "could not UnmarshalAny() the decrypt data: %v", err)
 	}
 
-	data, ok := v.(*cryptd.ProcessorPayload)
-	if !ok {
-		return nil, errors.Errorf("received an unknown data type '%s'", pb.TypeUrl)
+	switch data := v.(type) {
+	case *cryptd.ProcessorPayloadV2:
+		return data, nil
+	case *cryptd.ProcessorPayload:
+		return data.V2(), nil
 	}
-	return data, nil
+	return nil, unknownPayloadError(pb.TypeUrl)
+}
+
+// payloadTypeURLs are the type urls of the payloads registered by this stream processor
+var payloadTypeURLs = []string{
+	cryptd.ProcessorPayloadV2TypeURL,
+	cryptd.ProcessorPayloadTypeURL,
+}
+
+func unknownPayloadError(typeURL string) error {
+	return errors.Errorf("received an unknown data type '%s', expected one of [%s] registered by this stream processor; "+
+		"this usually means the stream processor and containerd were built against different cryptd versions",
+		typeURL, strings.Join(payloadTypeURLs, ", "))
 }
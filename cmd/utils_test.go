@@ -0,0 +1,117 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	"github.com/containerd/typeurl"
+	"github.com/crosbymichael/cryptd"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func marshalPayload(t *testing.T, v interface{}) []byte {
+	t.Helper()
+
+	any, err := typeurl.MarshalAny(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := proto.Marshal(any)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestUnmarshalLayerToolDecryptData(t *testing.T) {
+	dc := encconfig.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {[]byte("private key")},
+			"privkeys-passwords": {nil},
+		},
+	}
+	desc := ocispec.Descriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar+gzip+encrypted",
+		Digest:    digest.FromString("layer"),
+		Size:      5,
+	}
+
+	for _, tc := range []struct {
+		name     string
+		payload  interface{}
+		expected *cryptd.ProcessorPayloadV2
+	}{
+		{
+			name:     "v1",
+			payload:  &cryptd.ProcessorPayload{DecryptConfig: dc, Descriptor: desc},
+			expected: &cryptd.ProcessorPayloadV2{DecryptConfig: dc, Descriptor: desc},
+		},
+		{
+			name: "v2",
+			payload: &cryptd.ProcessorPayloadV2{
+				DecryptConfig: dc,
+				Descriptor:    desc,
+				Options:       map[string]string{"verify": "true"},
+			},
+			expected: &cryptd.ProcessorPayloadV2{
+				DecryptConfig: dc,
+				Descriptor:    desc,
+				Options:       map[string]string{"verify": "true"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			payload, err := UnmarshalLayerToolDecryptData(marshalPayload(t, tc.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(payload, tc.expected) {
+				t.Fatalf("got payload %+v, expected %+v", payload, tc.expected)
+			}
+		})
+	}
+}
+
+func TestUnmarshalLayerToolDecryptDataUnknownType(t *testing.T) {
+	p, err := proto.Marshal(&types.Any{
+		TypeUrl: "com.ibm.research.v3.ProcessorPayload",
+		Value:   []byte("{}"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = UnmarshalLayerToolDecryptData(p)
+	if err == nil {
+		t.Fatal("expected an unknown payload to be rejected")
+	}
+	for _, s := range append([]string{"com.ibm.research.v3.ProcessorPayload"}, payloadTypeURLs...) {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error %q does not mention %s", err, s)
+		}
+	}
+
+	if _, err := UnmarshalLayerToolDecryptData([]byte("not a protobuf message")); err == nil {
+		t.Fatal("expected malformed decrypt data to be rejected")
+	}
+}
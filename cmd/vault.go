@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const vaultScheme = "vault://"
+
+// readVaultSecret reads the field of a HashiCorp Vault secret given as <path>#<field>,
+// i.e. secret/data/team#pubkey. Secrets of the KV version 2 engine hold their fields
+// in data.data, those of version 1 in data. The address and token default to the
+// VAULT_ADDR and VAULT_TOKEN environment variables.
+func readVaultSecret(context *cli.Context, ref string) ([]byte, error) {
+	idx := strings.LastIndex(ref, "#")
+	if idx <= 0 || idx == len(ref)-1 {
+		return nil, errors.Errorf("invalid vault secret reference %s%s; expected %s<path>#<field>", vaultScheme, ref, vaultScheme)
+	}
+	path, field := strings.Trim(ref[:idx], "/"), ref[idx+1:]
+
+	addr := context.String("vault-addr")
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return nil, errors.Errorf("reading %s%s requires the vault address in --vault-addr or VAULT_ADDR", vaultScheme, ref)
+	}
+	token := context.String("vault-token")
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if token == "" {
+		return nil, errors.Errorf("reading %s%s requires a vault token in --vault-token or VAULT_TOKEN", vaultScheme, ref)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read vault secret %s", path)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("vault returned %s for secret %s", resp.Status, path)
+	}
+
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, errors.Wrapf(err, "could not parse vault secret %s", path)
+	}
+	fields := secret.Data
+	if nested, ok := secret.Data["data"]; ok {
+		var kv2 map[string]json.RawMessage
+		if err := json.Unmarshal(nested, &kv2); err == nil {
+			if _, ok := kv2[field]; ok {
+				fields = kv2
+			}
+		}
+	}
+	raw, ok := fields[field]
+	if !ok {
+		return nil, errors.Errorf("vault secret %s has no field %s", path, field)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, errors.Errorf("field %s of vault secret %s is not a string", field, path)
+	}
+	return []byte(value), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var verifyCommand = cli.Command{
+	Name:      "verify",
+	Usage:     "Verify without any keys that the selected layer blobs match the digests and sizes of the manifest",
+	ArgsUsage: "<ref>",
+	Flags: append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  "audit-keys",
+			Usage: "Also fail if different encrypted layers share a wrapped layer key, meaning they are encrypted with the same layer key (DEK)",
+		},
+	}, ImageLayerFlags...),
+	Action: func(context *cli.Context) error {
+		local := context.Args().First()
+		if local == "" {
+			return errors.New("please provide the name of an image to verify")
+		}
+
+		ctx := appContext()
+		ctdClient, err := newContainerdClient(ctx, context)
+		if err != nil {
+			return err
+		}
+
+		_, descs, err := getImageLayerInfos(ctdClient, ctx, local, commands.IntToInt32Array(context.IntSlice("layer")), commands.IntToInt32Array(context.IntSlice("exclude-layer")), context.StringSlice("platform"), context.String("platform-default-os"))
+		if err != nil {
+			return err
+		}
+
+		if len(descs) == 0 {
+			return noopStatus("nothing to do: no layers of %s selected", local)
+		}
+
+		var failed int
+		cs := ctdClient.ContentStore()
+		for _, desc := range descs {
+			if err := verifyBlob(ctx, cs, desc); err != nil {
+				fmt.Fprintln(os.Stderr, colorize(colorRed, fmt.Sprintf("layer %s: %v", desc.Digest, err)))
+				failed++
+			}
+		}
+		var reused []keyReuse
+		if context.Bool("audit-keys") {
+			if reused, err = auditKeyReuse(descs); err != nil {
+				return err
+			}
+			for _, r := range reused {
+				fmt.Fprintln(os.Stderr, colorize(colorRed, fmt.Sprintf("layers %s share a %s wrapped layer key", joinDigests(r.Layers), r.Scheme)))
+			}
+		}
+		if failed > 0 {
+			return errors.Errorf("%d of %d layers failed verification", failed, len(descs))
+		}
+		if len(reused) > 0 {
+			return errors.Errorf("%d layer keys are shared by different layers", len(reused))
+		}
+		fmt.Printf("%d layers verified\n", len(descs))
+		return nil
+	},
+}
+
+// verifyBlob checks that the blob of the layer in the content store has the size and
+// digest of its descriptor; the digest is computed from the content, not taken from
+// the store
+func verifyBlob(ctx gocontext.Context, cs content.Store, desc ocispec.Descriptor) error {
+	info, err := cs.Info(ctx, desc.Digest)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return errors.New("blob is missing")
+		}
+		return err
+	}
+	if info.Size != desc.Size {
+		return errors.Errorf("blob has size %d, expected %d", info.Size, desc.Size)
+	}
+
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+
+	if err := desc.Digest.Validate(); err != nil {
+		return err
+	}
+	dgst, err := desc.Digest.Algorithm().FromReader(content.NewReader(ra))
+	if err != nil {
+		return err
+	}
+	if dgst != desc.Digest {
+		return errors.Errorf("blob has digest %s", dgst)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package cryptd
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	imgenc "github.com/containerd/containerd/images/encryption"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// gzipMediaTypes maps the media types of the layers that can be recompressed to
+// the media type of the gzip compressed layer
+var gzipMediaTypes = map[string]string{
+	images.MediaTypeDockerSchema2Layer:     images.MediaTypeDockerSchema2LayerGzip,
+	images.MediaTypeDockerSchema2LayerGzip: images.MediaTypeDockerSchema2LayerGzip,
+	ocispec.MediaTypeImageLayer:            ocispec.MediaTypeImageLayerGzip,
+	ocispec.MediaTypeImageLayerGzip:        ocispec.MediaTypeImageLayerGzip,
+}
+
+// recompressLayers returns a manifestFunc that gzip compresses the plaintext layers
+// selected by lf with the given level. The digests of the new blobs are added to
+// recompressed so that the layer filter can select them for encryption.
+func recompressLayers(level int, lf imgenc.LayerFilter, recompressed map[digest.Digest]bool) manifestFunc {
+	return func(ctx context.Context, cs content.Store, m *ocispec.Manifest) (bool, error) {
+		var modified bool
+		for i, layer := range m.Layers {
+			mediaType, ok := gzipMediaTypes[layer.MediaType]
+			if !ok || !lf(layer) {
+				continue
+			}
+			desc, err := gzipLayer(ctx, cs, layer, mediaType, level)
+			if err != nil {
+				return false, err
+			}
+			recompressed[desc.Digest] = true
+			if desc.Digest == layer.Digest && desc.MediaType == layer.MediaType {
+				continue
+			}
+			m.Layers[i] = desc
+			modified = true
+		}
+		return modified, nil
+	}
+}
+
+// gzipLayer writes the uncompressed content of the layer gzip compressed with level
+// to the content store
+func gzipLayer(ctx context.Context, cs content.Store, layer ocispec.Descriptor, mediaType string, level int) (ocispec.Descriptor, error) {
+	ra, err := cs.ReaderAt(ctx, layer)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer ra.Close()
+
+	dr, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to decompress layer %s", layer.Digest)
+	}
+	defer dr.Close()
+
+	w, err := content.OpenWriter(ctx, cs, content.WithRef("cryptd-gzip-"+layer.Digest.String()))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer w.Close()
+	if err := w.Truncate(0); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	cw := &countingWriter{w: w}
+	zw, err := gzip.NewWriterLevel(cw, level)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if _, err := io.Copy(zw, dr); err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to compress layer %s", layer.Digest)
+	}
+	if err := zw.Close(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	dgst := w.Digest()
+	if err := w.Commit(ctx, cw.n, dgst); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to write compressed layer %s", layer.Digest)
+	}
+	return ocispec.Descriptor{
+		MediaType:   mediaType,
+		Digest:      dgst,
+		Size:        cw.n,
+		Annotations: layer.Annotations,
+	}, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,105 @@
+package cryptd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/content"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// transformConfigs returns a manifestFunc that applies fn to the image config of
+// the manifest and writes the resulting config. Fields of the config that are not
+// part of ocispec.Image are kept as they are, as are those of its nested "config"
+// that ocispec.ImageConfig does not know, such as Healthcheck or OnBuild.
+func transformConfigs(fn func(*ocispec.Image) error) manifestFunc {
+	return func(ctx context.Context, cs content.Store, m *ocispec.Manifest) (bool, error) {
+		var raw map[string]json.RawMessage
+		if err := readJSON(ctx, cs, m.Config, &raw); err != nil {
+			return false, err
+		}
+		var config ocispec.Image
+		if err := readJSON(ctx, cs, m.Config, &config); err != nil {
+			return false, err
+		}
+		orig, err := json.Marshal(&config)
+		if err != nil {
+			return false, err
+		}
+		if err := fn(&config); err != nil {
+			return false, errors.Wrapf(err, "failed to transform config %s", m.Config.Digest)
+		}
+		p, err := json.Marshal(&config)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(orig, p) {
+			return false, nil
+		}
+
+		if err := mergeFields(raw, orig, p, nestedConfigFields); err != nil {
+			return false, err
+		}
+
+		desc, err := writeJSON(ctx, cs, m.Config, raw, nil)
+		if err != nil {
+			return false, err
+		}
+		m.Config = desc
+		return true, nil
+	}
+}
+
+// nestedConfigFields are the fields of the image config whose objects have fields
+// unknown to ocispec.Image; these are merged one level down by mergeFields
+var nestedConfigFields = map[string]bool{
+	"config": true,
+}
+
+// mergeFields replaces the fields of raw known to orig, the marshalled config before
+// the transform, with those of transformed, including fields the transform emptied.
+// The objects of the nested fields are merged the same way, so that the fields they
+// have beyond the ones orig knows are kept.
+func mergeFields(raw map[string]json.RawMessage, orig, transformed []byte, nested map[string]bool) error {
+	var known map[string]json.RawMessage
+	if err := json.Unmarshal(orig, &known); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(transformed, &fields); err != nil {
+		return err
+	}
+	merged := make(map[string]bool)
+	for k := range known {
+		if nested[k] && fields[k] != nil {
+			var rawNested map[string]json.RawMessage
+			if err := json.Unmarshal(raw[k], &rawNested); err == nil && rawNested != nil {
+				if err := mergeFields(rawNested, known[k], fields[k], nil); err != nil {
+					return err
+				}
+				p, err := json.Marshal(rawNested)
+				if err != nil {
+					return err
+				}
+				raw[k] = p
+				merged[k] = true
+				continue
+			}
+		}
+		delete(raw, k)
+	}
+	for k, v := range fields {
+		if !merged[k] {
+			raw[k] = v
+		}
+	}
+	return nil
+}
+
+// stripHistory is the config transform removing the history entries
+func stripHistory(config *ocispec.Image) error {
+	config.History = nil
+	return nil
+}
@@ -0,0 +1,129 @@
+package cryptd
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// dockerConfig has the fields of a docker image config that ocispec.Image and
+// ocispec.ImageConfig do not know
+const dockerConfig = `{
+	"architecture": "amd64",
+	"os": "linux",
+	"container": "3f4e2a1b",
+	"config": {
+		"Env": ["PATH=/usr/bin", "SECRET=1"],
+		"Cmd": ["/bin/sh"],
+		"Healthcheck": {"Test": ["CMD", "true"], "Interval": 30000000000},
+		"OnBuild": ["RUN true"],
+		"Shell": ["/bin/bash", "-c"],
+		"ArgsEscaped": true,
+		"StopTimeout": 10
+	},
+	"rootfs": {"type": "layers", "diff_ids": []},
+	"history": [{"created_by": "/bin/sh -c #(nop) CMD [\"/bin/sh\"]"}]
+}`
+
+// unsetSecret is the config transform of --unset-env SECRET
+func unsetSecret(config *ocispec.Image) error {
+	var env []string
+	for _, e := range config.Config.Env {
+		if !strings.HasPrefix(e, "SECRET=") {
+			env = append(env, e)
+		}
+	}
+	config.Config.Env = env
+	return nil
+}
+
+// transformTestConfig applies the transform to a config written from p and returns
+// the transformed config as unmarshalled into a generic map
+func transformTestConfig(t *testing.T, p string, fn func(*ocispec.Image) error) (map[string]interface{}, bool) {
+	t.Helper()
+
+	ctx := context.Background()
+	cs, cleanup := newTestStore(t)
+	defer cleanup()
+
+	m := ocispec.Manifest{
+		Config: writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageConfig, []byte(p)),
+	}
+	changed, err := transformConfigs(fn)(ctx, cs, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]interface{}
+	if err := readJSON(ctx, cs, m.Config, &config); err != nil {
+		t.Fatal(err)
+	}
+	return config, changed
+}
+
+func TestTransformConfigsKeepsUnknownFields(t *testing.T) {
+	var orig map[string]interface{}
+	if err := json.Unmarshal([]byte(dockerConfig), &orig); err != nil {
+		t.Fatal(err)
+	}
+	config, changed := transformTestConfig(t, dockerConfig, unsetSecret)
+	if !changed {
+		t.Fatal("the config was not transformed")
+	}
+
+	nested := config["config"].(map[string]interface{})
+	if env := nested["Env"]; !reflect.DeepEqual(env, []interface{}{"PATH=/usr/bin"}) {
+		t.Errorf("got env %v, expected SECRET to be removed", env)
+	}
+	origNested := orig["config"].(map[string]interface{})
+	for _, k := range []string{"Cmd", "Healthcheck", "OnBuild", "Shell", "ArgsEscaped", "StopTimeout"} {
+		if !reflect.DeepEqual(nested[k], origNested[k]) {
+			t.Errorf("got %s %v, expected %v", k, nested[k], origNested[k])
+		}
+	}
+	for _, k := range []string{"container", "history"} {
+		if !reflect.DeepEqual(config[k], orig[k]) {
+			t.Errorf("got %s %v, expected %v", k, config[k], orig[k])
+		}
+	}
+}
+
+func TestTransformConfigsUnchanged(t *testing.T) {
+	if _, changed := transformTestConfig(t, dockerConfig, func(*ocispec.Image) error {
+		return nil
+	}); changed {
+		t.Fatal("a config the transform left alone was rewritten")
+	}
+}
+
+func TestStripHistory(t *testing.T) {
+	var orig map[string]interface{}
+	if err := json.Unmarshal([]byte(dockerConfig), &orig); err != nil {
+		t.Fatal(err)
+	}
+	config, changed := transformTestConfig(t, dockerConfig, stripHistory)
+	if !changed {
+		t.Fatal("the history was not removed")
+	}
+	if history, ok := config["history"]; ok {
+		t.Errorf("got history %v, expected none", history)
+	}
+	if !reflect.DeepEqual(config["config"], orig["config"]) {
+		t.Errorf("got config %v, expected %v", config["config"], orig["config"])
+	}
+	if config["container"] != orig["container"] {
+		t.Errorf("got container %v, expected %v", config["container"], orig["container"])
+	}
+
+	delete(orig, "history")
+	p, err := json.Marshal(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, changed := transformTestConfig(t, string(p), stripHistory); changed {
+		t.Fatal("a config without history was rewritten")
+	}
+}
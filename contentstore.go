@@ -0,0 +1,87 @@
+package cryptd
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/semaphore"
+)
+
+// limitedStore bounds the number of readers and writers open on a content store at
+// a time. Readers and writers are limited separately: encrypting or decrypting a
+// layer keeps a reader of the source blob open while writing the new one, a shared
+// limit would deadlock once every slot is held by a reader.
+type limitedStore struct {
+	content.Store
+	readers *semaphore.Weighted
+	writers *semaphore.Weighted
+}
+
+// limitContentStore returns cs with at most n readers and n writers open at a time;
+// for n < 1 cs is returned as is
+func limitContentStore(cs content.Store, n int) content.Store {
+	if n < 1 {
+		return cs
+	}
+	return &limitedStore{
+		Store:   cs,
+		readers: semaphore.NewWeighted(int64(n)),
+		writers: semaphore.NewWeighted(int64(n)),
+	}
+}
+
+func (s *limitedStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if err := s.readers.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	ra, err := s.Store.ReaderAt(ctx, desc)
+	if err != nil {
+		s.readers.Release(1)
+		return nil, err
+	}
+	return &limitedReaderAt{ReaderAt: ra, release: releaseOnce(s.readers)}, nil
+}
+
+func (s *limitedStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	if err := s.writers.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	w, err := s.Store.Writer(ctx, opts...)
+	if err != nil {
+		s.writers.Release(1)
+		return nil, err
+	}
+	return &limitedWriter{Writer: w, release: releaseOnce(s.writers)}, nil
+}
+
+// releaseOnce returns a function releasing a slot of sem on its first call only
+func releaseOnce(sem *semaphore.Weighted) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			sem.Release(1)
+		})
+	}
+}
+
+type limitedReaderAt struct {
+	content.ReaderAt
+	release func()
+}
+
+func (r *limitedReaderAt) Close() error {
+	defer r.release()
+	return r.ReaderAt.Close()
+}
+
+type limitedWriter struct {
+	content.Writer
+	release func()
+}
+
+func (w *limitedWriter) Close() error {
+	defer w.release()
+	return w.Writer.Close()
+}
@@ -2,124 +2,574 @@ package cryptd
 
 import (
 	"context"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/images"
 	imgenc "github.com/containerd/containerd/images/encryption"
 	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func New(client *containerd.Client) *CryptoClient {
-	return CryptoClient{
+func New(client *containerd.Client, opts ...ClientOpt) *CryptoClient {
+	c := &CryptoClient{
 		client: client,
+		logger: logrus.StandardLogger(),
 	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
 }
 
 type CryptoClient struct {
 	client *containerd.Client
+	logger *logrus.Logger
+}
+
+type ClientOpt func(c *CryptoClient)
+
+// WithLogger sets the logger used by the client instead of the standard logger
+func WithLogger(logger *logrus.Logger) ClientOpt {
+	return func(c *CryptoClient) {
+		c.logger = logger
+	}
 }
 
 type CryptOpt func(ctx context.Context, c *CryptOptConfig)
 
 type CryptOptConfig struct {
-	Platforms []string
-	Layers    []int32
+	Platforms          []string
+	PlatformDefaultOS  string
+	Layers             []int32
+	ExcludeLayers      []int32
+	VerifyDiffIDs      bool
+	Concurrency        int
+	ContentConcurrency int
+
+	StrictAnnotations       bool
+	StripUnknownAnnotations bool
+	MaterializeForeign      bool
+	EncryptedMediaType      func(orig string) string
+	NoLease                 bool
+	ConfigTransform         func(*ocispec.Image) error
+	GzipLevel               *int
+	Reencrypt               bool
+	LayerFilterExpr         string
+	KeyProvider             KeyProviderFunc
+	RedactLabels            []string
+	EncryptAttestations     bool
+	ImageCreateOpts         []ImageCreateOpt
+	RequireAllPlatforms     bool
+	StripHistory            bool
+	BestEffort              bool
+	BestEffortSkipped       func(ocispec.Descriptor)
+	LayerCryptoConfigs      map[int32]*encconfig.CryptoConfig
 }
 
+// ImageCreateOpt changes the image record of the new image before it is created
+type ImageCreateOpt func(ctx context.Context, image *images.Image) error
+
 func WithPlatforms(platforms []string) CryptOpt {
 	return func(ctx context.Context, c *CryptOptConfig) {
 		c.Platforms = platforms
 	}
 }
 
+// WithPlatformDefaultOS sets the OS used to complete platform specifiers
+// that only name an architecture
+func WithPlatformDefaultOS(os string) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.PlatformDefaultOS = os
+	}
+}
+
 func WithLayers(layers []int32) CryptOpt {
 	return func(ctx context.Context, c *CryptOptConfig) {
 		c.Layers = layers
 	}
 }
 
-func (c *CryptoClient) EncryptImage(ctx context.Context, image containerd.Image, name string, config *encconfig.CryptoConfig, opts ...CryptOpt) (containerd.Image, error) {
-	var optConfig CryptOptConfig
-	for _, o := range opts {
-		o(ctx, &optConfig)
+// WithExcludeLayers removes the layers from the selection of layers
+func WithExcludeLayers(layers []int32) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.ExcludeLayers = layers
+	}
+}
+
+// WithVerifyDiffIDs verifies that the DiffIDs of the decrypted layers
+// match the DiffIDs in the image config
+func WithVerifyDiffIDs() CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.VerifyDiffIDs = true
+	}
+}
+
+// WithConcurrency sets how many platforms of a multi-platform image are
+// processed in parallel; layers of a single platform are processed serially
+func WithConcurrency(n int) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.Concurrency = n
+	}
+}
+
+// WithContentConcurrency sets how many readers and how many writers may be open on
+// the content store at a time, independent of the concurrency of the platforms
+func WithContentConcurrency(n int) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.ContentConcurrency = n
+	}
+}
+
+// WithStrictAnnotations rejects encrypted layers carrying annotations that
+// are not written by the layer encryption; if strip is set these annotations
+// are removed instead
+func WithStrictAnnotations(strip bool) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.StrictAnnotations = true
+		c.StripUnknownAnnotations = strip
+	}
+}
+
+// WithMaterializeForeign fetches the content of selected foreign layers from
+// their URLs so that they are encrypted and stored as regular layers
+func WithMaterializeForeign() CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.MaterializeForeign = true
+	}
+}
+
+// WithEncryptedMediaType sets the media type of encrypted layers to the one fn
+// maps the media type of the plaintext layer to
+func WithEncryptedMediaType(fn func(orig string) string) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.EncryptedMediaType = fn
+	}
+}
+
+// WithNoLease operates without creating a lease for the content written while
+// processing the image; the content may be garbage collected before the new
+// image is created
+func WithNoLease() CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.NoLease = true
+	}
+}
+
+// WithGzipCompression gzip compresses the selected plaintext layers with level
+// before they are encrypted; by default layers keep their compression
+func WithGzipCompression(level int) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.GzipLevel = &level
+	}
+}
+
+// WithReencrypt makes RecryptImage decrypt the encrypted layers and encrypt them again
+// with a new layer key, so that only the recipients of the encrypt config can decrypt
+// them; recipients are removed this way
+func WithReencrypt() CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.Reencrypt = true
+	}
+}
+
+// WithConfigTransform applies fn to the image config of decrypted images before
+// the new image is created, e.g. to remove secrets from the environment
+func WithConfigTransform(fn func(*ocispec.Image) error) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.ConfigTransform = fn
 	}
+}
+
+// WithLayerFilterExpr further restricts the selected layers to those matching
+// the layer filter expression, e.g. "size > 100MB and platform == linux/amd64"
+func WithLayerFilterExpr(expr string) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.LayerFilterExpr = expr
+	}
+}
+
+// WithKeyProviderFunc makes DecryptImage ask fn for the candidate keys of each encrypted
+// layer when the layer is decrypted, instead of trying all keys of the config on every
+// layer; the layers are then decrypted one after the other
+func WithKeyProviderFunc(fn KeyProviderFunc) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.KeyProvider = fn
+	}
+}
+
+// WithRedactLabels removes the labels of the image from the new image whose keys are
+// one of the given keys or, for keys ending with *, start with the key's prefix
+func WithRedactLabels(keys []string) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.RedactLabels = keys
+	}
+}
+
+// WithEncryptAttestations selects the layers of attestation manifests, such as SBOMs,
+// of an index as well; by default they are passed through untouched and only the
+// layers of runnable platform manifests are selected
+func WithEncryptAttestations() CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.EncryptAttestations = true
+	}
+}
+
+// WithImageCreateOpts applies opts to the image record of the new image before it is
+// created, e.g. to add labels; when the target of an existing image is replaced all
+// fields of the record are updated
+func WithImageCreateOpts(opts ...ImageCreateOpt) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.ImageCreateOpts = append(c.ImageCreateOpts, opts...)
+	}
+}
+
+// WithRequireAllPlatforms fails on indexes referencing manifests that are not in the
+// content store; by default these platforms are skipped and kept as they are
+func WithRequireAllPlatforms() CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.RequireAllPlatforms = true
+	}
+}
+
+// WithStripHistory removes the history entries from the image configs of the new
+// image; by default the history is kept as it is
+func WithStripHistory() CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.StripHistory = true
+	}
+}
 
-	pl, err := parsePlatformArray(optConfig.Platforms)
+// WithBestEffort makes RecryptImage skip the selected encrypted layers whose layer key
+// none of the keys of the attached decrypt config unwraps, instead of failing; the
+// skipped layers are logged, passed to skipped unless it is nil, and kept as they are
+func WithBestEffort(skipped func(ocispec.Descriptor)) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		c.BestEffort = true
+		c.BestEffortSkipped = skipped
+	}
+}
+
+// WithLayerCryptoConfig makes EncryptImage encrypt the layer, numbered as for
+// WithLayers, with config instead of the config passed to EncryptImage, which may
+// then be nil to only encrypt the layers with a config of their own
+func WithLayerCryptoConfig(layer int32, config *encconfig.CryptoConfig) CryptOpt {
+	return func(ctx context.Context, c *CryptOptConfig) {
+		if c.LayerCryptoConfigs == nil {
+			c.LayerCryptoConfigs = make(map[int32]*encconfig.CryptoConfig)
+		}
+		c.LayerCryptoConfigs[layer] = config
+	}
+}
+
+func (c *CryptoClient) EncryptImage(ctx context.Context, image containerd.Image, name string, config *encconfig.CryptoConfig, opts ...CryptOpt) (containerd.Image, error) {
+	ctx, span := tracer.Start(ctx, "EncryptImage", trace.WithAttributes(attribute.String("image", image.Name())))
+	defer span.End()
+
+	optConfig := newCryptOptConfig(ctx, opts)
+
+	lf, err := c.layerFilter(ctx, image.Target(), optConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	lf, err := c.createLayerFilter(ctx, image.Target(), optConfig.Layers, pl)
+	ctx, done, err := c.withLease(ctx, optConfig)
 	if err != nil {
 		return nil, err
 	}
+	defer done(ctx)
 
-	ctx, done, err := c.client.WithLease(ctx)
+	cs := limitContentStore(image.ContentStore(), optConfig.ContentConcurrency)
+	target, _, err := rewriteManifests(ctx, cs, image.Target(), normalizeAnnotations())
 	if err != nil {
 		return nil, err
 	}
-	defer done(ctx)
+	if optConfig.MaterializeForeign {
+		if target, _, err = rewriteManifests(ctx, cs, target, materializeForeign(http.DefaultClient, lf)); err != nil {
+			return nil, err
+		}
+	} else {
+		foreign, err := selectedForeignLayers(ctx, cs, target, lf)
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range foreign {
+			c.logger.WithFields(logrus.Fields{
+				"layer":     layer.Digest,
+				"mediaType": layer.MediaType,
+				"platform":  formatPlatform(layer.Platform),
+			}).Warn("foreign layer is not encrypted; materialize foreign layers to encrypt them")
+		}
+	}
+	if optConfig.GzipLevel != nil {
+		recompressed := make(map[digest.Digest]bool)
+		if target, _, err = rewriteManifests(ctx, cs, target, recompressLayers(*optConfig.GzipLevel, lf, recompressed)); err != nil {
+			return nil, err
+		}
+		selected := lf
+		lf = func(desc ocispec.Descriptor) bool {
+			return recompressed[desc.Digest] || selected(desc)
+		}
+	}
 
-	desc, modified, err := imgenc.EncryptImage(ctx, image.ContentStore(), image.Target(), config, lf)
+	fn := func(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+		return imgenc.EncryptImage(ctx, cs, desc, config, lf)
+	}
+	if len(optConfig.LayerCryptoConfigs) > 0 {
+		if fn, err = c.layerConfigEncryptFunc(ctx, cs, target, config, lf, optConfig); err != nil {
+			return nil, err
+		}
+	}
+	desc, modified, err := cryptPlatforms(ctx, cs, target, optConfig.Concurrency, fn)
 	if err != nil {
 		return nil, err
 	}
 	if !modified {
 		return image, nil
 	}
+	if optConfig.EncryptedMediaType != nil {
+		if desc, _, err = rewriteManifests(ctx, cs, desc, mapEncryptedMediaTypes(optConfig.EncryptedMediaType)); err != nil {
+			return nil, err
+		}
+	}
+	if optConfig.StrictAnnotations {
+		if desc, _, err = rewriteManifests(ctx, cs, desc, checkAnnotations(optConfig.StripUnknownAnnotations)); err != nil {
+			return nil, err
+		}
+	}
+	if optConfig.StripHistory {
+		if desc, _, err = rewriteManifests(ctx, cs, desc, transformConfigs(stripHistory)); err != nil {
+			return nil, err
+		}
+	}
+	return c.createImage(ctx, image, name, desc, optConfig)
+}
 
-	newImage := images.Image{
-		Name:   name,
-		Target: desc,
-		Labels: image.Labels(),
+func (c *CryptoClient) DecryptImage(ctx context.Context, image containerd.Image, name string, config *encconfig.CryptoConfig, opts ...CryptOpt) (containerd.Image, error) {
+	ctx, span := tracer.Start(ctx, "DecryptImage", trace.WithAttributes(attribute.String("image", image.Name())))
+	defer span.End()
+
+	optConfig := newCryptOptConfig(ctx, opts)
+
+	lf, err := c.layerFilter(ctx, image.Target(), optConfig)
+	if err != nil {
+		return nil, err
 	}
 
-	s := c.client.ImageService()
-	i, err := s.Create(ctx, newImage)
+	ctx, done, err := c.withLease(ctx, optConfig)
 	if err != nil {
 		return nil, err
 	}
-	return containerd.NewImage(c.client, i)
-}
+	defer done(ctx)
 
-func (c *CryptoClient) DecryptImage(ctx context.Context, image containerd.Image, name string, config *encconfig.CryptoConfig, opts ...CryptOpt) (containerd.Image, error) {
-	var optConfig CryptOptConfig
-	for _, o := range opts {
-		o(ctx, &optConfig)
+	cs := limitContentStore(image.ContentStore(), optConfig.ContentConcurrency)
+	target, _, err := rewriteManifests(ctx, cs, image.Target(), normalizeAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	if optConfig.StrictAnnotations {
+		if target, _, err = rewriteManifests(ctx, cs, target, checkAnnotations(optConfig.StripUnknownAnnotations)); err != nil {
+			return nil, err
+		}
 	}
 
-	pl, err := parsePlatformArray(optConfig.Platforms)
+	desc, modified, err := cryptPlatforms(ctx, cs, target, optConfig.Concurrency, func(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+		if optConfig.KeyProvider != nil {
+			return decryptWithKeyProvider(ctx, cs, desc, config, encryptedOnly(lf), optConfig.KeyProvider)
+		}
+		return imgenc.DecryptImage(ctx, cs, desc, config, encryptedOnly(lf))
+	})
 	if err != nil {
 		return nil, err
 	}
+	if !modified {
+		return image, nil
+	}
+	if optConfig.VerifyDiffIDs {
+		if err := verifyDiffIDs(ctx, cs, target, desc); err != nil {
+			return nil, err
+		}
+	}
+	if optConfig.ConfigTransform != nil {
+		if desc, _, err = rewriteManifests(ctx, cs, desc, transformConfigs(optConfig.ConfigTransform)); err != nil {
+			return nil, err
+		}
+	}
+	if optConfig.StripHistory {
+		if desc, _, err = rewriteManifests(ctx, cs, desc, transformConfigs(stripHistory)); err != nil {
+			return nil, err
+		}
+	}
+	return c.createImage(ctx, image, name, desc, optConfig)
+}
 
-	lf, err := c.createLayerFilter(ctx, image.Target(), optConfig.Layers, pl)
+// EncryptDescriptor encrypts the layers selected by lf of the image rooted at desc in
+// store. No image is created and no lease is taken; callers have to protect the
+// written content from garbage collection themselves.
+func (c *CryptoClient) EncryptDescriptor(ctx context.Context, store content.Store, desc ocispec.Descriptor, cfg *encconfig.CryptoConfig, lf imgenc.LayerFilter) (ocispec.Descriptor, bool, error) {
+	return imgenc.EncryptImage(ctx, store, desc, cfg, lf)
+}
+
+// DecryptDescriptor decrypts the encrypted layers selected by lf of the image rooted
+// at desc in store; like EncryptDescriptor it neither creates an image nor takes a lease
+func (c *CryptoClient) DecryptDescriptor(ctx context.Context, store content.Store, desc ocispec.Descriptor, cfg *encconfig.CryptoConfig, lf imgenc.LayerFilter) (ocispec.Descriptor, bool, error) {
+	return imgenc.DecryptImage(ctx, store, desc, cfg, encryptedOnly(lf))
+}
+
+// RecryptImage adds the recipients of config to the encrypted layers of the image; the
+// decrypt config attached to its encrypt config must unwrap the keys of these layers.
+// Only the wrapped keys in the layer annotations are rewritten, the layer blobs are
+// kept byte for byte, which is verified before the new image is created. With
+// WithReencrypt the layers are encrypted anew for the recipients of config instead.
+func (c *CryptoClient) RecryptImage(ctx context.Context, image containerd.Image, name string, config *encconfig.CryptoConfig, opts ...CryptOpt) (containerd.Image, error) {
+	ctx, span := tracer.Start(ctx, "RecryptImage", trace.WithAttributes(attribute.String("image", image.Name())))
+	defer span.End()
+
+	optConfig := newCryptOptConfig(ctx, opts)
+
+	lf, err := c.layerFilter(ctx, image.Target(), optConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, done, err := c.client.WithLease(ctx)
+	ctx, done, err := c.withLease(ctx, optConfig)
 	if err != nil {
 		return nil, err
 	}
 	defer done(ctx)
 
-	desc, modified, err := imgenc.DecryptImage(ctx, image.ContentStore(), image.Target(), config, lf)
+	cs := limitContentStore(image.ContentStore(), optConfig.ContentConcurrency)
+	target, _, err := rewriteManifests(ctx, cs, image.Target(), normalizeAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	if optConfig.BestEffort {
+		lf = c.accessibleOnly(&config.EncryptConfig.DecryptConfig, lf, optConfig.BestEffortSkipped)
+	}
+	fn := func(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+		return imgenc.EncryptImage(ctx, cs, desc, config, encryptedOnly(lf))
+	}
+	if optConfig.Reencrypt {
+		fn = func(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+			return reencrypt(ctx, cs, desc, config, encryptedOnly(lf))
+		}
+	}
+	desc, modified, err := cryptPlatforms(ctx, cs, target, optConfig.Concurrency, fn)
 	if err != nil {
 		return nil, err
 	}
 	if !modified {
 		return image, nil
 	}
+	if optConfig.Reencrypt {
+		err = verifyReencrypted(ctx, cs, target, desc, config, encryptedOnly(lf))
+	} else {
+		err = verifyBlobsUnchanged(ctx, cs, target, desc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if optConfig.StrictAnnotations {
+		if desc, _, err = rewriteManifests(ctx, cs, desc, checkAnnotations(optConfig.StripUnknownAnnotations)); err != nil {
+			return nil, err
+		}
+	}
+	return c.createImage(ctx, image, name, desc, optConfig)
+}
 
+func newCryptOptConfig(ctx context.Context, opts []CryptOpt) *CryptOptConfig {
+	var optConfig CryptOptConfig
+	for _, o := range opts {
+		o(ctx, &optConfig)
+	}
+	return &optConfig
+}
+
+// withLease creates a lease keeping the content written while processing the image
+// from being garbage collected, unless leases are disabled
+func (c *CryptoClient) withLease(ctx context.Context, optConfig *CryptOptConfig) (context.Context, func(context.Context) error, error) {
+	if optConfig.NoLease {
+		c.logger.Warn("operating without a lease; content written may be garbage collected before the image is created")
+		return ctx, func(context.Context) error {
+			return nil
+		}, nil
+	}
+	ctx, done, err := c.client.WithLease(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the lease is removed even when ctx was cancelled, so that the partially
+	// written content is garbage collected
+	return ctx, func(ctx context.Context) error {
+		return done(detachedContext{ctx})
+	}, nil
+}
+
+// detachedContext keeps the values of its parent, such as the namespace and the
+// lease, but is never cancelled
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
+
+// createImage registers the image with the new target under name; if name is the
+// name of the image its target is replaced instead
+func (c *CryptoClient) createImage(ctx context.Context, image containerd.Image, name string, desc ocispec.Descriptor, optConfig *CryptOptConfig) (containerd.Image, error) {
+	ctx, span := tracer.Start(ctx, "create image", trace.WithAttributes(attribute.String("image", name)))
+	defer span.End()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	newImage := images.Image{
 		Name:   name,
 		Target: desc,
-		Labels: image.Labels(),
+		Labels: redactLabels(image.Labels(), optConfig.RedactLabels),
+	}
+	for _, o := range optConfig.ImageCreateOpts {
+		if err := o(ctx, &newImage); err != nil {
+			return nil, err
+		}
 	}
 
+	c.logger.WithFields(logrus.Fields{
+		"image":  name,
+		"target": desc.Digest,
+	}).Debug("creating image")
 	s := c.client.ImageService()
+	if name == image.Name() {
+		fieldpaths := []string{"target", "labels"}
+		if len(optConfig.ImageCreateOpts) > 0 {
+			fieldpaths = nil
+		}
+		i, err := s.Update(ctx, newImage, fieldpaths...)
+		if err != nil {
+			return nil, err
+		}
+		return containerd.NewImage(c.client, i)
+	}
 	i, err := s.Create(ctx, newImage)
 	if err != nil {
 		return nil, err
@@ -127,13 +577,84 @@ func (c *CryptoClient) DecryptImage(ctx context.Context, image containerd.Image,
 	return containerd.NewImage(c.client, i)
 }
 
-func (c *CryptoClient) createLayerFilter(ctx context.Context, desc ocispec.Descriptor, layers []int32, platformList []ocispec.Platform) (imgenc.LayerFilter, error) {
-	alldescs, err := images.GetImageLayerDescriptors(ctx, client.ContentStore(), desc)
+// redactLabels returns a copy of the labels without the ones matching keys, as
+// described for WithRedactLabels
+func redactLabels(labels map[string]string, keys []string) map[string]string {
+	if len(keys) == 0 {
+		return labels
+	}
+	redacted := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if !matchLabelKey(k, keys) {
+			redacted[k] = v
+		}
+	}
+	return redacted
+}
+
+func matchLabelKey(label string, keys []string) bool {
+	for _, k := range keys {
+		if prefix := strings.TrimSuffix(k, "*"); prefix != k {
+			if strings.HasPrefix(label, prefix) {
+				return true
+			}
+		} else if label == k {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CryptoClient) layerFilter(ctx context.Context, desc ocispec.Descriptor, optConfig *CryptOptConfig) (imgenc.LayerFilter, error) {
+	pl, err := ParsePlatformArray(optConfig.Platforms, optConfig.PlatformDefaultOS)
+	if err != nil {
+		return nil, err
+	}
+	var pred layerPredicate
+	if optConfig.LayerFilterExpr != "" {
+		if pred, err = compileLayerFilterExpr(optConfig.LayerFilterExpr); err != nil {
+			return nil, err
+		}
+	}
+	if !optConfig.EncryptAttestations {
+		skip, err := attestationLayers(ctx, c.client.ContentStore(), desc)
+		if err != nil {
+			return nil, err
+		}
+		if len(skip) > 0 {
+			exprPred := pred
+			pred = func(d ocispec.Descriptor) bool {
+				return !skip[d.Digest] && (exprPred == nil || exprPred(d))
+			}
+		}
+	}
+	return c.createLayerFilter(ctx, desc, optConfig.Layers, optConfig.ExcludeLayers, pl, pred, optConfig.RequireAllPlatforms)
+}
+
+// createLayerFilter selects the layers by index and platform; if pred is set
+// the selected layers must match it as well. Platforms whose manifests are not
+// available locally are skipped with a warning unless requireAll is set.
+func (c *CryptoClient) createLayerFilter(ctx context.Context, desc ocispec.Descriptor, layers, excludeLayers []int32, platformList []ocispec.Platform, pred layerPredicate, requireAll bool) (imgenc.LayerFilter, error) {
+	_, descs, skipped, err := SelectLayerDescriptors(ctx, c.client.ContentStore(), desc, layers, excludeLayers, platformList, requireAll)
 	if err != nil {
 		return nil, err
 	}
+	for _, m := range skipped {
+		c.logger.WithFields(logrus.Fields{
+			"manifest": m.Digest,
+			"platform": formatPlatform(m.Platform),
+		}).Warn("skipping platform whose manifest is not available locally")
+	}
 
-	_, descs := filterLayerDescriptors(alldescs, layers, platformList)
+	if pred != nil {
+		var matched []ocispec.Descriptor
+		for _, d := range descs {
+			if pred(d) {
+				matched = append(matched, d)
+			}
+		}
+		descs = matched
+	}
 
 	lf := func(d ocispec.Descriptor) bool {
 		for _, desc := range descs {
@@ -0,0 +1,330 @@
+package cryptd
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// layerPredicate selects layers by their descriptor, including its platform
+type layerPredicate func(desc ocispec.Descriptor) bool
+
+// compileLayerFilterExpr compiles a layer filter expression into a predicate. The
+// grammar is:
+//
+//	expr       = and { ("or" | "||") and }
+//	and        = not { ("and" | "&&") not }
+//	not        = ("not" | "!") not | "(" expr ")" | comparison | "encrypted"
+//	comparison = field op value
+//	field      = "size" | "mediaType" | "digest" | "platform" | "encrypted"
+//	op         = "==" | "!=" | "<" | "<=" | ">" | ">=" | "contains"
+//
+// Values are bare words or double quoted strings. Sizes may have one of the units
+// B, KB, MB, GB, TB or KiB, MiB, GiB, TiB; only size supports the ordering operators
+// and contains applies to the string fields. For example:
+//
+//	size > 100MB and mediaType contains gzip and platform == linux/amd64
+func compileLayerFilterExpr(expr string) (layerPredicate, error) {
+	tokens, err := tokenizeFilterExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterExprParser{tokens: tokens}
+	pred, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, errors.Errorf("unexpected %q in layer filter expression", p.peek().text)
+	}
+	return pred, nil
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+// filterOperators are the operator tokens, longest first
+var filterOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+func tokenizeFilterExpr(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+			continue
+		case c == '"':
+			end := strings.IndexByte(expr[i+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated string in layer filter expression")
+			}
+			tokens = append(tokens, filterToken{text: expr[i+1 : i+1+end], quoted: true})
+			i += end + 2
+			continue
+		}
+		var op string
+		for _, o := range filterOperators {
+			if strings.HasPrefix(expr[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op != "" {
+			tokens = append(tokens, filterToken{text: op})
+			i += len(op)
+			continue
+		}
+		start := i
+		for i < len(expr) && !unicode.IsSpace(rune(expr[i])) && !strings.ContainsRune(`()"=!<>&|`, rune(expr[i])) {
+			i++
+		}
+		tokens = append(tokens, filterToken{text: expr[start:i]})
+	}
+	return tokens, nil
+}
+
+type filterExprParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterExprParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *filterExprParser) peek() filterToken {
+	if p.done() {
+		return filterToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterExprParser) next() (filterToken, error) {
+	if p.done() {
+		return filterToken{}, errors.New("unexpected end of layer filter expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+// accept consumes the next token if it is one of the keywords
+func (p *filterExprParser) accept(keywords ...string) bool {
+	t := p.peek()
+	if p.done() || t.quoted {
+		return false
+	}
+	for _, k := range keywords {
+		if strings.EqualFold(t.text, k) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *filterExprParser) parseOr() (layerPredicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or", "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(desc ocispec.Descriptor) bool {
+			return l(desc) || right(desc)
+		}
+	}
+	return left, nil
+}
+
+func (p *filterExprParser) parseAnd() (layerPredicate, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and", "&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(desc ocispec.Descriptor) bool {
+			return l(desc) && right(desc)
+		}
+	}
+	return left, nil
+}
+
+func (p *filterExprParser) parseNot() (layerPredicate, error) {
+	if p.accept("not", "!") {
+		pred, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(desc ocispec.Descriptor) bool {
+			return !pred(desc)
+		}, nil
+	}
+	if p.accept("(") {
+		pred, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, errors.New("missing ) in layer filter expression")
+		}
+		return pred, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterExprParser) parseComparison() (layerPredicate, error) {
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(field.text)
+	if name == "encrypted" && !p.isOperator() {
+		return func(desc ocispec.Descriptor) bool {
+			return IsEncryptedMediaType(desc.MediaType)
+		}, nil
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	opName := strings.ToLower(op.text)
+
+	switch name {
+	case "size":
+		size, err := parseSize(value.text)
+		if err != nil {
+			return nil, err
+		}
+		return compareSize(opName, size)
+	case "mediatype":
+		return compareString(opName, value.text, func(desc ocispec.Descriptor) string {
+			return desc.MediaType
+		})
+	case "digest":
+		return compareString(opName, value.text, func(desc ocispec.Descriptor) string {
+			return desc.Digest.String()
+		})
+	case "platform":
+		v := value.text
+		if opName != "contains" {
+			spec, err := platforms.Parse(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid platform %s in layer filter expression", v)
+			}
+			v = platforms.Format(platforms.Normalize(spec))
+		}
+		return compareString(opName, v, func(desc ocispec.Descriptor) string {
+			if desc.Platform == nil {
+				return ""
+			}
+			return platforms.Format(platforms.Normalize(*desc.Platform))
+		})
+	case "encrypted":
+		want, err := strconv.ParseBool(value.text)
+		if err != nil {
+			return nil, errors.Errorf("invalid value %s for encrypted in layer filter expression", value.text)
+		}
+		if opName != "==" && opName != "!=" {
+			return nil, errors.Errorf("operator %s cannot be used with encrypted", op.text)
+		}
+		return func(desc ocispec.Descriptor) bool {
+			return (IsEncryptedMediaType(desc.MediaType) == want) == (opName == "==")
+		}, nil
+	}
+	return nil, errors.Errorf("unknown field %s in layer filter expression", field.text)
+}
+
+// isOperator checks whether the next token is a comparison operator
+func (p *filterExprParser) isOperator() bool {
+	t := p.peek()
+	if p.done() || t.quoted {
+		return false
+	}
+	switch strings.ToLower(t.text) {
+	case "==", "!=", "<", "<=", ">", ">=", "contains":
+		return true
+	}
+	return false
+}
+
+func compareSize(op string, size int64) (layerPredicate, error) {
+	var cmp func(a, b int64) bool
+	switch op {
+	case "==":
+		cmp = func(a, b int64) bool { return a == b }
+	case "!=":
+		cmp = func(a, b int64) bool { return a != b }
+	case "<":
+		cmp = func(a, b int64) bool { return a < b }
+	case "<=":
+		cmp = func(a, b int64) bool { return a <= b }
+	case ">":
+		cmp = func(a, b int64) bool { return a > b }
+	case ">=":
+		cmp = func(a, b int64) bool { return a >= b }
+	default:
+		return nil, errors.Errorf("operator %s cannot be used with size", op)
+	}
+	return func(desc ocispec.Descriptor) bool {
+		return cmp(desc.Size, size)
+	}, nil
+}
+
+func compareString(op, value string, field func(ocispec.Descriptor) string) (layerPredicate, error) {
+	switch op {
+	case "==":
+		return func(desc ocispec.Descriptor) bool { return field(desc) == value }, nil
+	case "!=":
+		return func(desc ocispec.Descriptor) bool { return field(desc) != value }, nil
+	case "contains":
+		return func(desc ocispec.Descriptor) bool { return strings.Contains(field(desc), value) }, nil
+	}
+	return nil, errors.Errorf("operator %s can only be used with size", op)
+}
+
+// sizeUnits are the units of sizes in layer filter expressions, longest first
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12},
+	{"b", 1},
+}
+
+func parseSize(s string) (int64, error) {
+	lower := strings.ToLower(s)
+	factor := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, factor = strings.TrimSuffix(lower, u.suffix), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(lower, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid size %s in layer filter expression", s)
+	}
+	return int64(n * float64(factor)), nil
+}
@@ -0,0 +1,98 @@
+package cryptd
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	imgenc "github.com/containerd/containerd/images/encryption"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// foreignMediaTypes maps the media types of foreign layers to the media type
+// of the regular layer with the same content
+var foreignMediaTypes = map[string]string{
+	images.MediaTypeDockerSchema2LayerForeign:       images.MediaTypeDockerSchema2Layer,
+	images.MediaTypeDockerSchema2LayerForeignGzip:   images.MediaTypeDockerSchema2LayerGzip,
+	ocispec.MediaTypeImageLayerNonDistributable:     ocispec.MediaTypeImageLayer,
+	ocispec.MediaTypeImageLayerNonDistributableGzip: ocispec.MediaTypeImageLayerGzip,
+}
+
+// selectedForeignLayers returns the foreign layers of the image rooted at desc selected
+// by lf. The layer encryption passes foreign layers, such as the base layers of Windows
+// images, through unencrypted; they have to be materialized first.
+func selectedForeignLayers(ctx context.Context, cs content.Store, desc ocispec.Descriptor, lf imgenc.LayerFilter) ([]ocispec.Descriptor, error) {
+	layers, _, err := LayerDescriptors(ctx, cs, desc, false)
+	if err != nil {
+		return nil, err
+	}
+	var foreign []ocispec.Descriptor
+	for _, layer := range layers {
+		if _, ok := foreignMediaTypes[layer.MediaType]; ok && lf(layer) {
+			foreign = append(foreign, layer)
+		}
+	}
+	return foreign, nil
+}
+
+// materializeForeign returns a manifestFunc that fetches the content of the foreign
+// layers selected by lf from their URLs and rewrites them as regular layers so that
+// they can be encrypted
+func materializeForeign(client *http.Client, lf imgenc.LayerFilter) manifestFunc {
+	return func(ctx context.Context, cs content.Store, m *ocispec.Manifest) (bool, error) {
+		var modified bool
+		for i, layer := range m.Layers {
+			mediaType, ok := foreignMediaTypes[layer.MediaType]
+			if !ok || !lf(layer) {
+				continue
+			}
+			if _, err := cs.Info(ctx, layer.Digest); err != nil {
+				if !errdefs.IsNotFound(err) {
+					return false, err
+				}
+				if err := fetchForeign(ctx, client, cs, layer); err != nil {
+					return false, err
+				}
+			}
+			m.Layers[i].MediaType = mediaType
+			m.Layers[i].URLs = nil
+			modified = true
+		}
+		return modified, nil
+	}
+}
+
+// fetchForeign fetches the content of a foreign layer from the first of its URLs that works
+func fetchForeign(ctx context.Context, client *http.Client, cs content.Store, desc ocispec.Descriptor) error {
+	if len(desc.URLs) == 0 {
+		return errors.Errorf("foreign layer %s has no urls", desc.Digest)
+	}
+	var err error
+	for _, url := range desc.URLs {
+		if err = fetchURL(ctx, client, cs, url, desc); err == nil {
+			return nil
+		}
+	}
+	return errors.Wrapf(err, "failed to fetch foreign layer %s", desc.Digest)
+}
+
+func fetchURL(ctx context.Context, client *http.Client, cs content.Store, url string, desc ocispec.Descriptor) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %s fetching %s", resp.Status, url)
+	}
+	// the size and digest of the fetched content are verified against desc
+	return content.WriteBlob(ctx, cs, "foreign-"+desc.Digest.String(), resp.Body, desc)
+}
@@ -0,0 +1,75 @@
+package cryptd
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	imgenc "github.com/containerd/containerd/images/encryption"
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// KeyProviderFunc returns the candidate private keys, and the passwords of these keys,
+// for decrypting the encrypted layer; no keys skip the keys of the provider for it
+type KeyProviderFunc func(layerDesc ocispec.Descriptor) (privKeys [][]byte, passwords [][]byte, err error)
+
+// decryptWithKeyProvider decrypts the encrypted layers selected by lf of the image rooted
+// at desc one at a time, each with the keys of config and the ones provider returns for
+// the layer, so that only the keys of the layer being decrypted are held in memory
+func decryptWithKeyProvider(ctx context.Context, cs content.Store, desc ocispec.Descriptor, config *encconfig.CryptoConfig, lf imgenc.LayerFilter, provider KeyProviderFunc) (ocispec.Descriptor, bool, error) {
+	layers, _, err := LayerDescriptors(ctx, cs, desc, false)
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+
+	var (
+		modified bool
+		seen     = make(map[string]bool)
+	)
+	for _, layer := range layers {
+		if !lf(layer) || seen[layer.Digest.String()] {
+			continue
+		}
+		seen[layer.Digest.String()] = true
+
+		privKeys, passwords, err := provider(layer)
+		if err != nil {
+			return ocispec.Descriptor{}, false, errors.Wrapf(err, "could not get the keys of layer %s", layer.Digest)
+		}
+		if len(passwords) != 0 && len(passwords) != len(privKeys) {
+			return ocispec.Descriptor{}, false, errors.Errorf("key provider returned %d passwords for %d keys of layer %s", len(passwords), len(privKeys), layer.Digest)
+		}
+		dgst := layer.Digest
+		layerConfig := withProvidedKeys(config, privKeys, passwords)
+		newDesc, layerModified, err := imgenc.DecryptImage(ctx, cs, desc, layerConfig, func(d ocispec.Descriptor) bool {
+			return d.Digest == dgst
+		})
+		if err != nil {
+			return ocispec.Descriptor{}, false, err
+		}
+		if layerModified {
+			desc, modified = newDesc, true
+		}
+	}
+	return desc, modified, nil
+}
+
+// withProvidedKeys returns a copy of config whose decrypt config holds the private keys
+// in addition to its own; keys without password get an empty one
+func withProvidedKeys(config *encconfig.CryptoConfig, privKeys, passwords [][]byte) *encconfig.CryptoConfig {
+	params := make(map[string][][]byte)
+	if config != nil && config.DecryptConfig != nil {
+		for k, v := range config.DecryptConfig.Parameters {
+			params[k] = append([][]byte{}, v...)
+		}
+	}
+	if len(passwords) == 0 {
+		passwords = make([][]byte, len(privKeys))
+	}
+	params["privkeys"] = append(params["privkeys"], privKeys...)
+	params["privkeys-passwords"] = append(params["privkeys-passwords"], passwords...)
+	return &encconfig.CryptoConfig{
+		DecryptConfig: &encconfig.DecryptConfig{Parameters: params},
+	}
+}
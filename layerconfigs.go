@@ -0,0 +1,76 @@
+package cryptd
+
+import (
+	"context"
+	"sort"
+
+	"github.com/containerd/containerd/content"
+	imgenc "github.com/containerd/containerd/images/encryption"
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layerConfigEncryptFunc returns the cryptFunc encrypting the layers selected by lf that
+// have a crypto config of their own with that config, and the other selected layers with
+// config; with a nil config only the layers with their own config are encrypted. The
+// layer numbers of the configs are resolved against the image rooted at target.
+func (c *CryptoClient) layerConfigEncryptFunc(ctx context.Context, cs content.Store, target ocispec.Descriptor, config *encconfig.CryptoConfig, lf imgenc.LayerFilter, optConfig *CryptOptConfig) (cryptFunc, error) {
+	pl, err := ParsePlatformArray(optConfig.Platforms, optConfig.PlatformDefaultOS)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := make([]int32, 0, len(optConfig.LayerCryptoConfigs))
+	for layer := range optConfig.LayerCryptoConfigs {
+		layers = append(layers, layer)
+	}
+	sort.Slice(layers, func(i, j int) bool { return layers[i] < layers[j] })
+
+	var (
+		configs = make([]*encconfig.CryptoConfig, len(layers))
+		filters = make([]imgenc.LayerFilter, len(layers))
+	)
+	for i, layer := range layers {
+		layerFilter, err := c.createLayerFilter(ctx, target, []int32{layer}, nil, pl, nil, optConfig.RequireAllPlatforms)
+		if err != nil {
+			return nil, err
+		}
+		configs[i] = optConfig.LayerCryptoConfigs[layer]
+		filters[i] = func(desc ocispec.Descriptor) bool {
+			return lf(desc) && layerFilter(desc)
+		}
+	}
+	rest := func(desc ocispec.Descriptor) bool {
+		for _, f := range filters {
+			if f(desc) {
+				return false
+			}
+		}
+		return lf(desc)
+	}
+
+	return func(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+		var modified bool
+		if config != nil {
+			newDesc, m, err := imgenc.EncryptImage(ctx, cs, desc, config, rest)
+			if err != nil {
+				return ocispec.Descriptor{}, false, err
+			}
+			if m {
+				desc, modified = newDesc, true
+			}
+		}
+		// layers encrypted by an earlier pass have new digests, so no layer
+		// is encrypted twice
+		for i, cfg := range configs {
+			newDesc, m, err := imgenc.EncryptImage(ctx, cs, desc, cfg, filters[i])
+			if err != nil {
+				return ocispec.Descriptor{}, false, err
+			}
+			if m {
+				desc, modified = newDesc, true
+			}
+		}
+		return desc, modified, nil
+	}, nil
+}
@@ -0,0 +1,163 @@
+package cryptd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// manifest keeps the media type field of Docker manifests which is not part of ocispec.Manifest
+type manifest struct {
+	MediaType string `json:"mediaType,omitempty"`
+	ocispec.Manifest
+}
+
+// index keeps the media type field of Docker manifest lists which is not part of ocispec.Index
+type index struct {
+	MediaType string `json:"mediaType,omitempty"`
+	ocispec.Index
+}
+
+// manifestFunc updates a manifest in place and reports whether it was modified
+type manifestFunc func(ctx context.Context, cs content.Store, m *ocispec.Manifest) (bool, error)
+
+func isManifestMediaType(mediaType string) bool {
+	return mediaType == images.MediaTypeDockerSchema2Manifest || mediaType == ocispec.MediaTypeImageManifest
+}
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == images.MediaTypeDockerSchema2ManifestList || mediaType == ocispec.MediaTypeImageIndex
+}
+
+// readManifests returns all manifests referenced by desc, which may either be
+// a manifest or an index
+func readManifests(ctx context.Context, cs content.Store, desc ocispec.Descriptor) ([]ocispec.Manifest, error) {
+	switch {
+	case isManifestMediaType(desc.MediaType):
+		var m manifest
+		if err := readJSON(ctx, cs, desc, &m); err != nil {
+			return nil, err
+		}
+		return []ocispec.Manifest{m.Manifest}, nil
+	case isIndexMediaType(desc.MediaType):
+		var idx index
+		if err := readJSON(ctx, cs, desc, &idx); err != nil {
+			return nil, err
+		}
+		var manifests []ocispec.Manifest
+		for _, child := range idx.Manifests {
+			if !isManifestMediaType(child.MediaType) && !isIndexMediaType(child.MediaType) {
+				continue
+			}
+			if _, err := cs.Info(ctx, child.Digest); errdefs.IsNotFound(err) {
+				// the platform is not available locally
+				continue
+			}
+			m, err := readManifests(ctx, cs, child)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, m...)
+		}
+		return manifests, nil
+	}
+	return nil, errors.Errorf("unsupported media type %s", desc.MediaType)
+}
+
+// rewriteManifests applies fn to every manifest referenced by desc and writes the
+// modified manifests, and the indexes referencing them, to the content store
+func rewriteManifests(ctx context.Context, cs content.Store, desc ocispec.Descriptor, fn manifestFunc) (ocispec.Descriptor, bool, error) {
+	switch {
+	case isManifestMediaType(desc.MediaType):
+		var m manifest
+		if err := readJSON(ctx, cs, desc, &m); err != nil {
+			return ocispec.Descriptor{}, false, err
+		}
+		modified, err := fn(ctx, cs, &m.Manifest)
+		if err != nil || !modified {
+			return desc, false, err
+		}
+		children := append([]ocispec.Descriptor{m.Config}, m.Layers...)
+		newDesc, err := writeJSON(ctx, cs, desc, &m, children)
+		if err != nil {
+			return ocispec.Descriptor{}, false, err
+		}
+		return newDesc, true, nil
+	case isIndexMediaType(desc.MediaType):
+		var idx index
+		if err := readJSON(ctx, cs, desc, &idx); err != nil {
+			return ocispec.Descriptor{}, false, err
+		}
+		var modified bool
+		for i, child := range idx.Manifests {
+			if !isManifestMediaType(child.MediaType) && !isIndexMediaType(child.MediaType) {
+				continue
+			}
+			if _, err := cs.Info(ctx, child.Digest); errdefs.IsNotFound(err) {
+				// the platform is not available locally and is kept as it is
+				continue
+			}
+			newChild, childModified, err := rewriteManifests(ctx, cs, child, fn)
+			if err != nil {
+				return ocispec.Descriptor{}, false, err
+			}
+			if childModified {
+				idx.Manifests[i] = newChild
+				modified = true
+			}
+		}
+		if !modified {
+			return desc, false, nil
+		}
+		newDesc, err := writeJSON(ctx, cs, desc, &idx, idx.Manifests)
+		if err != nil {
+			return ocispec.Descriptor{}, false, err
+		}
+		return newDesc, true, nil
+	}
+	return ocispec.Descriptor{}, false, errors.Errorf("unsupported media type %s", desc.MediaType)
+}
+
+func readJSON(ctx context.Context, cs content.Store, desc ocispec.Descriptor, v interface{}) error {
+	p, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(p, v); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal %s", desc.Digest)
+	}
+	return nil
+}
+
+// writeJSON writes v as the replacement of the blob described by orig and labels it
+// so that the children it references are not garbage collected
+func writeJSON(ctx context.Context, cs content.Store, orig ocispec.Descriptor, v interface{}, children []ocispec.Descriptor) (ocispec.Descriptor, error) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType:   orig.MediaType,
+		Digest:      digest.FromBytes(p),
+		Size:        int64(len(p)),
+		Platform:    orig.Platform,
+		Annotations: orig.Annotations,
+	}
+	labels := make(map[string]string)
+	for i, child := range children {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.%d", i)] = child.Digest.String()
+	}
+	ref := fmt.Sprintf("cryptd-%s", desc.Digest)
+	if err := content.WriteBlob(ctx, cs, ref, bytes.NewReader(p), desc, content.WithLabels(labels)); err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to write %s", desc.Digest)
+	}
+	return desc, nil
+}
@@ -0,0 +1,70 @@
+package cryptd
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	imgenc "github.com/containerd/containerd/images/encryption"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// IsEncryptedMediaType checks whether the layer media type is one of an encrypted layer
+func IsEncryptedMediaType(mediaType string) bool {
+	switch mediaType {
+	case images.MediaTypeDockerSchema2LayerEnc, images.MediaTypeDockerSchema2LayerGzipEnc:
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+encrypted")
+}
+
+// encryptedOnly restricts the layer filter to encrypted layers so that
+// plaintext layers of an image pass through decryption untouched
+func encryptedOnly(lf imgenc.LayerFilter) imgenc.LayerFilter {
+	return func(desc ocispec.Descriptor) bool {
+		return IsEncryptedMediaType(desc.MediaType) && lf(desc)
+	}
+}
+
+// plaintextMediaType returns the media type of the layer before it was encrypted
+func plaintextMediaType(mediaType string) string {
+	if mediaType == images.MediaTypeDockerSchema2LayerEnc {
+		return images.MediaTypeDockerSchema2Layer
+	}
+	return strings.TrimSuffix(mediaType, "+encrypted")
+}
+
+// DockerEncryptedMediaType maps the media type of a plaintext layer to the Docker
+// media type of the encrypted layer; it can be passed to WithEncryptedMediaType for
+// registries rejecting encrypted OCI layer media types. Other media types are kept.
+func DockerEncryptedMediaType(orig string) string {
+	switch orig {
+	case images.MediaTypeDockerSchema2LayerGzip, ocispec.MediaTypeImageLayerGzip:
+		return images.MediaTypeDockerSchema2LayerGzipEnc
+	case images.MediaTypeDockerSchema2Layer, ocispec.MediaTypeImageLayer:
+		return images.MediaTypeDockerSchema2LayerEnc
+	}
+	return ""
+}
+
+// mapEncryptedMediaTypes returns a manifestFunc that sets the media type of encrypted
+// layers to the one fn maps their plaintext media type to; an empty result keeps the
+// media type set by the layer encryption
+func mapEncryptedMediaTypes(fn func(orig string) string) manifestFunc {
+	return func(ctx context.Context, cs content.Store, m *ocispec.Manifest) (bool, error) {
+		var modified bool
+		for i, layer := range m.Layers {
+			if !IsEncryptedMediaType(layer.MediaType) {
+				continue
+			}
+			mediaType := fn(plaintextMediaType(layer.MediaType))
+			if mediaType == "" || mediaType == layer.MediaType {
+				continue
+			}
+			m.Layers[i].MediaType = mediaType
+			modified = true
+		}
+		return modified, nil
+	}
+}
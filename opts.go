@@ -3,6 +3,7 @@ package cryptd
 import (
 	"context"
 
+	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/diff"
 	encconfig "github.com/containerd/containerd/pkg/encryption/config"
 	"github.com/containerd/typeurl"
@@ -12,8 +13,8 @@ import (
 )
 
 // WithDecryptedImageUnpack sets the decryption keys for the client
-func WithDecryptedImageUnpack(config encconfig.DecryptConfig) RemoteOpt {
-	return func(_ *Client, c *RemoteContext) error {
+func WithDecryptedImageUnpack(config encconfig.DecryptConfig) containerd.RemoteOpt {
+	return func(_ *containerd.Client, c *containerd.RemoteContext) error {
 		c.Unpack = true
 		c.UnpackOpts = append(c.UnpackOpts, func(_ context.Context, desc ocispec.Descriptor, c *diff.ApplyConfig) error {
 			if c.ProcessorPayloads == nil {
@@ -35,3 +36,21 @@ func WithDecryptedImageUnpack(config encconfig.DecryptConfig) RemoteOpt {
 		return nil
 	}
 }
+
+// WithDecryptedPull pulls and unpacks the image for the platform into the snapshotter,
+// decrypting its layers with the decryption keys while unpacking
+func WithDecryptedPull(config encconfig.DecryptConfig, platform, snapshotter string) containerd.RemoteOpt {
+	return func(client *containerd.Client, c *containerd.RemoteContext) error {
+		for _, o := range []containerd.RemoteOpt{
+			containerd.WithPullUnpack,
+			containerd.WithPlatform(platform),
+			containerd.WithPullSnapshotter(snapshotter),
+			WithDecryptedImageUnpack(config),
+		} {
+			if err := o(client, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,224 @@
+package cryptd
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// cryptFunc encrypts or decrypts the image rooted at desc
+type cryptFunc func(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, bool, error)
+
+// cryptPlatforms applies fn to the platform manifests of an index in parallel, with at
+// most concurrency manifests being processed at a time. The index is assembled once all
+// manifests completed, keeping their original order. Descriptors other than an index are
+// passed to fn directly.
+func cryptPlatforms(ctx context.Context, cs content.Store, desc ocispec.Descriptor, concurrency int, fn cryptFunc) (ocispec.Descriptor, bool, error) {
+	fn = tracedCryptFunc(fn)
+	if err := ctx.Err(); err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	if !isIndexMediaType(desc.MediaType) {
+		return fn(ctx, desc)
+	}
+
+	var idx index
+	if err := readJSON(ctx, cs, desc, &idx); err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	// manifests missing from the content store are kept in the index as they are
+	missing, err := missingManifests(ctx, cs, idx.Manifests)
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	if len(missing) == 0 && concurrency <= 1 {
+		return fn(ctx, desc)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		eg, egCtx = errgroup.WithContext(ctx)
+		sem       = semaphore.NewWeighted(int64(concurrency))
+		results   = make([]ocispec.Descriptor, len(idx.Manifests))
+		modified  = make([]bool, len(idx.Manifests))
+	)
+	for i, child := range idx.Manifests {
+		if !isManifestMediaType(child.MediaType) && !isIndexMediaType(child.MediaType) || missing[child.Digest] {
+			continue
+		}
+		if err := sem.Acquire(egCtx, 1); err != nil {
+			eg.Go(func() error {
+				return err
+			})
+			break
+		}
+
+		i, child := i, child
+		eg.Go(func() error {
+			defer sem.Release(1)
+
+			// stop before starting on the next platform once cancelled
+			if err := egCtx.Err(); err != nil {
+				return err
+			}
+			newChild, childModified, err := fn(egCtx, child)
+			if err != nil {
+				return err
+			}
+			if childModified {
+				newChild.Platform = child.Platform
+				results[i] = newChild
+				modified[i] = true
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+
+	var indexModified bool
+	for i := range idx.Manifests {
+		if modified[i] {
+			idx.Manifests[i] = results[i]
+			indexModified = true
+		}
+	}
+	if !indexModified {
+		return desc, false, nil
+	}
+	newDesc, err := writeJSON(ctx, cs, desc, &idx, idx.Manifests)
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	return newDesc, true, nil
+}
+
+// missingManifests returns the digests of the manifests and indexes of the index
+// entries whose content is not in the content store
+func missingManifests(ctx context.Context, cs content.Store, manifests []ocispec.Descriptor) (map[digest.Digest]bool, error) {
+	missing := make(map[digest.Digest]bool)
+	for _, m := range manifests {
+		if !isManifestMediaType(m.MediaType) && !isIndexMediaType(m.MediaType) {
+			continue
+		}
+		if _, err := cs.Info(ctx, m.Digest); err != nil {
+			if !errdefs.IsNotFound(err) {
+				return nil, err
+			}
+			missing[m.Digest] = true
+		}
+	}
+	return missing, nil
+}
+
+// LayerDescriptors returns the layers of the image rooted at desc like
+// images.GetImageLayerDescriptors, but manifests of an index that are missing from
+// the content store, as with images only some platforms of which were pulled, are
+// skipped and returned instead. With requireAll a missing manifest is an error.
+func LayerDescriptors(ctx context.Context, cs content.Store, desc ocispec.Descriptor, requireAll bool) ([]ocispec.Descriptor, []ocispec.Descriptor, error) {
+	layers, _, skipped, err := layerDescriptors(ctx, cs, desc, requireAll, false)
+	return layers, skipped, err
+}
+
+// NumberedLayerDescriptors returns the layers and skipped manifests like
+// LayerDescriptors together with the number of every layer, the position of its DiffID
+// in the config of its manifest as given by ManifestLayerOrder. The numbers are
+// computed per manifest from the layers returned for it, see manifestLayerNumbers.
+func NumberedLayerDescriptors(ctx context.Context, cs content.Store, desc ocispec.Descriptor, requireAll bool) ([]ocispec.Descriptor, []int, []ocispec.Descriptor, error) {
+	return layerDescriptors(ctx, cs, desc, requireAll, true)
+}
+
+func layerDescriptors(ctx context.Context, cs content.Store, desc ocispec.Descriptor, requireAll, numbered bool) ([]ocispec.Descriptor, []int, []ocispec.Descriptor, error) {
+	if !isIndexMediaType(desc.MediaType) {
+		layers, err := images.GetImageLayerDescriptors(ctx, cs, desc)
+		if err != nil || !numbered {
+			return layers, nil, nil, err
+		}
+		numbers, err := manifestLayerNumbers(ctx, cs, desc, layers)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return layers, numbers, nil, nil
+	}
+	var idx index
+	if err := readJSON(ctx, cs, desc, &idx); err != nil {
+		return nil, nil, nil, err
+	}
+	missing, err := missingManifests(ctx, cs, idx.Manifests)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var (
+		layers, skipped []ocispec.Descriptor
+		numbers         []int
+	)
+	for _, child := range idx.Manifests {
+		if !isManifestMediaType(child.MediaType) && !isIndexMediaType(child.MediaType) {
+			continue
+		}
+		if missing[child.Digest] {
+			if requireAll {
+				return nil, nil, nil, errors.Wrapf(errdefs.ErrNotFound, "manifest %s of platform %s", child.Digest, formatPlatform(child.Platform))
+			}
+			skipped = append(skipped, child)
+			continue
+		}
+		childLayers, childNumbers, childSkipped, err := layerDescriptors(ctx, cs, child, requireAll, numbered)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if isManifestMediaType(child.MediaType) && child.Platform != nil {
+			// the layers of a manifest are numbered by the platform pointer they share;
+			// give every manifest its own so that manifests with the same platform, as
+			// BuildKit writes for rewritten or attestation manifests, are not merged
+			p := *child.Platform
+			for i := range childLayers {
+				childLayers[i].Platform = &p
+			}
+		}
+		layers = append(layers, childLayers...)
+		numbers = append(numbers, childNumbers...)
+		skipped = append(skipped, childSkipped...)
+	}
+	return layers, numbers, skipped, nil
+}
+
+func formatPlatform(p *ocispec.Platform) string {
+	if p == nil {
+		return "unknown"
+	}
+	return platforms.Format(*p)
+}
+
+// tracedCryptFunc records a span for every manifest or index fn is applied to
+func tracedCryptFunc(fn cryptFunc) cryptFunc {
+	return func(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, bool, error) {
+		attrs := []attribute.KeyValue{
+			attribute.String("digest", desc.Digest.String()),
+		}
+		if desc.Platform != nil {
+			attrs = append(attrs, attribute.String("platform", platforms.Format(*desc.Platform)))
+		}
+		ctx, span := tracer.Start(ctx, "crypt layers", trace.WithAttributes(attrs...))
+		defer span.End()
+
+		newDesc, modified, err := fn(ctx, desc)
+		if err != nil {
+			span.RecordError(err)
+		}
+		return newDesc, modified, err
+	}
+}
@@ -0,0 +1,58 @@
+package cryptd
+
+import (
+	"sync"
+
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+)
+
+// RecipientResolver resolves the value of recipients given as <scheme>:<value> into
+// the crypto config encrypting for the recipient
+type RecipientResolver interface {
+	Scheme() string
+	Resolve(value string) (encconfig.CryptoConfig, error)
+}
+
+var (
+	resolversMu sync.RWMutex
+	resolvers   = make(map[string]RecipientResolver)
+)
+
+// builtinSchemes are the recipient schemes of the layer encryption itself; their
+// recipients are parsed by the cryptd command, which applies its key sources, globs
+// and key type checks to them
+var builtinSchemes = map[string]bool{
+	"jwe":   true,
+	"pkcs7": true,
+	"pgp":   true,
+}
+
+// IsBuiltinRecipientScheme returns whether recipients of the scheme are handled by the
+// layer encryption itself, so that no resolver can be registered for it
+func IsBuiltinRecipientScheme(scheme string) bool {
+	return builtinSchemes[scheme]
+}
+
+// RegisterRecipientResolver makes the resolver available for recipients of its scheme;
+// it panics if a resolver for the scheme is registered already or if it is a builtin scheme
+func RegisterRecipientResolver(r RecipientResolver) {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+
+	if IsBuiltinRecipientScheme(r.Scheme()) {
+		panic("recipient resolver for builtin scheme " + r.Scheme() + " registered")
+	}
+	if _, ok := resolvers[r.Scheme()]; ok {
+		panic("recipient resolver for scheme " + r.Scheme() + " registered twice")
+	}
+	resolvers[r.Scheme()] = r
+}
+
+// GetRecipientResolver returns the resolver registered for the scheme
+func GetRecipientResolver(scheme string) (RecipientResolver, bool) {
+	resolversMu.RLock()
+	defer resolversMu.RUnlock()
+
+	r, ok := resolvers[scheme]
+	return r, ok
+}
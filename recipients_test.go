@@ -0,0 +1,63 @@
+package cryptd
+
+import (
+	"testing"
+
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+)
+
+type testResolver struct {
+	scheme string
+}
+
+func (r testResolver) Scheme() string {
+	return r.scheme
+}
+
+func (r testResolver) Resolve(value string) (encconfig.CryptoConfig, error) {
+	return encconfig.CryptoConfig{}, nil
+}
+
+func TestRegisterRecipientResolver(t *testing.T) {
+	RegisterRecipientResolver(testResolver{scheme: "registry-test"})
+
+	r, ok := GetRecipientResolver("registry-test")
+	if !ok {
+		t.Fatal("registered resolver not found")
+	}
+	if r.Scheme() != "registry-test" {
+		t.Fatalf("got resolver of scheme %s", r.Scheme())
+	}
+	if _, ok := GetRecipientResolver("registry-unknown"); ok {
+		t.Fatal("found a resolver for an unregistered scheme")
+	}
+}
+
+func TestRegisterRecipientResolverPanics(t *testing.T) {
+	RegisterRecipientResolver(testResolver{scheme: "registry-twice"})
+
+	for _, scheme := range []string{"registry-twice", "jwe", "pkcs7", "pgp"} {
+		t.Run(scheme, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("registering a resolver for scheme %s did not panic", scheme)
+				}
+			}()
+			RegisterRecipientResolver(testResolver{scheme: scheme})
+		})
+	}
+}
+
+func TestBuiltinSchemesHaveNoResolver(t *testing.T) {
+	for _, scheme := range []string{"jwe", "pkcs7", "pgp"} {
+		if !IsBuiltinRecipientScheme(scheme) {
+			t.Errorf("scheme %s is not builtin", scheme)
+		}
+		if _, ok := GetRecipientResolver(scheme); ok {
+			t.Errorf("builtin scheme %s has a registered resolver", scheme)
+		}
+	}
+	if IsBuiltinRecipientScheme("registry-test") {
+		t.Error("scheme registry-test is builtin")
+	}
+}
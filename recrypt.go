@@ -0,0 +1,177 @@
+package cryptd
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	imgenc "github.com/containerd/containerd/images/encryption"
+	"github.com/containerd/containerd/pkg/encryption"
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrBlobChanged is returned when recrypting an image rewrote the blob of a layer
+var ErrBlobChanged = errors.New("layer blob changed")
+
+// reencrypt decrypts the layers of the image rooted at desc selected by lf with the
+// decrypt config attached to config and encrypts them again, with a new layer key
+func reencrypt(ctx context.Context, cs content.Store, desc ocispec.Descriptor, config *encconfig.CryptoConfig, lf imgenc.LayerFilter) (ocispec.Descriptor, bool, error) {
+	dc := &encconfig.CryptoConfig{
+		DecryptConfig: &config.EncryptConfig.DecryptConfig,
+	}
+	decrypted, modified, err := imgenc.DecryptImage(ctx, cs, desc, dc, lf)
+	if err != nil || !modified {
+		return desc, false, err
+	}
+	changed, err := changedLayers(ctx, cs, desc, decrypted)
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	return imgenc.EncryptImage(ctx, cs, decrypted, config, func(desc ocispec.Descriptor) bool {
+		return changed[desc.Digest]
+	})
+}
+
+// accessibleOnly restricts lf to the encrypted layers whose layer key is unwrapped by
+// one of the keys of dc; every other encrypted layer is logged once as skipped and
+// passed to skipped, one call at a time
+func (c *CryptoClient) accessibleOnly(dc *encconfig.DecryptConfig, lf imgenc.LayerFilter, skipped func(ocispec.Descriptor)) imgenc.LayerFilter {
+	var (
+		mu         sync.Mutex
+		accessible = make(map[digest.Digest]bool)
+	)
+	return func(desc ocispec.Descriptor) bool {
+		if !lf(desc) {
+			return false
+		}
+		if !IsEncryptedMediaType(desc.MediaType) {
+			return true
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ok, checked := accessible[desc.Digest]
+		if !checked {
+			_, _, _, err := encryption.DecryptLayer(dc, nil, desc, true)
+			ok = err == nil
+			accessible[desc.Digest] = ok
+			if !ok {
+				c.logger.WithFields(logrus.Fields{
+					"layer":    desc.Digest,
+					"platform": formatPlatform(desc.Platform),
+				}).WithError(err).Warn("skipping layer without a key to unwrap its layer key")
+				if skipped != nil {
+					skipped(desc)
+				}
+			}
+		}
+		return ok
+	}
+}
+
+// changedLayers returns the digests of the layers of the manifests referenced by desc
+// that differ from the layer at the same position in the manifests referenced by orig
+func changedLayers(ctx context.Context, cs content.Store, orig, desc ocispec.Descriptor) (map[digest.Digest]bool, error) {
+	origManifests, err := readManifests(ctx, cs, orig)
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := readManifests(ctx, cs, desc)
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[digest.Digest]bool)
+	for i, m := range manifests {
+		for j, layer := range m.Layers {
+			if i >= len(origManifests) || j >= len(origManifests[i].Layers) || origManifests[i].Layers[j].Digest != layer.Digest {
+				changed[layer.Digest] = true
+			}
+		}
+	}
+	return changed, nil
+}
+
+// verifyReencrypted checks that none of the layers selected by lf is still stored in the
+// blob encrypted with the old layer key, which the removed recipients could unwrap, and
+// that the new layer keys are wrapped for the schemes of the recipients of config only
+func verifyReencrypted(ctx context.Context, cs content.Store, orig, desc ocispec.Descriptor, config *encconfig.CryptoConfig, lf imgenc.LayerFilter) error {
+	origManifests, err := readManifests(ctx, cs, orig)
+	if err != nil {
+		return err
+	}
+	manifests, err := readManifests(ctx, cs, desc)
+	if err != nil {
+		return err
+	}
+	if len(origManifests) != len(manifests) {
+		return errors.Errorf("image has %d manifests, expected %d", len(manifests), len(origManifests))
+	}
+	for i, m := range manifests {
+		for j, origLayer := range origManifests[i].Layers {
+			if !lf(origLayer) || j >= len(m.Layers) {
+				continue
+			}
+			if m.Layers[j].Digest == origLayer.Digest {
+				return errors.Errorf("layer %d: %s was not encrypted again", j, origLayer.Digest)
+			}
+			if err := checkWrapSchemes(m.Layers[j], config); err != nil {
+				return errors.Wrapf(err, "layer %d", j)
+			}
+		}
+	}
+	return nil
+}
+
+// schemeRecipientParameters maps the annotations holding the wrapped layer keys to the
+// encrypt config parameter listing the recipients of the scheme
+var schemeRecipientParameters = map[string]string{
+	"org.opencontainers.image.enc.keys.jwe":   "pubkeys",
+	"org.opencontainers.image.enc.keys.pkcs7": "x509s",
+	"org.opencontainers.image.enc.keys.pgp":   "gpg-recipients",
+}
+
+// checkWrapSchemes checks that the layer key of a layer encrypted again is wrapped for
+// the schemes of the recipients of config only, so that moving an image from one scheme
+// to another, i.e. from pgp to jwe, leaves no wrapped key of the old scheme behind
+func checkWrapSchemes(layer ocispec.Descriptor, config *encconfig.CryptoConfig) error {
+	for annotation, param := range schemeRecipientParameters {
+		if layer.Annotations[annotation] == "" {
+			continue
+		}
+		if len(config.EncryptConfig.Parameters[param]) == 0 {
+			return errors.Errorf("%s still has a layer key in %s without recipients of the scheme", layer.Digest, annotation)
+		}
+	}
+	return nil
+}
+
+// verifyBlobsUnchanged checks that the layers of the manifests referenced by desc
+// are stored in the same blobs as the layers of the manifests referenced by orig
+func verifyBlobsUnchanged(ctx context.Context, cs content.Store, orig, desc ocispec.Descriptor) error {
+	origManifests, err := readManifests(ctx, cs, orig)
+	if err != nil {
+		return err
+	}
+	manifests, err := readManifests(ctx, cs, desc)
+	if err != nil {
+		return err
+	}
+	if len(origManifests) != len(manifests) {
+		return errors.Errorf("image has %d manifests, expected %d", len(manifests), len(origManifests))
+	}
+	for i, m := range manifests {
+		if len(m.Layers) != len(origManifests[i].Layers) {
+			return errors.Errorf("manifest has %d layers, expected %d", len(m.Layers), len(origManifests[i].Layers))
+		}
+		for j, layer := range m.Layers {
+			origLayer := origManifests[i].Layers[j]
+			if layer.Digest != origLayer.Digest || layer.Size != origLayer.Size {
+				return errors.Wrapf(ErrBlobChanged, "layer %d: %s is now %s", j, origLayer.Digest, layer.Digest)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package cryptd
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// LayerInfo holds information about an image layer
+type LayerInfo struct {
+	// The Number of this layer in the sequence; starting at 0
+	Index      uint32
+	Descriptor ocispec.Descriptor
+}
+
+// IsUserSelectedLayer checks whether a layer is user-selected given its number
+// A layer can be described with its (positive) index number or its negative number.
+// The latter is counted relative to the topmost one (-1), the former relative to
+// the bottommost one (0).
+func IsUserSelectedLayer(layerIndex, layersTotal int32, layers []int32) bool {
+	if len(layers) == 0 {
+		// convenience for the user; none given means 'all'
+		return true
+	}
+	negNumber := layerIndex - layersTotal
+
+	for _, l := range layers {
+		if l == negNumber || l == layerIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUserExcludedLayer checks whether a layer is excluded by the user given its number;
+// layers are numbered the same way as for IsUserSelectedLayer
+func IsUserExcludedLayer(layerIndex, layersTotal int32, excludeLayers []int32) bool {
+	negNumber := layerIndex - layersTotal
+
+	for _, l := range excludeLayers {
+		if l == negNumber || l == layerIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUserSelectedPlatform determines whether the platform matches one in
+// the array of user-provided platforms. Layers of a manifest without platform,
+// as of an image that is a manifest or an index of a single manifest without
+// platform, belong to the only platform of the image and are always selected.
+func IsUserSelectedPlatform(platform *ocispec.Platform, platformList []ocispec.Platform) bool {
+	if len(platformList) == 0 || platform == nil {
+		// convenience for the user; none given means 'all'
+		return true
+	}
+	matcher := platforms.NewMatcher(*platform)
+
+	for _, p := range platformList {
+		if IsWildcardPlatform(p) {
+			if matchWildcardPlatform(p, platforms.Normalize(*platform)) {
+				return true
+			}
+			continue
+		}
+		if matcher.Match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// platformWildcard matches any OS, architecture or variant in a platform specifier
+const platformWildcard = "*"
+
+// IsWildcardPlatform determines whether a platform parsed by ParsePlatformArray has
+// wildcards; these cannot be passed to the matchers of the platforms package
+func IsWildcardPlatform(p ocispec.Platform) bool {
+	return p.OS == platformWildcard || p.Architecture == platformWildcard || p.Variant == platformWildcard
+}
+
+// matchWildcardPlatform matches the normalized platform against a specifier with
+// wildcards; fields given exactly must be equal, a variant that is not given
+// matches any variant
+func matchWildcardPlatform(spec, platform ocispec.Platform) bool {
+	if spec.OS != platformWildcard && spec.OS != platform.OS {
+		return false
+	}
+	if spec.Architecture != platformWildcard && spec.Architecture != platform.Architecture {
+		return false
+	}
+	return spec.Variant == "" || spec.Variant == platformWildcard || spec.Variant == platform.Variant
+}
+
+// parseWildcardPlatform parses a specifier of the form <os>/<arch>[/<variant>] in which
+// any of the fields may be the wildcard; a lone wildcard matches all platforms
+func parseWildcardPlatform(specifier string) (ocispec.Platform, error) {
+	parts := strings.Split(specifier, "/")
+	if len(parts) == 1 {
+		if parts[0] != platformWildcard {
+			return ocispec.Platform{}, errors.Errorf("invalid platform %s", specifier)
+		}
+		return ocispec.Platform{OS: platformWildcard, Architecture: platformWildcard}, nil
+	}
+	if len(parts) > 3 {
+		return ocispec.Platform{}, errors.Errorf("invalid platform %s", specifier)
+	}
+
+	var p ocispec.Platform
+	p.OS = strings.ToLower(parts[0])
+	if p.OS != platformWildcard {
+		p.OS = platforms.Normalize(ocispec.Platform{OS: p.OS}).OS
+	}
+	p.Architecture = strings.ToLower(parts[1])
+	if len(parts) == 3 {
+		p.Variant = strings.ToLower(parts[2])
+	}
+	if p.Architecture != platformWildcard && p.Variant != platformWildcard {
+		n := platforms.Normalize(ocispec.Platform{Architecture: p.Architecture, Variant: p.Variant})
+		p.Architecture, p.Variant = n.Architecture, n.Variant
+	} else if p.Architecture != platformWildcard {
+		p.Architecture = platforms.Normalize(ocispec.Platform{Architecture: p.Architecture}).Architecture
+	}
+	return p, nil
+}
+
+// CountLayers counts the layers of the manifest whose layers share the platform pointer
+func CountLayers(descs []ocispec.Descriptor, platform *ocispec.Platform) int32 {
+	c := int32(0)
+
+	for _, desc := range descs {
+		if desc.Platform == platform {
+			c = c + 1
+		}
+	}
+
+	return c
+}
+
+// FilterLayerDescriptors selects the layers given by their numbers and platforms; layers
+// that are excluded are removed from the selection afterwards. The layers are numbered
+// by numbers, as returned by NumberedLayerDescriptors for alldescs, or by their position
+// in the manifest if numbers is nil.
+func FilterLayerDescriptors(alldescs []ocispec.Descriptor, numbers []int, layers, excludeLayers []int32, pl []ocispec.Platform) ([]LayerInfo, []ocispec.Descriptor, error) {
+	if numbers != nil && len(numbers) != len(alldescs) {
+		return nil, nil, errors.Errorf("%d layer numbers for %d layers", len(numbers), len(alldescs))
+	}
+	var (
+		layerInfos  []LayerInfo
+		descs       []ocispec.Descriptor
+		curplat     *ocispec.Platform
+		layerIndex  int32
+		layersTotal int32
+	)
+
+	for i, desc := range alldescs {
+		// the layers of a manifest without platform have a nil platform, as has
+		// curplat before the first layer; the first layer always starts a group
+		if i == 0 || curplat != desc.Platform {
+			curplat = desc.Platform
+			layerIndex = 0
+			layersTotal = CountLayers(alldescs, desc.Platform)
+		} else {
+			layerIndex = layerIndex + 1
+		}
+
+		number := layerIndex
+		if numbers != nil {
+			number = int32(numbers[i])
+		}
+		if IsUserSelectedLayer(number, layersTotal, layers) && !IsUserExcludedLayer(number, layersTotal, excludeLayers) && IsUserSelectedPlatform(curplat, pl) {
+			li := LayerInfo{
+				Index:      uint32(number),
+				Descriptor: desc,
+			}
+			descs = append(descs, desc)
+			layerInfos = append(layerInfos, li)
+		}
+	}
+	return layerInfos, descs, nil
+}
+
+// SelectLayerDescriptors returns the layers of the image rooted at desc selected by
+// FilterLayerDescriptors, and the manifests skipped as missing by LayerDescriptors.
+// The layers are numbered by NumberedLayerDescriptors only when layers or excludeLayers
+// are given, so that images whose layers cannot be numbered by their DiffIDs can still
+// be processed as a whole.
+func SelectLayerDescriptors(ctx context.Context, cs content.Store, desc ocispec.Descriptor, layers, excludeLayers []int32, pl []ocispec.Platform, requireAll bool) ([]LayerInfo, []ocispec.Descriptor, []ocispec.Descriptor, error) {
+	var (
+		alldescs, skipped []ocispec.Descriptor
+		numbers           []int
+		err               error
+	)
+	if len(layers) > 0 || len(excludeLayers) > 0 {
+		alldescs, numbers, skipped, err = NumberedLayerDescriptors(ctx, cs, desc, requireAll)
+	} else {
+		alldescs, skipped, err = LayerDescriptors(ctx, cs, desc, requireAll)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	lis, descs, err := FilterLayerDescriptors(alldescs, numbers, layers, excludeLayers, pl)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return lis, descs, skipped, nil
+}
+
+// ParsePlatformArray parses an array of specifiers and converts them into an array of specs.Platform
+// Specifiers that only name an architecture are completed with defaultOS rather than the
+// OS of the host; if defaultOS is empty the host OS is used. Specifiers may use * for any
+// of their fields, such as linux/* or */amd64; a platform is selected when it matches any
+// of the specifiers, exact or wildcard, and layers are excluded with --exclude-layer only.
+func ParsePlatformArray(specifiers []string, defaultOS string) ([]ocispec.Platform, error) {
+	var speclist []ocispec.Platform
+
+	for _, specifier := range specifiers {
+		if strings.Contains(specifier, platformWildcard) {
+			spec, err := parseWildcardPlatform(specifier)
+			if err != nil {
+				return []ocispec.Platform{}, err
+			}
+			speclist = append(speclist, spec)
+			continue
+		}
+		spec, err := platforms.Parse(specifier)
+		if err != nil {
+			return []ocispec.Platform{}, err
+		}
+		if defaultOS != "" && isBareArchitecture(specifier, spec) {
+			spec.OS = platforms.Normalize(ocispec.Platform{OS: defaultOS}).OS
+		}
+		speclist = append(speclist, spec)
+	}
+	return speclist, nil
+}
+
+// isBareArchitecture determines whether the specifier, parsed into spec, only named an
+// architecture so that platforms.Parse filled in the OS of the host
+func isBareArchitecture(specifier string, spec ocispec.Platform) bool {
+	if strings.Contains(specifier, "/") {
+		return false
+	}
+	return platforms.Normalize(ocispec.Platform{OS: strings.ToLower(specifier)}).OS != spec.OS
+}
@@ -0,0 +1,195 @@
+package cryptd
+
+import (
+	"reflect"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestIsUserSelectedLayer(t *testing.T) {
+	for _, tc := range []struct {
+		index    int32
+		layers   []int32
+		selected bool
+	}{
+		{index: 0, selected: true},
+		{index: 0, layers: []int32{0}, selected: true},
+		{index: 2, layers: []int32{-1}, selected: true},
+		{index: 0, layers: []int32{-3}, selected: true},
+		{index: 1, layers: []int32{0, -1}, selected: false},
+		{index: 1, layers: []int32{3}, selected: false},
+	} {
+		if selected := IsUserSelectedLayer(tc.index, 3, tc.layers); selected != tc.selected {
+			t.Errorf("layer %d of 3 with %v: got selected %v, expected %v", tc.index, tc.layers, selected, tc.selected)
+		}
+	}
+}
+
+func TestIsUserExcludedLayer(t *testing.T) {
+	for _, tc := range []struct {
+		index    int32
+		exclude  []int32
+		excluded bool
+	}{
+		{index: 0, excluded: false},
+		{index: 0, exclude: []int32{0}, excluded: true},
+		{index: 2, exclude: []int32{-1}, excluded: true},
+		{index: 1, exclude: []int32{0, -1}, excluded: false},
+	} {
+		if excluded := IsUserExcludedLayer(tc.index, 3, tc.exclude); excluded != tc.excluded {
+			t.Errorf("layer %d of 3 with %v: got excluded %v, expected %v", tc.index, tc.exclude, excluded, tc.excluded)
+		}
+	}
+}
+
+func TestParsePlatformArray(t *testing.T) {
+	for _, tc := range []struct {
+		specifier string
+		defaultOS string
+		platform  ocispec.Platform
+		err       bool
+	}{
+		{specifier: "linux/amd64", platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}},
+		{specifier: "linux/arm/v7", platform: ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{specifier: "arm64", defaultOS: "windows", platform: ocispec.Platform{OS: "windows", Architecture: "arm64"}},
+		{specifier: "linux/*", platform: ocispec.Platform{OS: "linux", Architecture: "*"}},
+		{specifier: "*/amd64", platform: ocispec.Platform{OS: "*", Architecture: "amd64"}},
+		{specifier: "*", platform: ocispec.Platform{OS: "*", Architecture: "*"}},
+		{specifier: "linux/arm/*", platform: ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "*"}},
+		{specifier: "a*", err: true},
+		{specifier: "linux/*/v7/x", err: true},
+	} {
+		t.Run(tc.specifier, func(t *testing.T) {
+			pl, err := ParsePlatformArray([]string{tc.specifier}, tc.defaultOS)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", pl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pl) != 1 || !reflect.DeepEqual(pl[0], tc.platform) {
+				t.Fatalf("got %v, expected %v", pl, tc.platform)
+			}
+		})
+	}
+}
+
+func TestIsUserSelectedPlatform(t *testing.T) {
+	amd64 := &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	armv7 := &ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	windows := &ocispec.Platform{OS: "windows", Architecture: "amd64"}
+
+	for _, tc := range []struct {
+		specifiers []string
+		platform   *ocispec.Platform
+		selected   bool
+	}{
+		{platform: amd64, selected: true},
+		{specifiers: []string{"linux/amd64"}, platform: nil, selected: true},
+		{specifiers: []string{"linux/amd64"}, platform: amd64, selected: true},
+		{specifiers: []string{"linux/amd64"}, platform: armv7, selected: false},
+		{specifiers: []string{"linux/*"}, platform: armv7, selected: true},
+		{specifiers: []string{"linux/*"}, platform: windows, selected: false},
+		{specifiers: []string{"*/amd64"}, platform: windows, selected: true},
+		{specifiers: []string{"linux/arm/*"}, platform: armv7, selected: true},
+		{specifiers: []string{"linux/arm64", "linux/arm/v7"}, platform: armv7, selected: true},
+	} {
+		pl, err := ParsePlatformArray(tc.specifiers, "linux")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selected := IsUserSelectedPlatform(tc.platform, pl); selected != tc.selected {
+			t.Errorf("platform %v with %v: got selected %v, expected %v", tc.platform, tc.specifiers, selected, tc.selected)
+		}
+	}
+}
+
+func TestFilterLayerDescriptors(t *testing.T) {
+	amd64 := &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := &ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	layer := func(name string, p *ocispec.Platform) ocispec.Descriptor {
+		return ocispec.Descriptor{Digest: digest.FromString(name), Platform: p}
+	}
+	alldescs := []ocispec.Descriptor{
+		layer("amd64-0", amd64), layer("amd64-1", amd64), layer("amd64-2", amd64),
+		layer("arm64-0", arm64), layer("arm64-1", arm64),
+	}
+
+	for _, tc := range []struct {
+		name      string
+		numbers   []int
+		layers    []int32
+		exclude   []int32
+		platforms []string
+		selected  []string
+		err       bool
+	}{
+		{
+			name:     "all",
+			selected: []string{"amd64-0", "amd64-1", "amd64-2", "arm64-0", "arm64-1"},
+		},
+		{
+			name:     "topmost of every platform",
+			layers:   []int32{-1},
+			selected: []string{"amd64-2", "arm64-1"},
+		},
+		{
+			name:      "bottommost of a platform",
+			layers:    []int32{0},
+			platforms: []string{"linux/arm64"},
+			selected:  []string{"arm64-0"},
+		},
+		{
+			name:     "excluded",
+			exclude:  []int32{0},
+			selected: []string{"amd64-1", "amd64-2", "arm64-1"},
+		},
+		{
+			name:     "numbered",
+			numbers:  []int{2, 0, 1, 1, 0},
+			layers:   []int32{0},
+			selected: []string{"amd64-1", "arm64-1"},
+		},
+		{
+			name:    "numbers of other layers",
+			numbers: []int{0, 1, 2},
+			err:     true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pl, err := ParsePlatformArray(tc.platforms, "linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			lis, descs, err := FilterLayerDescriptors(alldescs, tc.numbers, tc.layers, tc.exclude, pl)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var selected []digest.Digest
+			for _, name := range tc.selected {
+				selected = append(selected, digest.FromString(name))
+			}
+			var got []digest.Digest
+			for i, d := range descs {
+				got = append(got, d.Digest)
+				if lis[i].Descriptor.Digest != d.Digest {
+					t.Errorf("layer info %d describes %s, expected %s", i, lis[i].Descriptor.Digest, d.Digest)
+				}
+			}
+			if !reflect.DeepEqual(got, selected) {
+				t.Fatalf("selected %v, expected %v", got, selected)
+			}
+		})
+	}
+}
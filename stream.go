@@ -3,14 +3,88 @@ package cryptd
 import (
 	encconfig "github.com/containerd/containerd/pkg/encryption/config"
 	"github.com/containerd/typeurl"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 )
 
+const (
+	// ProcessorPayloadTypeURL is the type url of ProcessorPayload
+	ProcessorPayloadTypeURL = "com.ibm.research.v1.ProcessorPayload"
+	// ProcessorPayloadV2TypeURL is the type url of ProcessorPayloadV2
+	ProcessorPayloadV2TypeURL = "com.ibm.research.v2.ProcessorPayload"
+)
+
+// ErrInvalidPayload is returned by Validate for payloads the stream processor cannot
+// decrypt a layer with
+var ErrInvalidPayload = errors.New("invalid processor payload")
+
 func init() {
-	typeurl.Register(&ProcessorPayload{}, "com.ibm.research.v1.ProcessorPayload")
+	typeurl.Register(&ProcessorPayload{}, ProcessorPayloadTypeURL)
+	typeurl.Register(&ProcessorPayloadV2{}, ProcessorPayloadV2TypeURL)
 }
 
 type ProcessorPayload struct {
 	DecryptConfig encconfig.DecryptConfig `json:"decrypt_config"`
 	Descriptor    ocispec.Descriptor      `json:"descriptor"`
 }
+
+// V2 converts the payload into a ProcessorPayloadV2
+func (p *ProcessorPayload) V2() *ProcessorPayloadV2 {
+	return &ProcessorPayloadV2{
+		DecryptConfig: p.DecryptConfig,
+		Descriptor:    p.Descriptor,
+	}
+}
+
+// Validate checks the payload as ProcessorPayloadV2.Validate does
+func (p *ProcessorPayload) Validate() error {
+	return p.V2().Validate()
+}
+
+// ProcessorPayloadV2 is the second version of the stream processor payload.
+// It is registered under its own type url so that stream processors that only
+// know about ProcessorPayload are not handed a payload they cannot interpret.
+type ProcessorPayloadV2 struct {
+	DecryptConfig encconfig.DecryptConfig  `json:"decrypt_config"`
+	EncryptConfig *encconfig.EncryptConfig `json:"encrypt_config,omitempty"`
+	Descriptor    ocispec.Descriptor       `json:"descriptor"`
+	Options       map[string]string        `json:"options,omitempty"`
+}
+
+// Validate checks that the descriptor is the one of an encrypted layer, with a valid
+// digest, and that the decrypt config holds keys, before a layer is decrypted with the
+// payload
+func (p *ProcessorPayloadV2) Validate() error {
+	if p.Descriptor.MediaType == "" {
+		return errors.Wrap(ErrInvalidPayload, "descriptor has no media type")
+	}
+	if !IsEncryptedMediaType(p.Descriptor.MediaType) {
+		return errors.Wrapf(ErrInvalidPayload, "descriptor media type %s is not an encrypted layer", p.Descriptor.MediaType)
+	}
+	if p.Descriptor.Digest == "" {
+		return errors.Wrap(ErrInvalidPayload, "descriptor has no digest")
+	}
+	if err := p.Descriptor.Digest.Validate(); err != nil {
+		return errors.Wrapf(ErrInvalidPayload, "descriptor digest %s: %v", p.Descriptor.Digest, err)
+	}
+	for _, values := range p.DecryptConfig.Parameters {
+		for _, v := range values {
+			if len(v) > 0 {
+				return nil
+			}
+		}
+	}
+	return errors.Wrap(ErrInvalidPayload, "decrypt config is empty")
+}
+
+// StreamResult is written by the stream processor after decrypting a layer so that
+// the caller can validate the layer it received
+type StreamResult struct {
+	// Size is the size of the decrypted layer
+	Size int64 `json:"size"`
+	// Digest is the digest of the decrypted layer
+	Digest digest.Digest `json:"digest"`
+	// DiffID is the digest of the uncompressed decrypted layer
+	DiffID digest.Digest `json:"diffid"`
+}
@@ -0,0 +1,98 @@
+package cryptd
+
+import (
+	"testing"
+
+	encconfig "github.com/containerd/containerd/pkg/encryption/config"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+func TestProcessorPayloadValidate(t *testing.T) {
+	keys := encconfig.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys": {[]byte("private key")},
+		},
+	}
+	layer := ocispec.Descriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar+gzip+encrypted",
+		Digest:    digest.FromString("layer"),
+	}
+	withLayer := func(fn func(*ocispec.Descriptor)) ocispec.Descriptor {
+		desc := layer
+		fn(&desc)
+		return desc
+	}
+
+	for _, tc := range []struct {
+		name    string
+		payload ProcessorPayloadV2
+		valid   bool
+	}{
+		{
+			name:    "encrypted layer",
+			payload: ProcessorPayloadV2{DecryptConfig: keys, Descriptor: layer},
+			valid:   true,
+		},
+		{
+			name: "docker encrypted layer",
+			payload: ProcessorPayloadV2{DecryptConfig: keys, Descriptor: withLayer(func(d *ocispec.Descriptor) {
+				d.MediaType = "application/vnd.docker.image.rootfs.diff.tar.gzip+encrypted"
+			})},
+			valid: true,
+		},
+		{
+			name: "no media type",
+			payload: ProcessorPayloadV2{DecryptConfig: keys, Descriptor: withLayer(func(d *ocispec.Descriptor) {
+				d.MediaType = ""
+			})},
+		},
+		{
+			name: "plaintext layer",
+			payload: ProcessorPayloadV2{DecryptConfig: keys, Descriptor: withLayer(func(d *ocispec.Descriptor) {
+				d.MediaType = ocispec.MediaTypeImageLayerGzip
+			})},
+		},
+		{
+			name: "no digest",
+			payload: ProcessorPayloadV2{DecryptConfig: keys, Descriptor: withLayer(func(d *ocispec.Descriptor) {
+				d.Digest = ""
+			})},
+		},
+		{
+			name: "invalid digest",
+			payload: ProcessorPayloadV2{DecryptConfig: keys, Descriptor: withLayer(func(d *ocispec.Descriptor) {
+				d.Digest = "sha256:abc"
+			})},
+		},
+		{
+			name:    "no keys",
+			payload: ProcessorPayloadV2{Descriptor: layer},
+		},
+		{
+			name: "empty keys",
+			payload: ProcessorPayloadV2{
+				DecryptConfig: encconfig.DecryptConfig{
+					Parameters: map[string][][]byte{"privkeys": {nil}},
+				},
+				Descriptor: layer,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for version, validate := range map[string]func() error{
+				"v1": (&ProcessorPayload{DecryptConfig: tc.payload.DecryptConfig, Descriptor: tc.payload.Descriptor}).Validate,
+				"v2": tc.payload.Validate,
+			} {
+				err := validate()
+				if tc.valid && err != nil {
+					t.Fatalf("%s: %v", version, err)
+				}
+				if !tc.valid && errors.Cause(err) != ErrInvalidPayload {
+					t.Fatalf("%s: got error %v, expected an invalid payload", version, err)
+				}
+			}
+		})
+	}
+}
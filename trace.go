@@ -0,0 +1,9 @@
+package cryptd
+
+import (
+	"go.opentelemetry.io/otel"
+)
+
+// tracer creates the spans of the library; spans are only recorded when the
+// application installed a tracer provider
+var tracer = otel.Tracer("github.com/crosbymichael/cryptd")
@@ -0,0 +1,208 @@
+package cryptd
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ErrDiffIDMismatch is returned when the uncompressed digest of a decrypted layer
+// does not match the DiffID recorded in the image config
+var ErrDiffIDMismatch = errors.New("layer diffid mismatch")
+
+// verifyDiffIDs recomputes the DiffIDs of the layers decrypted from the image rooted
+// at orig into the image rooted at desc and compares them against the rootfs of the
+// manifest's config. A layer was decrypted when its digest differs from the one at the
+// same position of orig; other layers, still encrypted or never encrypted, are left
+// alone, as are layers whose content is not in cs. The layers are matched with their
+// DiffIDs by the order of the layers of orig, as given by diffIDOrder.
+func verifyDiffIDs(ctx context.Context, cs content.Store, orig, desc ocispec.Descriptor) error {
+	origManifests, err := readManifests(ctx, cs, orig)
+	if err != nil {
+		return err
+	}
+	manifests, err := readManifests(ctx, cs, desc)
+	if err != nil {
+		return err
+	}
+	if len(manifests) != len(origManifests) {
+		return errors.Errorf("image has %d manifests, expected %d", len(manifests), len(origManifests))
+	}
+	for i, manifest := range manifests {
+		origLayers := origManifests[i].Layers
+		if len(origLayers) != len(manifest.Layers) {
+			return errors.Errorf("manifest has %d layers, expected %d", len(manifest.Layers), len(origLayers))
+		}
+		order, err := manifestLayerOrder(ctx, cs, origManifests[i])
+		if err != nil {
+			return err
+		}
+		if order == nil {
+			// there are no DiffIDs to verify the layers against
+			continue
+		}
+		diffIDs, err := images.RootFS(ctx, cs, manifest.Config)
+		if err != nil {
+			return err
+		}
+		if len(diffIDs) != len(manifest.Layers) {
+			return errors.Wrapf(ErrDiffIDMismatch, "config %s has %d diffids for %d layers", manifest.Config.Digest, len(diffIDs), len(manifest.Layers))
+		}
+		for j, layer := range manifest.Layers {
+			if layer.Digest == origLayers[j].Digest {
+				continue
+			}
+			if _, err := cs.Info(ctx, layer.Digest); err != nil {
+				if errdefs.IsNotFound(err) {
+					continue
+				}
+				return err
+			}
+			diffID, err := layerDiffID(ctx, cs, layer)
+			if err != nil {
+				return err
+			}
+			if expected := diffIDs[order[j]]; diffID != expected {
+				return errors.Wrapf(ErrDiffIDMismatch, "layer %s has diffid %s, expected %s", layer.Digest, diffID, expected)
+			}
+		}
+	}
+	return nil
+}
+
+// diffIDOrder maps the layers of a manifest to the positions of their DiffIDs in the
+// rootfs of the config. Some images list the layers in the manifest in another order
+// than their DiffIDs; a layer is mapped by the DiffID of its uncompressedAnnotation,
+// which does not depend on whether the layer is encrypted, and otherwise to the DiffID
+// at its own position. A mapping that does not take every DiffID exactly once is
+// rejected, so swapped or duplicated layers are not matched with the wrong DiffIDs.
+func diffIDOrder(layers []ocispec.Descriptor, diffIDs []digest.Digest) ([]int, error) {
+	if len(diffIDs) != len(layers) {
+		return nil, errors.Wrapf(ErrDiffIDMismatch, "%d diffids for %d layers", len(diffIDs), len(layers))
+	}
+	positions := make(map[digest.Digest]int, len(diffIDs))
+	for i, d := range diffIDs {
+		if _, ok := positions[d]; ok {
+			// repeated DiffIDs, i.e. of empty layers, cannot be told apart
+			positions[d] = -1
+			continue
+		}
+		positions[d] = i
+	}
+
+	var (
+		order = make([]int, len(layers))
+		taken = make([]bool, len(diffIDs))
+	)
+	for i, layer := range layers {
+		order[i] = i
+		if v := layer.Annotations[uncompressedAnnotation]; v != "" {
+			pos, ok := positions[digest.Digest(v)]
+			if !ok {
+				return nil, errors.Wrapf(ErrDiffIDMismatch, "layer %s has diffid %s, which is not in the config", layer.Digest, v)
+			}
+			if pos >= 0 {
+				order[i] = pos
+			}
+		}
+		if taken[order[i]] {
+			return nil, errors.Wrapf(ErrDiffIDMismatch, "layer %s maps to diffid %s of another layer", layer.Digest, diffIDs[order[i]])
+		}
+		taken[order[i]] = true
+	}
+	return order, nil
+}
+
+// manifestLayerOrder returns the diffIDOrder of the layers of the manifest, or nil for
+// manifests without DiffIDs, such as attestation manifests
+func manifestLayerOrder(ctx context.Context, cs content.Store, m ocispec.Manifest) ([]int, error) {
+	if !isImageConfigMediaType(m.Config.MediaType) {
+		return nil, nil
+	}
+	diffIDs, err := images.RootFS(ctx, cs, m.Config)
+	if err != nil {
+		return nil, err
+	}
+	if len(diffIDs) == 0 {
+		return nil, nil
+	}
+	order, err := diffIDOrder(m.Layers, diffIDs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "config %s", m.Config.Digest)
+	}
+	return order, nil
+}
+
+// ManifestLayerOrder returns the position of the DiffID in the config of every layer of
+// the manifest; layers of manifests without DiffIDs keep their position in the manifest
+func ManifestLayerOrder(ctx context.Context, cs content.Store, m ocispec.Manifest) ([]int, error) {
+	order, err := manifestLayerOrder(ctx, cs, m)
+	if err != nil || order != nil {
+		return order, err
+	}
+	order = make([]int, len(m.Layers))
+	for i := range order {
+		order[i] = i
+	}
+	return order, nil
+}
+
+// manifestLayerNumbers returns the numbers of layers, the layers of the manifest desc
+// as images.GetImageLayerDescriptors returns them: the manifestLayerOrder positions of
+// the layers, or their positions in layers for manifests without DiffIDs. Layers cannot
+// be numbered by their DiffIDs if the returned layers are not the ones of the manifest,
+// which happens when entries of other media types are left out.
+func manifestLayerNumbers(ctx context.Context, cs content.Store, desc ocispec.Descriptor, layers []ocispec.Descriptor) ([]int, error) {
+	var m manifest
+	if err := readJSON(ctx, cs, desc, &m); err != nil {
+		return nil, err
+	}
+	order, err := manifestLayerOrder(ctx, cs, m.Manifest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "manifest %s", desc.Digest)
+	}
+	numbers := make([]int, len(layers))
+	if order == nil {
+		for i := range numbers {
+			numbers[i] = i
+		}
+		return numbers, nil
+	}
+	if len(order) != len(m.Layers) || len(layers) != len(m.Layers) {
+		return nil, errors.Errorf("manifest %s has %d layers, %d of which can be numbered by %d diffids", desc.Digest, len(m.Layers), len(layers), len(order))
+	}
+	for i, layer := range layers {
+		if layer.Digest != m.Layers[i].Digest {
+			return nil, errors.Errorf("layer %s is not at position %d of manifest %s", layer.Digest, i, desc.Digest)
+		}
+		numbers[i] = order[i]
+	}
+	return numbers, nil
+}
+
+func isImageConfigMediaType(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageConfig || mediaType == images.MediaTypeDockerSchema2Config
+}
+
+// layerDiffID computes the digest of the uncompressed layer content
+func layerDiffID(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (digest.Digest, error) {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return "", err
+	}
+	defer ra.Close()
+
+	r, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to decompress layer %s", desc.Digest)
+	}
+	defer r.Close()
+
+	return digest.Canonical.FromReader(r)
+}
@@ -0,0 +1,317 @@
+package cryptd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// newTestStore returns a content store in a new temporary directory; the returned
+// function removes it again
+func newTestStore(t *testing.T) (content.Store, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "cryptd-content-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := local.NewStore(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return cs, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// writeTestBlob writes the blob to cs and returns its descriptor
+func writeTestBlob(ctx context.Context, t *testing.T, cs content.Store, mediaType string, p []byte) ocispec.Descriptor {
+	t.Helper()
+
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(p),
+		Size:      int64(len(p)),
+	}
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(p), desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// writeTestManifest writes a manifest of the layers, in the given order, whose config
+// lists diffIDs
+func writeTestManifest(ctx context.Context, t *testing.T, cs content.Store, layers []ocispec.Descriptor, diffIDs []digest.Digest) ocispec.Descriptor {
+	t.Helper()
+
+	config, err := json.Marshal(ocispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageConfig, config),
+		Layers:    layers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageManifest, manifest)
+}
+
+// writeTestLayers writes uncompressed layers of the contents, annotated with their
+// DiffIDs, and returns their descriptors and DiffIDs
+func writeTestLayers(ctx context.Context, t *testing.T, cs content.Store, contents ...string) ([]ocispec.Descriptor, []digest.Digest) {
+	t.Helper()
+
+	var (
+		layers  []ocispec.Descriptor
+		diffIDs []digest.Digest
+	)
+	for _, c := range contents {
+		desc := writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageLayer, []byte(c))
+		desc.Annotations = map[string]string{uncompressedAnnotation: desc.Digest.String()}
+		layers = append(layers, desc)
+		diffIDs = append(diffIDs, desc.Digest)
+	}
+	return layers, diffIDs
+}
+
+func layerDescriptor(diffID digest.Digest) ocispec.Descriptor {
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("blob of " + diffID.String()),
+	}
+	if diffID != "" {
+		desc.Annotations = map[string]string{uncompressedAnnotation: diffID.String()}
+	}
+	return desc
+}
+
+func TestDiffIDOrder(t *testing.T) {
+	var (
+		a     = digest.FromString("a")
+		b     = digest.FromString("b")
+		c     = digest.FromString("c")
+		empty = digest.FromString("")
+	)
+	for _, tc := range []struct {
+		name    string
+		layers  []ocispec.Descriptor
+		diffIDs []digest.Digest
+		order   []int
+		err     bool
+	}{
+		{
+			name:    "config order",
+			layers:  []ocispec.Descriptor{layerDescriptor(a), layerDescriptor(b), layerDescriptor(c)},
+			diffIDs: []digest.Digest{a, b, c},
+			order:   []int{0, 1, 2},
+		},
+		{
+			name:    "out of order",
+			layers:  []ocispec.Descriptor{layerDescriptor(c), layerDescriptor(a), layerDescriptor(b)},
+			diffIDs: []digest.Digest{a, b, c},
+			order:   []int{2, 0, 1},
+		},
+		{
+			name:    "without annotations",
+			layers:  []ocispec.Descriptor{layerDescriptor(""), layerDescriptor("")},
+			diffIDs: []digest.Digest{a, b},
+			order:   []int{0, 1},
+		},
+		{
+			name:    "repeated diffids are positional",
+			layers:  []ocispec.Descriptor{layerDescriptor(empty), layerDescriptor(a), layerDescriptor(empty)},
+			diffIDs: []digest.Digest{empty, a, empty},
+			order:   []int{0, 1, 2},
+		},
+		{
+			name:    "annotated and positional layer collide",
+			layers:  []ocispec.Descriptor{layerDescriptor(""), layerDescriptor(a)},
+			diffIDs: []digest.Digest{a, b},
+			err:     true,
+		},
+		{
+			name:    "duplicated layer",
+			layers:  []ocispec.Descriptor{layerDescriptor(a), layerDescriptor(a)},
+			diffIDs: []digest.Digest{a, b},
+			err:     true,
+		},
+		{
+			name:    "diffid not in config",
+			layers:  []ocispec.Descriptor{layerDescriptor(c), layerDescriptor(a)},
+			diffIDs: []digest.Digest{a, b},
+			err:     true,
+		},
+		{
+			name:    "fewer diffids than layers",
+			layers:  []ocispec.Descriptor{layerDescriptor(a), layerDescriptor(b)},
+			diffIDs: []digest.Digest{a},
+			err:     true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			order, err := diffIDOrder(tc.layers, tc.diffIDs)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got order %v", order)
+				}
+				if errors.Cause(err) != ErrDiffIDMismatch {
+					t.Fatalf("got error %v, expected a diffid mismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(order, tc.order) {
+				t.Fatalf("got order %v, expected %v", order, tc.order)
+			}
+		})
+	}
+}
+
+func TestNumberedLayerDescriptors(t *testing.T) {
+	ctx := context.Background()
+	cs, cleanup := newTestStore(t)
+	defer cleanup()
+
+	layers, diffIDs := writeTestLayers(ctx, t, cs, "a", "b", "c")
+	// the manifest lists the topmost layer first
+	target := writeTestManifest(ctx, t, cs, []ocispec.Descriptor{layers[2], layers[0], layers[1]}, diffIDs)
+
+	descs, numbers, skipped, err := NumberedLayerDescriptors(ctx, cs, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 0 {
+		t.Fatalf("skipped manifests %v", skipped)
+	}
+	if len(descs) != 3 || descs[0].Digest != layers[2].Digest {
+		t.Fatalf("got layers %v, expected the layers in manifest order", descs)
+	}
+	if !reflect.DeepEqual(numbers, []int{2, 0, 1}) {
+		t.Fatalf("got numbers %v, expected [2 0 1]", numbers)
+	}
+
+	// --layer 0 selects the bottommost layer, listed second
+	_, selected, err := FilterLayerDescriptors(descs, numbers, []int32{0}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0].Digest != layers[0].Digest {
+		t.Fatalf("layer 0 selected %v, expected %s", selected, layers[0].Digest)
+	}
+	// -1 is the topmost layer, listed first
+	_, selected, err = FilterLayerDescriptors(descs, numbers, []int32{-1}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0].Digest != layers[2].Digest {
+		t.Fatalf("layer -1 selected %v, expected %s", selected, layers[2].Digest)
+	}
+}
+
+func TestNumberedLayerDescriptorsMismatch(t *testing.T) {
+	ctx := context.Background()
+	cs, cleanup := newTestStore(t)
+	defer cleanup()
+
+	layers, diffIDs := writeTestLayers(ctx, t, cs, "a", "b")
+	// both layers claim the DiffID of the first one
+	layers[1].Annotations[uncompressedAnnotation] = diffIDs[0].String()
+	target := writeTestManifest(ctx, t, cs, layers, diffIDs)
+
+	if _, _, _, err := NumberedLayerDescriptors(ctx, cs, target, false); err == nil {
+		t.Fatal("expected the layers not to be numbered")
+	}
+
+	// without a layer selection the image is processed as a whole
+	_, selected, _, err := SelectLayerDescriptors(ctx, cs, target, nil, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 {
+		t.Fatalf("selected %d layers, expected all 2", len(selected))
+	}
+	if _, _, _, err := SelectLayerDescriptors(ctx, cs, target, []int32{0}, nil, nil, false); err == nil {
+		t.Fatal("expected selecting a layer to fail")
+	}
+}
+
+func TestVerifyDiffIDs(t *testing.T) {
+	ctx := context.Background()
+	cs, cleanup := newTestStore(t)
+	defer cleanup()
+
+	layers, diffIDs := writeTestLayers(ctx, t, cs, "a", "b")
+	// stand-ins for the encrypted blobs, which the config has no DiffIDs of
+	encrypted := []ocispec.Descriptor{
+		writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageLayer, []byte("encrypted a")),
+		writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageLayer, []byte("encrypted b")),
+	}
+	missing := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromString("not fetched"),
+		Size:      int64(len("not fetched")),
+	}
+	orig := writeTestManifest(ctx, t, cs, encrypted, diffIDs)
+
+	for _, tc := range []struct {
+		name   string
+		layers []ocispec.Descriptor
+		err    bool
+	}{
+		{
+			name:   "all decrypted",
+			layers: []ocispec.Descriptor{layers[0], layers[1]},
+		},
+		{
+			name:   "layer left encrypted",
+			layers: []ocispec.Descriptor{layers[0], encrypted[1]},
+		},
+		{
+			name:   "decrypted layer not in the store",
+			layers: []ocispec.Descriptor{missing, layers[1]},
+		},
+		{
+			name:   "decrypted to the wrong content",
+			layers: []ocispec.Descriptor{layers[1], encrypted[1]},
+			err:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			desc := writeTestManifest(ctx, t, cs, tc.layers, diffIDs)
+			err := verifyDiffIDs(ctx, cs, orig, desc)
+			if tc.err {
+				if errors.Cause(err) != ErrDiffIDMismatch {
+					t.Fatalf("got error %v, expected a diffid mismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}